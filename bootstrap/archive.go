@@ -0,0 +1,324 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats recognized by ADD.
+const (
+	compressionNone  = "none"
+	compressionBzip2 = "bzip2"
+	compressionGzip  = "gzip"
+	compressionXz    = "xz"
+)
+
+// paxXattrPrefix is the prefix of the PAX records holding extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+var (
+	magicBzip2 = []byte{0x42, 0x5A, 0x68}
+	magicGzip  = []byte{0x1F, 0x8B, 0x08}
+	magicXz    = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
+)
+
+// detectCompression detects the compression format from the first bytes of the content.
+func detectCompression(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, magicBzip2):
+		return compressionBzip2
+	case bytes.HasPrefix(header, magicGzip):
+		return compressionGzip
+	case bytes.HasPrefix(header, magicXz):
+		return compressionXz
+	}
+	return compressionNone
+}
+
+// archiveReader is a tar reader over a possibly compressed file.
+type archiveReader struct {
+	*tar.Reader
+	closers []io.Closer
+}
+
+func (r *archiveReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openArchive opens a tar archive compressed with any of the supported formats.
+func openArchive(path string) (*archiveReader, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	result := &archiveReader{closers: []io.Closer{file}}
+
+	buffered := bufio.NewReader(file)
+	header, err := buffered.Peek(len(magicXz))
+	if err != nil && err != io.EOF {
+		result.Close()
+		return nil, "", err
+	}
+
+	var reader io.Reader = buffered
+	compression := detectCompression(header)
+	switch compression {
+	case compressionBzip2:
+		reader = bzip2.NewReader(buffered)
+	case compressionGzip:
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			result.Close()
+			return nil, "", err
+		}
+		result.closers = append(result.closers, gzipReader)
+		reader = gzipReader
+	case compressionXz:
+		xzReader, err := xz.NewReader(buffered)
+		if err != nil {
+			result.Close()
+			return nil, "", err
+		}
+		reader = xzReader
+	}
+
+	result.Reader = tar.NewReader(reader)
+	return result, compression, nil
+}
+
+// isArchive returns true if the file is a tar archive, compressed or not.
+// Like Docker, it relies on the content, not on the file name.
+func isArchive(path string) (bool, error) {
+	archive, _, err := openArchive(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	defer archive.Close()
+	if _, err := archive.Next(); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// extractArchive extracts the tar archive into the destination directory resolved within the root.
+// Modes, ownership, symlinks, hardlinks, modification times and extended attributes are preserved, the settings override
+// the ownership and the mode. Entries which would end up outside of the destination directory are refused.
+func extractArchive(logger hclog.Logger, archivePath, root, destination string, settings *deploySettings) error {
+	archive, compression, err := openArchive(archivePath)
+	if err != nil {
+		return errors.Wrap(err, "failed opening archive")
+	}
+	defer archive.Close()
+
+	logger.Debug("extracting archive", "archive", archivePath, "compression", compression, "destination", destination)
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return err
+	}
+
+	// directory times must be set after all the content is written:
+	directoryTimes := map[string]time.Time{}
+	nEntries := 0
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed reading archive")
+		}
+
+		entryPath, err := archiveEntryPath(root, destination, header.Name)
+		if err != nil {
+			return err
+		}
+		if entryPath == destination && header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("archive entry '%s' can't replace the destination directory", header.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(entryPath), 0755); err != nil {
+			return err
+		}
+
+		mode := header.FileInfo().Mode()
+		if settings.mode != nil {
+			mode = *settings.mode
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(entryPath); err == nil && !info.IsDir() {
+				if err := os.Remove(entryPath); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return err
+			}
+			directoryTimes[entryPath] = header.ModTime
+		case tar.TypeReg, tar.TypeRegA:
+			if err := removeIfNotDirectory(entryPath); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(entryPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, archive); err != nil {
+				file.Close()
+				return errors.Wrapf(err, "failed extracting archive entry '%s'", header.Name)
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// the target is resolved in the guest, it does not have to be within the destination:
+			if err := removeIfNotDirectory(entryPath); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, entryPath); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkTarget, err := archiveEntryPath(root, destination, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := removeIfNotDirectory(entryPath); err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, entryPath); err != nil {
+				return err
+			}
+			nEntries = nEntries + 1
+			continue // a hardlink shares ownership, mode and times with the target
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := removeIfNotDirectory(entryPath); err != nil {
+				return err
+			}
+			deviceMode := uint32(mode.Perm())
+			switch header.Typeflag {
+			case tar.TypeChar:
+				deviceMode = deviceMode | syscall.S_IFCHR
+			case tar.TypeBlock:
+				deviceMode = deviceMode | syscall.S_IFBLK
+			case tar.TypeFifo:
+				deviceMode = deviceMode | syscall.S_IFIFO
+			}
+			device := int((header.Devminor & 0xff) | ((header.Devmajor & 0xfff) << 8) | ((header.Devminor &^ 0xff) << 12) | ((header.Devmajor &^ 0xfff) << 32))
+			if err := syscall.Mknod(entryPath, deviceMode, device); err != nil {
+				return errors.Wrapf(err, "failed creating device node '%s'", header.Name)
+			}
+		default:
+			logger.Warn("unsupported archive entry type, skipping", "name", header.Name, "type", string(header.Typeflag))
+			continue
+		}
+
+		nEntries = nEntries + 1
+
+		// ownership before mode, chown clears the setuid and setgid bits:
+		uid, gid := header.Uid, header.Gid
+		if settings.uid > -1 || settings.gid > -1 {
+			uid, gid = settings.uid, settings.gid
+		}
+		if os.Geteuid() == 0 || settings.uid > -1 || settings.gid > -1 {
+			if err := os.Lchown(entryPath, uid, gid); err != nil {
+				return errors.Wrapf(err, "failed changing ownership of archive entry '%s'", header.Name)
+			}
+		}
+		// symlinks have no mode:
+		if header.Typeflag != tar.TypeSymlink {
+			if err := os.Chmod(entryPath, mode); err != nil {
+				return errors.Wrapf(err, "failed changing mode of archive entry '%s'", header.Name)
+			}
+		}
+		if err := setXattrs(entryPath, archiveEntryXattrs(header)); err != nil {
+			return errors.Wrapf(err, "failed setting extended attributes of archive entry '%s'", header.Name)
+		}
+		if header.Typeflag != tar.TypeDir {
+			if err := setModTime(entryPath, header.ModTime); err != nil {
+				return errors.Wrapf(err, "failed changing times of archive entry '%s'", header.Name)
+			}
+		}
+	}
+
+	for path, modTime := range directoryTimes {
+		if err := setModTime(path, modTime); err != nil {
+			return errors.Wrapf(err, "failed changing times of directory '%s'", path)
+		}
+	}
+
+	logger.Debug("archive extracted", "archive", archivePath, "destination", destination, "number-of-entries", nEntries)
+
+	return nil
+}
+
+// archiveEntryPath resolves the on disk path of an archive entry within the root,
+// the entry must stay in the destination directory, also when resolving the symlinks on the way.
+// Like with tar, a leading slash is removed so absolute entries land in the destination directory.
+func archiveEntryPath(root, destination, name string) (string, error) {
+	cleaned, err := cleanConfinedPath(destination, name)
+	if err != nil {
+		return "", &PathViolationError{Root: destination, Path: name, Reason: PathViolationEscapesDestination}
+	}
+	relativeDestination, err := filepath.Rel(root, destination)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := resolveInRoot(root, filepath.Join(relativeDestination, cleaned), false)
+	if err != nil {
+		return "", err
+	}
+	if !isBeneath(destination, resolved) {
+		return "", &PathViolationError{Root: destination, Path: name, Reason: PathViolationEscapesDestination}
+	}
+	return resolved, nil
+}
+
+// archiveEntryXattrs returns the extended attributes of the entry stored in the PAX records.
+func archiveEntryXattrs(header *tar.Header) map[string][]byte {
+	xattrs := map[string][]byte{}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = []byte(value)
+		}
+	}
+	return xattrs
+}
+
+func removeIfNotDirectory(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("'%s' exists and is a directory", path)
+	}
+	return os.Remove(path)
+}
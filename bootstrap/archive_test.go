@@ -0,0 +1,265 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+type testArchiveEntry struct {
+	header  *tar.Header
+	content string
+}
+
+var testArchiveModTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func mustBuildTestArchive(t *testing.T, entries []testArchiveEntry) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	writer := tar.NewWriter(buffer)
+	for _, entry := range entries {
+		entry.header.Size = int64(len(entry.content))
+		if entry.header.ModTime.IsZero() {
+			entry.header.ModTime = testArchiveModTime
+		}
+		if err := writer.WriteHeader(entry.header); err != nil {
+			t.Fatal("failed writing test archive header", err)
+		}
+		if _, err := writer.Write([]byte(entry.content)); err != nil {
+			t.Fatal("failed writing test archive content", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("failed closing test archive", err)
+	}
+	return buffer.Bytes()
+}
+
+func mustCompress(t *testing.T, compression string, input []byte) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	switch compression {
+	case compressionNone:
+		return input
+	case compressionGzip:
+		writer := gzip.NewWriter(buffer)
+		writer.Write(input)
+		writer.Close()
+	case compressionXz:
+		writer, err := xz.NewWriter(buffer)
+		if err != nil {
+			t.Fatal("failed creating xz writer", err)
+		}
+		writer.Write(input)
+		writer.Close()
+	case compressionBzip2:
+		cmd := exec.Command("bzip2", "-c")
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = buffer
+		if err := cmd.Run(); err != nil {
+			t.Skip("bzip2 not available", err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func addTestResource(t *testing.T, source, target string, content []byte) (commands.Add, *recordingClient) {
+	cmd := commands.Add{
+		OriginalCommand: "ADD " + source + " " + target,
+		OriginalSource:  source,
+		Source:          source,
+		Target:          target,
+		User:            commands.DefaultUser(),
+		Workdir:         commands.DefaultWorkdir(),
+	}
+	client := &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			source: {
+				resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(content)), nil
+				}, fs.FileMode(0644), source, target, cmd.Workdir, cmd.User),
+			},
+		},
+	}
+	return cmd, client
+}
+
+func TestAddExtractsArchives(t *testing.T) {
+	archive := mustBuildTestArchive(t, []testArchiveEntry{
+		{header: &tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0750}},
+		{header: &tar.Header{Name: "app/bin/run", Typeflag: tar.TypeReg, Mode: 0755}, content: "#!/bin/sh\n"},
+		{header: &tar.Header{Name: "app/config", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1000}, content: "config"},
+		{header: &tar.Header{Name: "app/config-link", Typeflag: tar.TypeSymlink, Linkname: "config"}},
+		{header: &tar.Header{Name: "app/config-hardlink", Typeflag: tar.TypeLink, Linkname: "app/config"}},
+	})
+
+	for _, compression := range []string{compressionNone, compressionGzip, compressionBzip2, compressionXz} {
+		t.Run(compression, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal("expected temp dir, got error", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			deployer := newTestResourceDeployer(hclog.Default(), tempDir)
+			cmd, client := addTestResource(t, "app.tar", "/opt/", mustCompress(t, compression, archive))
+			assert.Nil(t, deployer.Add(cmd, client))
+
+			content, err := ioutil.ReadFile(filepath.Join(tempDir, "opt/app/config"))
+			assert.Nil(t, err)
+			assert.Equal(t, "config", string(content))
+
+			for path, expectedMode := range map[string]fs.FileMode{
+				"opt/app":         fs.ModeDir | 0750,
+				"opt/app/bin/run": 0755,
+				"opt/app/config":  0640,
+			} {
+				info, err := os.Lstat(filepath.Join(tempDir, path))
+				assert.Nil(t, err)
+				assert.Equal(t, expectedMode, info.Mode(), path)
+				assert.True(t, info.ModTime().Equal(testArchiveModTime), path)
+			}
+
+			if os.Geteuid() == 0 {
+				info, _ := os.Lstat(filepath.Join(tempDir, "opt/app/config"))
+				assert.Equal(t, uint32(1000), info.Sys().(*syscall.Stat_t).Uid)
+			}
+
+			linkTarget, err := os.Readlink(filepath.Join(tempDir, "opt/app/config-link"))
+			assert.Nil(t, err)
+			assert.Equal(t, "config", linkTarget)
+
+			original, _ := os.Stat(filepath.Join(tempDir, "opt/app/config"))
+			hardlink, err := os.Stat(filepath.Join(tempDir, "opt/app/config-hardlink"))
+			assert.Nil(t, err)
+			assert.True(t, os.SameFile(original, hardlink))
+
+			// the archive itself is not written:
+			_, err = os.Stat(filepath.Join(tempDir, "opt/app.tar"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestAddCopiesNonArchives(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	deployer := newTestResourceDeployer(hclog.Default(), tempDir)
+
+	// the name does not matter, the content does:
+	cmd, client := addTestResource(t, "not-an-archive.tar.gz", "/opt/", []byte("plain content"))
+	assert.Nil(t, deployer.Add(cmd, client))
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, "opt/not-an-archive.tar.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "plain content", string(content))
+
+	// a compressed file which is not a tar archive is copied as is:
+	compressed := mustCompress(t, compressionGzip, []byte("plain content"))
+	cmd, client = addTestResource(t, "file.gz", "/opt/", compressed)
+	assert.Nil(t, deployer.Add(cmd, client))
+	content, err = ioutil.ReadFile(filepath.Join(tempDir, "opt/file.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, compressed, content)
+}
+
+func TestExtractArchiveRefusesEscapes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	outsideDir := filepath.Join(tempDir, "outside")
+	if err := os.MkdirAll(outsideDir, 0755); err != nil {
+		t.Fatal("expected outside directory, got error", err)
+	}
+
+	for name, entries := range map[string][]testArchiveEntry{
+		"parent-traversal": {
+			{header: &tar.Header{Name: "../outside/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"},
+		},
+		"symlink-traversal": {
+			{header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outsideDir}},
+			{header: &tar.Header{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"},
+		},
+		"hardlink-traversal": {
+			{header: &tar.Header{Name: "evil", Typeflag: tar.TypeLink, Linkname: "../outside/target"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			deployer := newTestResourceDeployer(hclog.Default(), filepath.Join(tempDir, "root"))
+			cmd, client := addTestResource(t, "evil.tar", "/opt/", mustBuildTestArchive(t, entries))
+			assert.NotNil(t, deployer.Add(cmd, client))
+			_, err := os.Stat(filepath.Join(outsideDir, "evil"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+
+	// absolute entries are extracted into the destination:
+	deployer := newTestResourceDeployer(hclog.Default(), filepath.Join(tempDir, "root"))
+	cmd, client := addTestResource(t, "absolute.tar", "/opt/", mustBuildTestArchive(t, []testArchiveEntry{
+		{header: &tar.Header{Name: "/etc/absolute", Typeflag: tar.TypeReg, Mode: 0644}, content: "absolute"},
+	}))
+	assert.Nil(t, deployer.Add(cmd, client))
+	_, err = os.Stat(filepath.Join(tempDir, "root/opt/etc/absolute"))
+	assert.Nil(t, err)
+}
+
+func TestAddCopiesArchivesOfDirectorySources(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	archive := mustCompress(t, compressionGzip, mustBuildTestArchive(t, []testArchiveEntry{
+		{header: &tar.Header{Name: "extracted", Typeflag: tar.TypeReg, Mode: 0644}, content: "extracted"},
+	}))
+
+	workdir := commands.DefaultWorkdir()
+	cmd := commands.Add{
+		OriginalCommand: "ADD dist /opt/",
+		OriginalSource:  "dist",
+		Source:          "dist",
+		Target:          "/opt/",
+		User:            commands.DefaultUser(),
+		Workdir:         workdir,
+	}
+	client := &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"dist": {
+				resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755), "dist", "dist", "/opt/", workdir, cmd.User),
+				resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(archive)), nil
+				}, fs.FileMode(0644), "dist/release.tar.gz", "/opt/release.tar.gz", workdir, cmd.User),
+			},
+		},
+	}
+
+	deployer := newTestResourceDeployer(hclog.Default(), tempDir)
+	assert.Nil(t, deployer.Add(cmd, client))
+
+	// an archive within a directory source is copied as is:
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, "opt/release.tar.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, archive, content)
+	_, err = os.Stat(filepath.Join(tempDir, "opt/extracted"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,6 +1,7 @@
 package bootstrap
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -14,30 +15,87 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Timeout scopes reported with TimeoutError.
+const (
+	TimeoutScopeBuild   = "build"
+	TimeoutScopeCommand = "command"
+)
+
+// TimeoutError is reported to the server when the bootstrap or a RUN command exceeds its timeout.
+type TimeoutError struct {
+	// Command is the original command which was executing when the timeout was exceeded.
+	Command string
+	// Scope is one of the TimeoutScope... scopes.
+	Scope string
+	// Timeout is the exceeded timeout.
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %s exceeded: %s", e.Scope, e.Timeout, e.Command)
+}
+
 type Bootstrapper interface {
 	Execute() error
+	// ExecuteContext executes the bootstrap sequence, the bootstrap is aborted when the context is done.
+	ExecuteContext(context.Context) error
+	// ExecuteWithClient executes the bootstrap sequence served by the client instead of the gRPC server.
+	ExecuteWithClient(context.Context, rootfs.ClientProvider) error
+	// WithBuildReportFile writes the build report to the file when the bootstrap finishes.
+	WithBuildReportFile(string) Bootstrapper
+	// WithCacheFile records the completed steps in the rootfs, the next build on the rootfs skips the unchanged steps.
+	WithCacheFile(string) Bootstrapper
+	// WithCacheDrive keeps the RUN --mount=type=cache directories on the block device or in the directory.
+	WithCacheDrive(string) Bootstrapper
+	// WithCheckpointFile records the completed commands in the file and resumes after them on the next execution.
+	WithCheckpointFile(string) Bootstrapper
 	WithCommandRunner(CommandRunner) Bootstrapper
+	// WithImageConfigFile writes the final image config to the file after a successful build.
+	WithImageConfigFile(string) Bootstrapper
 	WithResourceDeployer(ResourceDeployer) Bootstrapper
+	// WithSealedBuildReportFile writes the build report of a sealed build to the file instead, outside of the sealed image.
+	WithSealedBuildReportFile(string) Bootstrapper
+	// WithSealRoot seals the file system under the root, a build with Seal is refused without it.
+	WithSealRoot(string) Bootstrapper
 }
 
 type defaultBootstrapper struct {
+	checkpoint       *checkpointFile
 	commandRunner    CommandRunner
 	bootstrapData    *mmds.MMDSBootstrap
+	cache            *cacheFile
+	cacheDrive       string
+	imageConfig      *imageConfigFile
 	logger           hclog.Logger
+	report           *buildReportFile
 	resourceDeployer ResourceDeployer
+	sealedReport     *buildReportFile
+	// sealRoot is the root of the sealed file system, nothing is sealed without it:
+	sealRoot string
 }
 
 func NewDefaultBoostrapper(logger hclog.Logger, bootstrapData *mmds.MMDSBootstrap) Bootstrapper {
 	return &defaultBootstrapper{
+		checkpoint:       &checkpointFile{},
 		commandRunner:    &noopCommandRunner{logger: logger.Named("noop-runner")},
 		bootstrapData:    bootstrapData,
+		cache:            &cacheFile{},
+		imageConfig:      &imageConfigFile{},
 		logger:           logger,
+		report:           &buildReportFile{},
 		resourceDeployer: &noopResourceDeployer{logger: logger.Named("noo-deployer")},
+		sealedReport:     &buildReportFile{},
 	}
 }
 
 // Execute executes the bootstrap sequence on the machine.
 func (b *defaultBootstrapper) Execute() error {
+	return b.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the bootstrap sequence on the machine within the build timeout.
+// Each RUN command executes within the command timeout.
+func (b *defaultBootstrapper) ExecuteContext(ctx context.Context) error {
 	clientTLSConfig, err := getTLSConfig(b.bootstrapData)
 	if err != nil {
 		b.logger.Error("failed creating client TLS config", "reason", err)
@@ -56,77 +114,352 @@ func (b *defaultBootstrapper) Execute() error {
 		return err
 	}
 
-	chanFinished := make(chan struct{}, 1)
-	go func() {
-		timer := time.NewTimer(b.bootstrapData.SafePingInterval())
-		for {
-			select {
-			case <-timer.C:
-				b.logger.Debug("pinging server")
-				if err := client.Ping(); err != nil {
-					b.logger.Error("ping returned an error", "reason", err)
-					return
-				}
-				timer.Reset(time.Second * 5)
-			case <-chanFinished:
-				timer.Stop()
-				b.logger.Debug("ping stopped, program finished")
-				return
+	return b.execute(ctx, client)
+}
+
+// ExecuteWithClient executes the bootstrap sequence served by the client, for example a local build plan.
+func (b *defaultBootstrapper) ExecuteWithClient(ctx context.Context, client rootfs.ClientProvider) error {
+	return b.execute(ctx, client)
+}
+
+// execute executes the commands of the client.
+// After each command the checkpoint is saved, a checkpoint of a previous execution skips the completed commands.
+// The build report is written when the execution finishes, successfully or not.
+func (b *defaultBootstrapper) execute(ctx context.Context, client rootfs.ClientProvider) (executeErr error) {
+	report := &BuildReport{StartedAt: time.Now().UTC(), ManifestPaths: b.bootstrapData.SafeManifestPaths()}
+	reportFile := b.report
+	defer func() {
+		report.FinishedAt = time.Now().UTC()
+		report.Status = BuildStatusSucceeded
+		if executeErr != nil {
+			report.Status = BuildStatusFailed
+			report.Error = executeErr.Error()
+			if violation := (&PathViolationError{}); errors.As(executeErr, &violation) {
+				report.PathViolation = violation
 			}
 		}
+		if err := reportFile.save(report); err != nil {
+			b.logger.Warn("failed saving build report", "reason", err)
+		}
 	}()
 
+	buildTimeout := b.bootstrapData.SafeBuildTimeout()
+	if buildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, buildTimeout)
+		defer cancel()
+	}
+	commandTimeout := b.bootstrapData.SafeCommandTimeout()
+
+	// the heartbeat cancels the build when the server stops responding:
+	ctx, cancelBuild := context.WithCancel(ctx)
+	defer cancelBuild()
+
+	progress := &buildProgress{}
+	beat := newHeartbeat(b.logger.Named("heartbeat"), client, progress, b.bootstrapData)
+	beat.start(cancelBuild)
+	defer beat.stop()
+
+	// the commands see a client counting the transferred bytes:
+	commandClient := &progressClient{ClientProvider: client, progress: progress}
+
+	abort := func(message string, err error) error {
+		beat.stop()
+		if heartbeatErr := beat.err(); heartbeatErr != nil {
+			err = heartbeatErr
+		}
+		b.logger.Error(message, "reason", err)
+		client.Abort(abortError(err))
+		return err
+	}
+
+	// sealing a file system which is not the built rootfs, the host for example, would destroy it:
+	if b.bootstrapData.SafeSeal() && b.sealRoot == "" {
+		return abort("bootstrap failed, the rootfs can't be sealed", errors.New("no seal root, the rootfs is sealed only in the guest"))
+	}
+	sealPaths, err := sealPatterns(b.bootstrapData.SafeSealPaths())
+	if b.bootstrapData.SafeSeal() && err != nil {
+		return abort("bootstrap failed, the rootfs can't be sealed", err)
+	}
+
 	if err := client.Commands(); err != nil {
+		beat.stop()
 		b.logger.Error("failed fetching bootstrap commands over gRPC", "reason", err)
 		return err
 	}
 
+	// the complete list is needed to tell if a checkpoint belongs to it:
+	allCommands := []commands.VMInitSerializableCommand{}
 	for {
-
 		serializableCommand := client.NextCommand()
 		if serializableCommand == nil {
 			break // finished
 		}
+		allCommands = append(allCommands, serializableCommand)
+	}
 
-		switch vCommand := serializableCommand.(type) {
-		case commands.Run:
-			if err := b.commandRunner.Execute(vCommand, client); err != nil {
-				b.logger.Error("bootstrap failed, executing RUN command failed", "reason", err)
-				close(chanFinished)
-				client.Abort(err)
-				return err
+	hash, commandHashes, err := commandsHash(allCommands)
+	if err != nil {
+		return abort("bootstrap failed, commands can't be hashed", err)
+	}
+	checkpoint, err := b.checkpoint.load()
+	if err != nil {
+		return abort("bootstrap failed, checkpoint can't be loaded", err)
+	}
+	if checkpoint != nil && checkpoint.CommandsHash != hash {
+		// the commands changed since the checkpoint was recorded, the bootstrap starts over:
+		b.logger.Warn("discarding checkpoint of different commands", "checkpoint-hash", checkpoint.CommandsHash, "commands-hash", hash, "completed-commands", checkpoint.Completed())
+		if err := b.checkpoint.remove(); err != nil {
+			b.logger.Warn("failed removing stale checkpoint", "reason", err)
+		}
+		checkpoint = nil
+	}
+	firstIndex := resumeIndex(checkpoint, hash, len(allCommands))
+	if checkpoint == nil {
+		checkpoint = &Checkpoint{CommandsHash: hash}
+	}
+	if firstIndex > 0 {
+		b.logger.Info("resuming bootstrap from checkpoint", "completed-commands", checkpoint.Completed(), "resume-index", firstIndex, "number-of-commands", len(allCommands))
+		// the server is told which commands are skipped:
+		if err := sendStatus(client, StatusKindResume, &Resume{CommandsHash: hash, ResumeIndex: firstIndex}); err != nil {
+			return abort("bootstrap failed, resume can't be sent", err)
+		}
+	}
+	checkpoint.Steps = checkpoint.Steps[0:firstIndex]
+
+	// the changes of every step are listed only when the directories to scan are configured:
+	var scanner *manifestScanner
+	if len(report.ManifestPaths) > 0 {
+		scanner = newManifestScanner(b.logger.Named("manifest"), report.ManifestPaths)
+		if err := scanner.start(); err != nil {
+			return abort("bootstrap failed, file system can't be scanned", err)
+		}
+	}
+
+	// the cache mounts are reported when the build finishes, also when it fails:
+	caches := newCacheStore(b.logger.Named("cache-mounts"), b.cacheDrive, b.bootstrapData.SafeCacheDriveFSType())
+	defer b.reportCacheMounts(client, caches, report)
+
+	// the RUN commands see the secrets of the bootstrap data and of the server, and the caches:
+	secretProvider, _ := client.(SecretProvider)
+	commandRunClient := &runClient{ClientProvider: commandClient, caches: caches, provider: secretProvider, secrets: b.bootstrapData.Secrets}
+
+	// the resources are deployed with a client hashing them when the build cache is enabled:
+	var cache *stepCache
+	if b.bootstrapData.SafeCache() {
+		cache, err = newStepCache(b.logger.Named("cache"), b.cache, client, commandClient, report, firstIndex)
+		if err != nil {
+			return abort("bootstrap failed, build cache can't be loaded", err)
+		}
+		defer cache.close()
+	} else if err := b.cache.remove(); err != nil {
+		return abort("bootstrap failed, stale build cache can't be removed", err)
+	}
+
+	for commandIndex := firstIndex; commandIndex < len(allCommands); commandIndex++ {
+
+		serializableCommand := allCommands[commandIndex]
+
+		progress.setCommand(commandIndex)
+		commandClient.takeResources()
+
+		if ctx.Err() != nil {
+			return abort("bootstrap failed, stopped before executing next command",
+				b.stopReason(ctx, buildTimeout, nil, 0, originalCommand(serializableCommand), ctx.Err()))
+		}
+
+		cacheHit := false
+		var resourceClient rootfs.ClientProvider = commandClient
+		if cache != nil {
+			cacheHit, err = cache.lookup(commandIndex, serializableCommand, commandHashes[commandIndex])
+			if err != nil {
+				return abort("bootstrap failed, build cache lookup failed", err)
 			}
-		case commands.Add:
-			if err := b.resourceDeployer.Add(vCommand, client); err != nil {
-				b.logger.Error("bootstrap failed, executing ADD command failed", "reason", err)
-				close(chanFinished)
-				client.Abort(err)
-				return err
+			resourceClient = cache.resourceClient()
+		}
+
+		if !cacheHit {
+			switch vCommand := serializableCommand.(type) {
+			case commands.Run:
+				runCtx, cancelRun := ctx, context.CancelFunc(func() {})
+				if commandTimeout > 0 {
+					runCtx, cancelRun = context.WithTimeout(ctx, commandTimeout)
+				}
+				err := b.commandRunner.Execute(runCtx, vCommand, commandRunClient)
+				if err != nil {
+					err = b.stopReason(ctx, buildTimeout, runCtx, commandTimeout, vCommand.OriginalCommand, err)
+				}
+				cancelRun()
+				if err != nil {
+					return abort("bootstrap failed, executing RUN command failed", err)
+				}
+			case commands.Add:
+				if err := b.resourceDeployer.Add(vCommand, resourceClient); err != nil {
+					return abort("bootstrap failed, executing ADD command failed", err)
+				}
+			case commands.Copy:
+				if err := b.resourceDeployer.Copy(vCommand, resourceClient); err != nil {
+					return abort("bootstrap failed, executing COPY command failed", err)
+				}
+			}
+		}
+
+		if cache != nil && !cacheHit {
+			cache.completed(commandIndex, serializableCommand, commandHashes[commandIndex])
+		}
+
+		if scanner != nil && !cacheHit {
+			manifest, err := scanner.step(commandIndex, originalCommand(serializableCommand))
+			if err != nil {
+				return abort("bootstrap failed, file system changes can't be listed", err)
 			}
-		case commands.Copy:
-			if err := b.resourceDeployer.Copy(vCommand, client); err != nil {
-				b.logger.Error("bootstrap failed, executing COPY command failed", "reason", err)
-				close(chanFinished)
-				client.Abort(err)
-				return err
+			report.Steps = append(report.Steps, manifest)
+			if err := sendManifest(client, manifest); err != nil {
+				b.logger.Warn("failed sending step manifest", "command-index", commandIndex, "reason", err)
 			}
 		}
 
+		checkpoint.Steps = append(checkpoint.Steps, &CheckpointStep{
+			Index:       commandIndex,
+			CommandHash: commandHashes[commandIndex],
+			Resources:   commandClient.takeResources(),
+			CompletedAt: time.Now().UTC(),
+		})
+		if err := b.checkpoint.save(checkpoint); err != nil {
+			// the build goes on, the next execution resumes from an earlier command:
+			b.logger.Warn("failed saving checkpoint", "command-index", commandIndex, "reason", err)
+		}
+
+	}
+
+	// the built image describes itself, the entrypoint is not needed in the metadata on every boot:
+	config, err := imageConfig(client)
+	if err != nil {
+		return abort("bootstrap failed, image config not available", err)
+	}
+	if config == nil {
+		// a config of a previous build would describe another image:
+		b.logger.Warn("the server serves no image config, the image config is not written", "image-config", b.imageConfig.path)
+		if err := b.imageConfig.remove(); err != nil {
+			return abort("bootstrap failed, stale image config can't be removed", err)
+		}
+	} else if err := b.imageConfig.save(config); err != nil {
+		return abort("bootstrap failed, image config can't be written", err)
+	}
+
+	b.reportCacheMounts(client, caches, report)
+
+	// the image is sealed before the server has the result, the server may take the rootfs as soon as it has it;
+	// the clones of the image don't share the build-time state, don't resume this build and don't carry its report:
+	if b.bootstrapData.SafeSeal() {
+		if cache != nil {
+			cache.close()
+		}
+		if err := b.checkpoint.remove(); err != nil {
+			b.logger.Warn("failed removing checkpoint", "reason", err)
+		}
+		if err := b.cache.remove(); err != nil {
+			b.logger.Warn("failed removing build cache", "reason", err)
+		}
+		if b.sealedReport.path != "" {
+			if err := b.report.remove(); err != nil {
+				b.logger.Warn("failed removing build report", "reason", err)
+			}
+			reportFile = b.sealedReport
+		}
+		report.Seal = (&sealer{
+			logger:        b.logger.Named("seal"),
+			paths:         sealPaths,
+			root:          b.sealRoot,
+			zeroFreeSpace: b.bootstrapData.SafeSealZeroFreeSpace(),
+		}).seal()
+		if err := sealFailure(report.Seal); err != nil {
+			return abort("bootstrap failed, the rootfs can't be sealed", err)
+		}
+	}
+
+	beat.stop()
+
+	if err := client.Success(); err != nil {
+		return err
 	}
+	if err := b.checkpoint.remove(); err != nil {
+		b.logger.Warn("failed removing checkpoint", "reason", err)
+	}
+	return nil
+}
 
-	close(chanFinished)
+// reportCacheMounts unmounts the cache drive, logs the usage of the caches and sends it to the server.
+// Nothing is reported when no cache was mounted or the usage has already been reported.
+func (b *defaultBootstrapper) reportCacheMounts(client rootfs.ClientProvider, caches *cacheStore, report *BuildReport) {
+	stats := caches.close()
+	if stats == nil {
+		return
+	}
+	report.CacheMounts = stats
+	for _, cache := range stats {
+		b.logger.Info("cache mount usage", "id", cache.ID, "uses", cache.Uses, "instances", cache.Instances, "files", cache.Files, "size-bytes", cache.SizeBytes, "persistent", cache.Persistent)
+	}
+	if err := sendStatus(client, StatusKindCacheMounts, stats); err != nil {
+		b.logger.Warn("failed sending cache mount usage", "reason", err)
+	}
+}
 
-	return client.Success()
+// stopReason returns a TimeoutError if the error is caused by an exceeded build or command timeout,
+// otherwise the error is returned as it is.
+func (b *defaultBootstrapper) stopReason(buildCtx context.Context, buildTimeout time.Duration, commandCtx context.Context, commandTimeout time.Duration, originalCommand string, err error) error {
+	if buildCtx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Command: originalCommand, Scope: TimeoutScopeBuild, Timeout: buildTimeout}
+	}
+	if commandCtx != nil && commandCtx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Command: originalCommand, Scope: TimeoutScopeCommand, Timeout: commandTimeout}
+	}
+	return err
 }
 
+func (b *defaultBootstrapper) WithBuildReportFile(input string) Bootstrapper {
+	b.report = &buildReportFile{path: input}
+	return b
+}
+func (b *defaultBootstrapper) WithCacheFile(input string) Bootstrapper {
+	b.cache = &cacheFile{path: input}
+	return b
+}
+func (b *defaultBootstrapper) WithCacheDrive(input string) Bootstrapper {
+	b.cacheDrive = input
+	return b
+}
+func (b *defaultBootstrapper) WithCheckpointFile(input string) Bootstrapper {
+	b.checkpoint = &checkpointFile{path: input}
+	return b
+}
 func (b *defaultBootstrapper) WithCommandRunner(input CommandRunner) Bootstrapper {
 	b.commandRunner = input
 	return b
 }
+func (b *defaultBootstrapper) WithImageConfigFile(input string) Bootstrapper {
+	b.imageConfig = &imageConfigFile{path: input}
+	return b
+}
 func (b *defaultBootstrapper) WithResourceDeployer(input ResourceDeployer) Bootstrapper {
 	b.resourceDeployer = input
 	return b
 }
+func (b *defaultBootstrapper) WithSealedBuildReportFile(input string) Bootstrapper {
+	b.sealedReport = &buildReportFile{path: input}
+	return b
+}
+func (b *defaultBootstrapper) WithSealRoot(input string) Bootstrapper {
+	b.sealRoot = input
+	return b
+}
+
+func originalCommand(input commands.VMInitSerializableCommand) string {
+	if serializable, ok := input.(commands.DockerfileSerializable); ok {
+		return serializable.GetOriginal()
+	}
+	return fmt.Sprintf("%T", input)
+}
 
 func getTLSConfig(bootstrapData *mmds.MMDSBootstrap) (*tls.Config, error) {
 	roots := x509.NewCertPool()
@@ -2,6 +2,7 @@ package bootstrap
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/fs"
 	"io/ioutil"
@@ -17,6 +18,7 @@ import (
 	"github.com/combust-labs/firebuild-shared/build/resources"
 	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -120,7 +122,7 @@ func TestFailingAddBootstrap(t *testing.T) {
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
 
-	// use this directory as the workdir for ADD and COPY resources:
+	// use this directory as the root for ADD and COPY resources:
 	tempDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal("expected temp dir, got error", err)
@@ -214,7 +216,7 @@ func TestFailingAddBootstrap(t *testing.T) {
 
 	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
 		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
-		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+		WithResourceDeployer(newTestResourceDeployer(logger.Named("executing-deployer"), tempDir))
 
 	bootstrapErr := bootstrapper.Execute()
 	assert.NotNil(t, bootstrapErr)
@@ -232,7 +234,7 @@ func TestFailingCopyBootstrap(t *testing.T) {
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
 
-	// use this directory as the workdir for ADD and COPY resources:
+	// use this directory as the root for ADD and COPY resources:
 	tempDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal("expected temp dir, got error", err)
@@ -326,7 +328,7 @@ func TestFailingCopyBootstrap(t *testing.T) {
 
 	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
 		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
-		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+		WithResourceDeployer(newTestResourceDeployer(logger.Named("executing-deployer"), tempDir))
 
 	bootstrapErr := bootstrapper.Execute()
 	assert.NotNil(t, bootstrapErr)
@@ -344,7 +346,7 @@ func TestSuccessfulBootstrapWithResources(t *testing.T) {
 	logger := hclog.Default()
 	logger.SetLevel(hclog.Debug)
 
-	// use this directory as the workdir for ADD and COPY resources:
+	// use this directory as the root for ADD and COPY resources:
 	tempDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal("expected temp dir, got error", err)
@@ -495,7 +497,7 @@ func TestSuccessfulBootstrapWithResources(t *testing.T) {
 
 	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
 		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner"))).
-		WithResourceDeployer(NewExecutingResourceDeployer(logger.Named("executing-deployer")))
+		WithResourceDeployer(newTestResourceDeployer(logger.Named("executing-deployer"), tempDir))
 
 	bootstrapErr := bootstrapper.Execute()
 	assert.Nil(t, bootstrapErr)
@@ -506,6 +508,73 @@ func TestSuccessfulBootstrapWithResources(t *testing.T) {
 	assert.Equal(t, len(serverOutput), 2)
 }
 
+// startTestServer starts a rootfs gRPC server serving the work context,
+// the bootstrap data connects the bootstrapper to it.
+func startTestServer(t *testing.T, logger hclog.Logger, buildCtx *rootfs.WorkContext) (rootfs.TestServer, *mmds.MMDSBootstrap) {
+	testServerAppName := "test-server-app"
+
+	embeddedCA, err := ca.NewDefaultEmbeddedCAWithLogger(&ca.EmbeddedCAConfig{
+		Addresses:     []string{testServerAppName},
+		CertsValidFor: time.Hour,
+		KeySize:       1024,
+	}, logger.Named("embedded-ca"))
+	if err != nil {
+		t.Fatal("failed constructing embedded CA", err)
+	}
+	serverTLSConfig, err := embeddedCA.NewServerCertTLSConfig()
+	if err != nil {
+		t.Fatal("failed creating test server TLS config", err)
+	}
+	grpcConfig := &rootfs.GRPCServiceConfig{
+		ServerName:      testServerAppName,
+		BindHostPort:    "127.0.0.1:0",
+		TLSConfigServer: serverTLSConfig,
+	}
+
+	testServer := rootfs.NewTestServer(t, logger.Named("grpc-server"), grpcConfig, buildCtx)
+	testServer.Start()
+	select {
+	case startErr := <-testServer.FailedNotify():
+		t.Fatal("expected the GRPC server to start but it failed", startErr)
+	case <-testServer.ReadyNotify():
+	}
+
+	clientCertData, err := embeddedCA.NewClientCert()
+	if err != nil {
+		t.Fatal("failed creating test client certitifcate", err)
+	}
+	return testServer, &mmds.MMDSBootstrap{
+		HostPort:    grpcConfig.BindHostPort,
+		CaChain:     strings.Join(embeddedCA.CAPEMChain(), "\n"),
+		Certificate: string(clientCertData.CertificatePEM()),
+		Key:         string(clientCertData.KeyPEM()),
+		ServerName:  testServerAppName,
+	}
+}
+
+func TestBootstrapStopReason(t *testing.T) {
+	bootstrapper := &defaultBootstrapper{logger: hclog.Default()}
+	original := errors.New("original")
+
+	buildCtx, cancelBuild := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelBuild()
+	commandCtx, cancelCommand := context.WithTimeout(buildCtx, time.Nanosecond)
+	defer cancelCommand()
+	<-commandCtx.Done()
+
+	assert.Equal(t, &TimeoutError{Command: "RUN sleep 1", Scope: TimeoutScopeCommand, Timeout: time.Nanosecond},
+		bootstrapper.stopReason(buildCtx, time.Hour, commandCtx, time.Nanosecond, "RUN sleep 1", original))
+
+	expiredBuildCtx, cancelExpired := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancelExpired()
+	<-expiredBuildCtx.Done()
+	assert.Equal(t, &TimeoutError{Command: "RUN sleep 1", Scope: TimeoutScopeBuild, Timeout: time.Nanosecond},
+		bootstrapper.stopReason(expiredBuildCtx, time.Nanosecond, commandCtx, time.Hour, "RUN sleep 1", original))
+
+	// anything else than a timeout is returned as it is:
+	assert.Equal(t, original, bootstrapper.stopReason(buildCtx, time.Hour, nil, 0, "RUN exit 1", original))
+}
+
 func TestGetTLSConfig(t *testing.T) {
 
 	logger := hclog.Default()
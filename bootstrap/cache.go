@@ -0,0 +1,497 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// BuildCache records the steps completed on the rootfs. A step is identified by a hash of the command,
+// the contents of its resources and the hash of the previous step.
+// The rootfs is not rolled back: the steps after the first changed step execute on top of the results of the previous build.
+type BuildCache struct {
+	Steps []*CacheStep `json:"Steps"`
+}
+
+// CacheStep is a step completed on the rootfs.
+type CacheStep struct {
+	Index   int    `json:"Index"`
+	Command string `json:"Command"`
+	// Hash is empty when the step can't be identified, for example when a resource was not fully read.
+	Hash        string    `json:"Hash"`
+	CompletedAt time.Time `json:"CompletedAt"`
+}
+
+// CacheResult tells if a step was skipped because the rootfs contains its results.
+type CacheResult struct {
+	Index   int    `json:"Index"`
+	Command string `json:"Command"`
+	Hash    string `json:"Hash"`
+	Hit     bool   `json:"Hit"`
+	// OnPreviousResults is true for an executed step when the rootfs has the results of the previous build
+	// of this step and the following ones, those are not rolled back and the step executes on top of them.
+	OnPreviousResults bool `json:"OnPreviousResults,omitempty"`
+}
+
+// cacheFile is the file in the rootfs the build cache is recorded in, nothing is recorded without a path.
+type cacheFile struct {
+	path string
+}
+
+func (f *cacheFile) load() (*BuildCache, error) {
+	cache := &BuildCache{Steps: []*CacheStep{}}
+	if f.path == "" {
+		return cache, nil
+	}
+	cacheBytes, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, errors.Wrap(err, "failed reading build cache")
+	}
+	if err := json.Unmarshal(cacheBytes, cache); err != nil {
+		return nil, errors.Wrap(err, "failed parsing build cache")
+	}
+	return cache, nil
+}
+
+// save writes the build cache atomically.
+func (f *cacheFile) save(cache *BuildCache) error {
+	if f.path == "" {
+		return nil
+	}
+	return errors.Wrap(fsutil.WriteJSONAtomically(f.path, cache, 0600, 0700), "failed writing build cache")
+}
+
+// remove removes the build cache, a rootfs built without the cache is not described by it.
+func (f *cacheFile) remove() error {
+	if f.path == "" {
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed removing build cache")
+	}
+	return nil
+}
+
+// stepHash returns the hash of a step.
+func stepHash(previousHash, commandHash, resourcesHash string) string {
+	hash := sha256.Sum256([]byte(previousHash + "\n" + commandHash + "\n" + resourcesHash))
+	return hex.EncodeToString(hash[:])
+}
+
+// commandSource returns the resource source of an ADD or COPY command, false for other commands.
+func commandSource(command commands.VMInitSerializableCommand) (string, bool) {
+	switch vCommand := command.(type) {
+	case commands.Add:
+		return vCommand.Source, true
+	case commands.Copy:
+		return vCommand.Source, true
+	}
+	return "", false
+}
+
+// hashingClient is a client provider hashing the resources as they are read.
+// The resources fetched for hashing are spooled to files and served from there to the next fetch of the same source.
+type hashingClient struct {
+	rootfs.ClientProvider
+	logger hclog.Logger
+
+	m         sync.Mutex
+	resources []*hashedResource
+
+	spoolDirectory string
+	spooled        map[string][]interface{}
+}
+
+func (c *hashingClient) unwrap() rootfs.ClientProvider {
+	return c.ClientProvider
+}
+
+// fetchResourcesHash reads all the resources of the source and returns their hash.
+// The contents are spooled so the resources of a changed step are deployed without fetching them again.
+func (c *hashingClient) fetchResourcesHash(source string) (string, error) {
+	c.take()
+	c.discard()
+	input, err := c.Resource(source)
+	if err != nil {
+		return "", err
+	}
+	spooled := []interface{}{}
+	for item := range input {
+		if item == nil {
+			break
+		}
+		switch titem := item.(type) {
+		case error:
+			return "", titem
+		case *hashedResource:
+			if !titem.hasContents() {
+				spooled = append(spooled, titem.ResolvedResource)
+				continue
+			}
+			path, err := c.spool(titem)
+			if err != nil {
+				return "", err
+			}
+			spooled = append(spooled, &spooledResource{ResolvedResource: titem.ResolvedResource, path: path})
+		}
+	}
+	c.spooled = map[string][]interface{}{source: spooled}
+	return c.hash(), nil
+}
+
+// spool writes the contents of the resource to a file in the spool directory.
+func (c *hashingClient) spool(resource *hashedResource) (string, error) {
+	if c.spoolDirectory == "" {
+		directory, err := ioutil.TempDir("", "vminit-resources-")
+		if err != nil {
+			return "", errors.Wrap(err, "failed creating resource spool directory")
+		}
+		c.spoolDirectory = directory
+	}
+	file, err := ioutil.TempFile(c.spoolDirectory, "")
+	if err != nil {
+		return "", errors.Wrap(err, "failed creating resource spool file")
+	}
+	defer file.Close()
+	reader, err := resource.Contents()
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed spooling resource")
+	}
+	return file.Name(), nil
+}
+
+// discard removes the spooled resources.
+func (c *hashingClient) discard() {
+	c.spooled = nil
+	if c.spoolDirectory == "" {
+		return
+	}
+	if err := os.RemoveAll(c.spoolDirectory); err != nil {
+		c.logger.Warn("failed removing resource spool directory", "path", c.spoolDirectory, "reason", err)
+	}
+	c.spoolDirectory = ""
+}
+
+// hash returns the hash of the resources received since the last call, empty if any contents were not fully read.
+func (c *hashingClient) hash() string {
+	hash := sha256.New()
+	for _, resource := range c.take() {
+		contentsHash, ok := resource.contentsHash()
+		if !ok {
+			return ""
+		}
+		metadata := resourceMetadata(resource)
+		linkTarget := ""
+		if metadata != nil {
+			linkTarget = metadata.SymlinkTarget + "\x00" + metadata.HardlinkTarget
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%o\x00%t\x00%s\x00%s\n",
+			resource.SourcePath(), resource.TargetPath(), resource.TargetMode(), resource.IsDir(), linkTarget, contentsHash)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *hashingClient) take() []*hashedResource {
+	c.m.Lock()
+	defer c.m.Unlock()
+	taken := c.resources
+	c.resources = nil
+	return taken
+}
+
+func (c *hashingClient) Resource(path string) (chan interface{}, error) {
+	input, err := c.fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan interface{})
+	go func() {
+		// the client closes the channel or sends nil when finished:
+		defer close(output)
+		for item := range input {
+			if item == nil {
+				output <- nil
+				return
+			}
+			if resource, ok := item.(resources.ResolvedResource); ok {
+				hashed := &hashedResource{ResolvedResource: resource, hash: sha256.New()}
+				c.m.Lock()
+				c.resources = append(c.resources, hashed)
+				c.m.Unlock()
+				item = hashed
+			}
+			output <- item
+		}
+	}()
+	return output, nil
+}
+
+// fetch serves the spooled resources of the path, the spooled resources are served once.
+func (c *hashingClient) fetch(path string) (chan interface{}, error) {
+	spooled, ok := c.spooled[path]
+	if !ok {
+		return c.ClientProvider.Resource(path)
+	}
+	delete(c.spooled, path)
+	output := make(chan interface{}, len(spooled)+1)
+	for _, item := range spooled {
+		output <- item
+	}
+	output <- nil
+	return output, nil
+}
+
+// spooledResource is a resource with the contents read from a spool file.
+type spooledResource struct {
+	resources.ResolvedResource
+	path string
+}
+
+func (r *spooledResource) Contents() (io.ReadCloser, error) {
+	return os.Open(r.path)
+}
+
+// Metadata passes the metadata of the wrapped resource through.
+func (r *spooledResource) Metadata() *ResourceMetadata {
+	return resourceMetadata(r.ResolvedResource)
+}
+
+// hashedResource hashes the resource contents as they are read, the unread rest is hashed on close.
+type hashedResource struct {
+	resources.ResolvedResource
+
+	m    sync.Mutex
+	hash hash.Hash
+	read bool
+}
+
+// hasContents returns false for the resources deployed without reading their contents.
+func (r *hashedResource) hasContents() bool {
+	if r.IsDir() {
+		return false
+	}
+	metadata := resourceMetadata(r.ResolvedResource)
+	return metadata == nil || (metadata.SymlinkTarget == "" && metadata.HardlinkTarget == "")
+}
+
+func (r *hashedResource) contentsHash() (string, bool) {
+	if !r.hasContents() {
+		return "", true
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.read {
+		return "", false
+	}
+	return hex.EncodeToString(r.hash.Sum(nil)), true
+}
+
+func (r *hashedResource) Contents() (io.ReadCloser, error) {
+	reader, err := r.ResolvedResource.Contents()
+	if err != nil {
+		return nil, err
+	}
+	r.m.Lock()
+	r.hash.Reset()
+	r.read = false
+	r.m.Unlock()
+	return &hashingReader{ReadCloser: reader, resource: r}, nil
+}
+
+// Metadata passes the metadata of the wrapped resource through.
+func (r *hashedResource) Metadata() *ResourceMetadata {
+	return resourceMetadata(r.ResolvedResource)
+}
+
+type hashingReader struct {
+	io.ReadCloser
+	resource *hashedResource
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.resource.m.Lock()
+	r.resource.hash.Write(p[:n])
+	r.resource.m.Unlock()
+	return n, err
+}
+
+func (r *hashingReader) Close() error {
+	// an archive may be extracted without reading its padding:
+	_, drainErr := io.Copy(ioutil.Discard, readerFunc(r.Read))
+	r.resource.m.Lock()
+	r.resource.read = drainErr == nil
+	r.resource.m.Unlock()
+	return r.ReadCloser.Close()
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// stepCache tells which steps are skipped and records the completed steps.
+// Steps are skipped until the first step with a different hash, the following steps are executed.
+type stepCache struct {
+	client *hashingClient
+	file   *cacheFile
+	logger hclog.Logger
+	report *BuildReport
+	status rootfs.ClientProvider
+
+	cache         *BuildCache
+	hitting       bool
+	known         bool
+	previousHash  string
+	previousSteps int
+}
+
+// newStepCache loads the build cache, firstIndex is the first step executed after a resume.
+// The resources are fetched with the command client, the results are sent to the client as status lines.
+func newStepCache(logger hclog.Logger, file *cacheFile, client, commandClient rootfs.ClientProvider, report *BuildReport, firstIndex int) (*stepCache, error) {
+	cache, err := file.load()
+	if err != nil {
+		return nil, err
+	}
+	c := &stepCache{
+		client:        &hashingClient{ClientProvider: commandClient, logger: logger},
+		file:          file,
+		logger:        logger,
+		report:        report,
+		status:        client,
+		cache:         cache,
+		known:         firstIndex == 0,
+		previousSteps: len(cache.Steps),
+	}
+	if firstIndex > 0 {
+		// resumed steps are identified by the steps recorded before the restart:
+		if previous := c.recorded(firstIndex - 1); previous != nil {
+			c.previousHash = previous.Hash
+			c.known = true
+		}
+	}
+	c.hitting = c.known
+	return c, nil
+}
+
+// recorded returns the recorded step with a known hash, nil if the step is not recorded.
+func (c *stepCache) recorded(index int) *CacheStep {
+	if index < 0 || index >= len(c.cache.Steps) || c.cache.Steps[index].Index != index || c.cache.Steps[index].Hash == "" {
+		return nil
+	}
+	return c.cache.Steps[index]
+}
+
+// lookup returns true if the results of the step are in the rootfs and the step is skipped.
+// The resources of ADD and COPY are fetched and hashed to tell if they changed.
+func (c *stepCache) lookup(index int, command commands.VMInitSerializableCommand, commandHash string) (bool, error) {
+	if !c.hitting {
+		return false, nil
+	}
+	recorded := c.recorded(index)
+	if recorded == nil {
+		c.hitting = false
+		return false, nil
+	}
+	resourcesHash := ""
+	if source, ok := commandSource(command); ok {
+		fetched, err := c.client.fetchResourcesHash(source)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed hashing resources of '%s'", source)
+		}
+		resourcesHash = fetched
+	}
+	hash := stepHash(c.previousHash, commandHash, resourcesHash)
+	if hash != recorded.Hash {
+		// the spooled resources are deployed:
+		c.hitting = false
+		return false, nil
+	}
+	c.client.discard()
+	c.previousHash = hash
+	c.result(&CacheResult{Index: index, Command: originalCommand(command), Hash: hash, Hit: true})
+	return true, nil
+}
+
+// completed records the executed step, the resources of ADD and COPY are hashed as they were deployed.
+func (c *stepCache) completed(index int, command commands.VMInitSerializableCommand, commandHash string) {
+	c.client.discard()
+	resourcesHash := ""
+	if _, ok := commandSource(command); ok {
+		resourcesHash = c.client.hash()
+		if resourcesHash == "" {
+			// the step can't be identified, neither can the following ones:
+			c.known = false
+		}
+	}
+	hash := ""
+	if c.known {
+		hash = stepHash(c.previousHash, commandHash, resourcesHash)
+	}
+	c.previousHash = hash
+	c.result(&CacheResult{Index: index, Command: originalCommand(command), Hash: hash, Hit: false, OnPreviousResults: index < c.previousSteps})
+
+	if len(c.cache.Steps) > index {
+		c.cache.Steps = c.cache.Steps[0:index]
+	}
+	c.cache.Steps = append(c.cache.Steps, &CacheStep{
+		Index:       index,
+		Command:     originalCommand(command),
+		Hash:        hash,
+		CompletedAt: time.Now().UTC(),
+	})
+	if err := c.file.save(c.cache); err != nil {
+		// the build goes on, the next build executes this step again:
+		c.logger.Warn("failed saving build cache", "command-index", index, "reason", err)
+	}
+}
+
+// close removes the resources spooled for a step which did not complete.
+func (c *stepCache) close() {
+	c.client.discard()
+}
+
+// resourceClient returns the client the ADD and COPY resources are deployed with.
+func (c *stepCache) resourceClient() rootfs.ClientProvider {
+	c.client.take()
+	return c.client
+}
+
+func (c *stepCache) result(result *CacheResult) {
+	if result.Hit {
+		c.logger.Info("cache hit, step skipped", "command-index", result.Index, "command", result.Command)
+	} else if result.OnPreviousResults {
+		c.logger.Warn("cache miss, step executed on top of the results of the previous build, the rootfs is not rolled back", "command-index", result.Index, "command", result.Command)
+	} else {
+		c.logger.Debug("cache miss, step executed", "command-index", result.Index, "command", result.Command)
+	}
+	c.report.Cache = append(c.report.Cache, result)
+	if err := sendStatus(c.status, StatusKindCache, result); err != nil {
+		c.logger.Warn("failed sending cache result", "command-index", result.Index, "reason", err)
+	}
+}
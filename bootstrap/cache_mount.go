@@ -0,0 +1,421 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cacheMountsDirectory is the directory of the cache drive holding the cache directories.
+	cacheMountsDirectory = "caches"
+	// defaultCacheMountMode is the mode of a new cache directory unless the mode is given, the same as in Docker.
+	defaultCacheMountMode = fs.FileMode(0755)
+)
+
+// Sharing modes of RUN --mount=type=cache, the same as in Docker.
+const (
+	cacheSharingLocked  = "locked"
+	cacheSharingPrivate = "private"
+	cacheSharingShared  = "shared"
+)
+
+// CacheMountStats is the usage of a RUN --mount=type=cache directory during a build.
+type CacheMountStats struct {
+	ID string `json:"ID"`
+	// Uses is the number of the RUN commands which mounted the cache.
+	Uses int `json:"Uses"`
+	// Instances is the number of the directories of the cache, a private cache mounted while in use gets another one.
+	Instances int `json:"Instances"`
+	// Files and SizeBytes are the regular files in the cache directories when the build finishes.
+	Files     int   `json:"Files"`
+	SizeBytes int64 `json:"SizeBytes"`
+	// Persistent is true when the cache is kept on the cache drive for the next builds.
+	Persistent bool `json:"Persistent"`
+}
+
+// cacheMount is a RUN --mount=type=cache flag.
+type cacheMount struct {
+	id       string
+	target   string
+	sharing  string
+	readOnly bool
+	mode     fs.FileMode
+	uid      int
+	gid      int
+}
+
+// parseCacheMounts returns the cache mounts of the RUN command, relative targets are in the workdir.
+func parseCacheMounts(cmd commands.Run) ([]*cacheMount, error) {
+	mounts, err := parseRunMounts(cmd.OriginalCommand)
+	if err != nil {
+		return nil, err
+	}
+	caches := []*cacheMount{}
+	for _, mount := range mounts {
+		if mount.Type != runMountTypeCache {
+			continue
+		}
+		cache := &cacheMount{sharing: cacheSharingShared, mode: defaultCacheMountMode}
+		cache.target, _ = mount.option("target", "dst", "destination")
+		if cache.target == "" {
+			return nil, fmt.Errorf("cache mount requires a target")
+		}
+		if !filepath.IsAbs(cache.target) {
+			cache.target = filepath.Join(cmd.Workdir.Value, cache.target)
+		}
+		cache.target = filepath.Clean(cache.target)
+		cache.id, _ = mount.option("id")
+		if cache.id == "" {
+			cache.id = cache.target
+		}
+		if _, ok := mount.option("from", "source", "src"); ok {
+			return nil, fmt.Errorf("cache '%s' can't be mounted from another stage", cache.id)
+		}
+		if value, ok := mount.option("sharing"); ok {
+			switch value {
+			case cacheSharingLocked, cacheSharingPrivate, cacheSharingShared:
+				cache.sharing = value
+			default:
+				return nil, fmt.Errorf("invalid sharing mode '%s' of cache '%s'", value, cache.id)
+			}
+		}
+		if value, ok := mount.option("readonly", "ro"); ok {
+			if cache.readOnly, err = strconv.ParseBool(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid readonly flag of cache '%s'", cache.id)
+			}
+		}
+		if value, ok := mount.option("mode"); ok {
+			if cache.mode, err = fsutil.ParseOctalMode(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid mode of cache '%s'", cache.id)
+			}
+		}
+		for _, owner := range []struct {
+			key   string
+			value *int
+		}{{"uid", &cache.uid}, {"gid", &cache.gid}} {
+			if value, ok := mount.option(owner.key); ok {
+				if *owner.value, err = strconv.Atoi(value); err != nil {
+					return nil, errors.Wrapf(err, "invalid %s of cache '%s'", owner.key, cache.id)
+				}
+			}
+		}
+		caches = append(caches, cache)
+	}
+	return caches, nil
+}
+
+// cacheDirectoryName returns the name of the directory of the cache, the ID may be any string, for example a path.
+func cacheDirectoryName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// cacheStore holds the cache directories of a build.
+// The source is the cache drive, mounted when the first cache is mounted, or a directory.
+// Without the source, the caches are kept on a tmpfs and last for a single build.
+type cacheStore struct {
+	fsType string
+	logger hclog.Logger
+	source string
+
+	m          sync.Mutex
+	opened     bool
+	mountPoint string
+	root       string
+	stats      map[string]*CacheMountStats
+	instances  map[string]map[string]struct{}
+}
+
+func newCacheStore(logger hclog.Logger, source, fsType string) *cacheStore {
+	return &cacheStore{
+		fsType:    fsType,
+		logger:    logger,
+		source:    source,
+		stats:     map[string]*CacheMountStats{},
+		instances: map[string]map[string]struct{}{},
+	}
+}
+
+// open mounts the cache drive, must be called with the lock held.
+func (s *cacheStore) open() error {
+	if s.opened {
+		return nil
+	}
+	if s.source != "" {
+		info, err := os.Stat(s.source)
+		if err != nil {
+			return errors.Wrap(err, "cache drive not available")
+		}
+		if info.IsDir() {
+			s.root = filepath.Join(s.source, cacheMountsDirectory)
+		} else if err := s.mountSource(s.source, s.fsType, unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+			return errors.Wrapf(err, "failed mounting cache drive '%s'", s.source)
+		}
+	} else {
+		s.logger.Warn("no cache drive, the cache mounts last for this build only")
+		if err := s.mountSource("tmpfs", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+			return errors.Wrap(err, "failed mounting cache tmpfs")
+		}
+	}
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		s.unmountSource()
+		return errors.Wrap(err, "failed creating cache directory")
+	}
+	s.opened = true
+	return nil
+}
+
+func (s *cacheStore) mountSource(source, fsType string, flags uintptr, data string) error {
+	mountPoint, err := ioutil.TempDir("", "firebuild-cache-")
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount(source, mountPoint, fsType, flags, data); err != nil {
+		os.Remove(mountPoint)
+		return err
+	}
+	s.mountPoint = mountPoint
+	s.root = filepath.Join(mountPoint, cacheMountsDirectory)
+	return nil
+}
+
+func (s *cacheStore) unmountSource() {
+	if s.mountPoint == "" {
+		return
+	}
+	if err := unix.Unmount(s.mountPoint, unix.MNT_DETACH); err != nil {
+		s.logger.Warn("failed unmounting cache drive", "path", s.mountPoint, "reason", err)
+	}
+	if err := os.Remove(s.mountPoint); err != nil {
+		s.logger.Warn("failed removing cache drive mount point", "path", s.mountPoint, "reason", err)
+	}
+	s.mountPoint = ""
+}
+
+// mount mounts the caches of a RUN command at their targets.
+func (s *cacheStore) mount(caches []*cacheMount) (*mountedCaches, error) {
+	mounted := &mountedCaches{logger: s.logger}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	// a cache mounted more than once by the command is locked once, a second lock would wait for the first:
+	directories := map[string]string{}
+	for _, cache := range caches {
+		directory, ok := directories[cache.id]
+		if !ok {
+			var lockFile *os.File
+			var err error
+			directory, lockFile, err = s.acquire(cache)
+			if err != nil {
+				mounted.cleanup()
+				return nil, errors.Wrapf(err, "failed locking cache '%s'", cache.id)
+			}
+			mounted.lockFiles = append(mounted.lockFiles, lockFile)
+			directories[cache.id] = directory
+			s.used(cache.id, directory)
+		}
+		if err := mounted.mount(cache, directory); err != nil {
+			mounted.cleanup()
+			return nil, errors.Wrapf(err, "failed mounting cache '%s'", cache.id)
+		}
+		s.logger.Debug("cache mounted", "id", cache.id, "target", cache.target, "sharing", cache.sharing)
+	}
+	return mounted, nil
+}
+
+// acquire locks the directory of the cache with the sharing mode and creates it when missing:
+// a shared cache is locked with a shared lock, a locked cache waits for the exclusive lock,
+// a private cache gets the first directory not locked by anybody else.
+func (s *cacheStore) acquire(cache *cacheMount) (string, *os.File, error) {
+	name := cacheDirectoryName(cache.id)
+	for instance := 0; ; instance++ {
+		directory := filepath.Join(s.root, name)
+		if instance > 0 {
+			directory = fmt.Sprintf("%s.%d", directory, instance)
+		}
+		lockFile, err := os.OpenFile(directory+".lock", os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return "", nil, err
+		}
+		how := unix.LOCK_SH
+		switch cache.sharing {
+		case cacheSharingLocked:
+			how = unix.LOCK_EX
+		case cacheSharingPrivate:
+			how = unix.LOCK_EX | unix.LOCK_NB
+		}
+		if err := unix.Flock(int(lockFile.Fd()), how); err != nil {
+			lockFile.Close()
+			if cache.sharing == cacheSharingPrivate && err == unix.EWOULDBLOCK {
+				continue
+			}
+			return "", nil, err
+		}
+		if err := createCacheDirectory(directory, cache); err != nil {
+			lockFile.Close()
+			return "", nil, err
+		}
+		return directory, lockFile, nil
+	}
+}
+
+// createCacheDirectory creates the directory of the cache, the mode and the owner apply only to a new directory.
+func createCacheDirectory(directory string, cache *cacheMount) error {
+	if err := os.Mkdir(directory, cache.mode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Chmod(directory, cache.mode); err != nil {
+		return err
+	}
+	return os.Chown(directory, cache.uid, cache.gid)
+}
+
+// used records a use of the cache, must be called with the lock held.
+func (s *cacheStore) used(id, directory string) {
+	stats, ok := s.stats[id]
+	if !ok {
+		stats = &CacheMountStats{ID: id, Persistent: s.source != ""}
+		s.stats[id] = stats
+		s.instances[id] = map[string]struct{}{}
+	}
+	stats.Uses = stats.Uses + 1
+	s.instances[id][directory] = struct{}{}
+}
+
+// close unmounts the cache drive and returns the usage of the caches mounted during the build,
+// nil if no cache was mounted. The caches can't be mounted after close.
+func (s *cacheStore) close() []*CacheMountStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !s.opened {
+		return nil
+	}
+	ids := []string{}
+	for id := range s.stats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := []*CacheMountStats{}
+	for _, id := range ids {
+		stats := s.stats[id]
+		stats.Instances = len(s.instances[id])
+		for directory := range s.instances[id] {
+			files, size, err := directoryUsage(directory)
+			if err != nil {
+				s.logger.Warn("failed measuring cache", "id", id, "reason", err)
+			}
+			stats.Files = stats.Files + files
+			stats.SizeBytes = stats.SizeBytes + size
+		}
+		result = append(result, stats)
+	}
+	s.unmountSource()
+	s.opened = false
+	return result
+}
+
+// directoryUsage returns the number and the total size of the regular files in the directory.
+func directoryUsage(directory string) (int, int64, error) {
+	files, size := 0, int64(0)
+	err := filepath.Walk(directory, func(_ string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = files + 1
+			size = size + info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// cacheStoreProvider is implemented by the clients of the RUN commands able to mount the caches.
+type cacheStoreProvider interface {
+	cacheStore() *cacheStore
+}
+
+// mountCaches mounts the caches of the RUN command, a command with cache mounts fails
+// when the client can't mount them.
+func mountCaches(logger hclog.Logger, cmd commands.Run, grpcClient rootfs.ClientProvider) (*mountedCaches, error) {
+	caches, err := parseCacheMounts(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(caches) == 0 {
+		return &mountedCaches{logger: logger}, nil
+	}
+	var store *cacheStore
+	if provider, ok := grpcClient.(cacheStoreProvider); ok {
+		store = provider.cacheStore()
+	}
+	if store == nil {
+		return nil, fmt.Errorf("cache mounts not available")
+	}
+	return store.mount(caches)
+}
+
+// mountedCaches are the caches mounted for a single RUN command, the locks are held until cleanup.
+type mountedCaches struct {
+	logger hclog.Logger
+
+	createdDirectories []string
+	lockFiles          []*os.File
+	mountedTargets     []string
+}
+
+func (m *mountedCaches) mount(cache *cacheMount, directory string) error {
+	// the bind mount needs an existing target, whatever is created for it is removed afterwards:
+	createdDirectories, err := createMountDirectories(cache.target)
+	m.createdDirectories = append(m.createdDirectories, createdDirectories...)
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount(directory, cache.target, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+	m.mountedTargets = append(m.mountedTargets, cache.target)
+	if cache.readOnly {
+		return unix.Mount("", cache.target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+	}
+	return nil
+}
+
+// cleanup unmounts the caches, removes what was created for them and releases the locks.
+func (m *mountedCaches) cleanup() {
+	for index := len(m.mountedTargets) - 1; index >= 0; index-- {
+		if err := unix.Unmount(m.mountedTargets[index], unix.MNT_DETACH); err != nil {
+			m.logger.Warn("failed unmounting cache", "target", m.mountedTargets[index], "reason", err)
+		}
+	}
+	for index := len(m.createdDirectories) - 1; index >= 0; index-- {
+		// the command may have left something in the directory:
+		os.Remove(m.createdDirectories[index])
+	}
+	for _, lockFile := range m.lockFiles {
+		lockFile.Close()
+	}
+	m.mountedTargets, m.createdDirectories, m.lockFiles = nil, nil, nil
+}
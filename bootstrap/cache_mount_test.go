@@ -0,0 +1,138 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func cacheCommand(flags, command string) commands.Run {
+	cmd := commands.RunWithDefaults(command)
+	cmd.OriginalCommand = fmt.Sprintf("RUN %s %s", flags, command)
+	return cmd
+}
+
+func TestParseCacheMounts(t *testing.T) {
+	cmd := cacheCommand("--mount=type=cache,target=/root/.cache --mount=type=secret,id=token --mount=type=cache,id=pip,target=relative,sharing=locked,ro,mode=0700,uid=1000,gid=1000", "true")
+	cmd.Workdir = commands.Workdir{Value: "/app"}
+	caches, err := parseCacheMounts(cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, []*cacheMount{
+		{id: "/root/.cache", target: "/root/.cache", sharing: cacheSharingShared, mode: defaultCacheMountMode},
+		{id: "pip", target: "/app/relative", sharing: cacheSharingLocked, readOnly: true, mode: fs.FileMode(0700), uid: 1000, gid: 1000},
+	}, caches)
+
+	for _, invalid := range []string{
+		"--mount=type=cache,id=pip",
+		"--mount=type=cache,target=/cache,sharing=exclusive",
+		"--mount=type=cache,target=/cache,from=builder",
+		"--mount=type=cache,target=/cache,mode=rw",
+	} {
+		_, err := parseCacheMounts(cacheCommand(invalid, "true"))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestShellCommandRunnerMountsCaches(t *testing.T) {
+	runner := newTestShellCommandRunner(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mustSupportMounts(t, tempDir)
+
+	drive := filepath.Join(tempDir, "drive")
+	assert.Nil(t, os.Mkdir(drive, 0755))
+	target := filepath.Join(tempDir, "var/cache/apt")
+	newClient := func(caches *cacheStore) *runClient {
+		return &runClient{ClientProvider: &recordingClient{}, caches: caches}
+	}
+
+	// the cache contents survive the command and the build:
+	caches := newCacheStore(hclog.Default(), drive, "")
+	assert.Nil(t, runner.Execute(context.Background(), cacheCommand("--mount=type=cache,id=apt,target="+target, "echo cached > "+target+"/file"), newClient(caches)))
+	_, err = os.Stat(filepath.Join(tempDir, "var"))
+	assert.True(t, os.IsNotExist(err), err)
+	assert.Equal(t, []*CacheMountStats{{ID: "apt", Uses: 1, Instances: 1, Files: 1, SizeBytes: 7, Persistent: true}}, caches.close())
+
+	caches = newCacheStore(hclog.Default(), drive, "")
+	client := newClient(caches)
+	assert.Nil(t, runner.Execute(context.Background(), cacheCommand("--mount=type=cache,id=apt,target="+target+",ro", "cat "+target+"/file"), client))
+	assert.Equal(t, []string{"cached"}, client.ClientProvider.(*recordingClient).stdout)
+
+	// a read-only cache can't be written:
+	assert.NotNil(t, runner.Execute(context.Background(), cacheCommand("--mount=type=cache,id=apt,target="+target+",readonly", "touch "+target+"/other"), newClient(caches)))
+
+	// a private cache in use gets another directory, a shared one does not:
+	held, err := caches.mount([]*cacheMount{{id: "apt", target: filepath.Join(tempDir, "held"), sharing: cacheSharingShared, mode: defaultCacheMountMode}})
+	assert.Nil(t, err)
+	client = newClient(caches)
+	assert.Nil(t, runner.Execute(context.Background(), cacheCommand("--mount=type=cache,id=apt,sharing=private,target="+target, "ls "+target), client))
+	assert.Empty(t, client.ClientProvider.(*recordingClient).stdout)
+	client = newClient(caches)
+	assert.Nil(t, runner.Execute(context.Background(), cacheCommand("--mount=type=cache,id=apt,sharing=shared,target="+target, "ls "+target), client))
+	assert.Equal(t, []string{"file"}, client.ClientProvider.(*recordingClient).stdout)
+	held.cleanup()
+
+	stats := caches.close()
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, 5, stats[0].Uses)
+	assert.Equal(t, 2, stats[0].Instances)
+
+	// without the client providing the caches, a command with a cache mount fails:
+	assert.NotNil(t, runner.Execute(context.Background(), cacheCommand("--mount=type=cache,target="+target, "true"), &recordingClient{}))
+}
+
+func TestBootstrapReportsCacheMounts(t *testing.T) {
+	runner := newTestShellCommandRunner(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mustSupportMounts(t, tempDir)
+
+	target := filepath.Join(tempDir, "cache")
+	reportPath := filepath.Join(tempDir, "report.json")
+	client := &recordingClient{commands: []commands.VMInitSerializableCommand{
+		cacheCommand("--mount=type=cache,target="+target, "echo one > "+target+"/one"),
+		cacheCommand("--mount=type=cache,target="+target, "echo two > "+target+"/two"),
+		cacheCommand("--mount=type=cache,target="+target, "cat "+target+"/one "+target+"/two"),
+	}}
+
+	// without the cache drive, the caches last for the build:
+	assert.Nil(t, NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{}).
+		WithCommandRunner(runner).
+		WithBuildReportFile(reportPath).(*defaultBootstrapper).
+		execute(context.Background(), client))
+	assert.Equal(t, []string{"one", "two"}, client.output())
+	expected := []*CacheMountStats{{ID: target, Uses: 3, Instances: 1, Files: 2, SizeBytes: 8}}
+	sent := []*CacheMountStats{}
+	assert.Nil(t, client.statuses(StatusKindCacheMounts, func() interface{} {
+		return &sent
+	}))
+	assert.Equal(t, expected, sent)
+
+	reportBytes, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal("expected build report, got error", err)
+	}
+	report := &BuildReport{}
+	if err := json.Unmarshal(reportBytes, report); err != nil {
+		t.Fatal("expected build report to parse, got error", err)
+	}
+	assert.Equal(t, expected, report.CacheMounts)
+}
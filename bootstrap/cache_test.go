@@ -0,0 +1,196 @@
+package bootstrap
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// cacheReportingClient counts the resource fetches.
+type cacheReportingClient struct {
+	*recordingClient
+	fetches int
+}
+
+func (c *cacheReportingClient) Resource(path string) (chan interface{}, error) {
+	c.fetches = c.fetches + 1
+	return c.recordingClient.Resource(path)
+}
+
+// results returns the cache results of the status lines.
+func (c *cacheReportingClient) results(t *testing.T) []*CacheResult {
+	results := []*CacheResult{}
+	assert.Nil(t, c.statuses(StatusKindCache, func() interface{} {
+		results = append(results, &CacheResult{})
+		return results[len(results)-1]
+	}))
+	return results
+}
+
+func cacheHits(results []*CacheResult) []bool {
+	hits := []bool{}
+	for _, result := range results {
+		hits = append(hits, result.Hit)
+	}
+	return hits
+}
+
+func cacheOnPreviousResults(results []*CacheResult) []bool {
+	onPrevious := []bool{}
+	for _, result := range results {
+		onPrevious = append(onPrevious, result.OnPreviousResults)
+	}
+	return onPrevious
+}
+
+func TestBuildCacheSkipsUnchangedSteps(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cachePath := filepath.Join(tempDir, "bootstrap/cache.json")
+	targetPath := filepath.Join(tempDir, "etc/app.conf")
+
+	build := func(copiedContent string, runCommands ...string) (*failingCommandRunner, *cacheReportingClient) {
+		copyCommand := commands.Copy{
+			OriginalCommand: "COPY app.conf " + targetPath,
+			OriginalSource:  "app.conf",
+			Source:          "app.conf",
+			Target:          targetPath,
+			User:            commands.DefaultUser(),
+			Workdir:         commands.DefaultWorkdir(),
+		}
+		allCommands := []commands.VMInitSerializableCommand{commands.RunWithDefaults(runCommands[0]), copyCommand}
+		allCommands = append(allCommands, testCommands(runCommands[1:]...)...)
+		client := &cacheReportingClient{recordingClient: &recordingClient{
+			commands: allCommands,
+			resources: map[string][]resources.ResolvedResource{
+				"app.conf": {
+					resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+						return ioutil.NopCloser(strings.NewReader(copiedContent)), nil
+					}, fs.FileMode(0644), "app.conf", targetPath, copyCommand.Workdir, copyCommand.User),
+				},
+			},
+		}}
+		runner := &failingCommandRunner{}
+		err := NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{Cache: "true"}).
+			WithCommandRunner(runner).
+			WithResourceDeployer(NewExecutingResourceDeployer(hclog.Default())).
+			WithCacheFile(cachePath).(*defaultBootstrapper).
+			execute(context.Background(), client)
+		assert.Nil(t, err)
+		return runner, client
+	}
+	assertDeployed := func(expected string) {
+		content, err := ioutil.ReadFile(targetPath)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	// the first build executes everything:
+	runner, client := build("v1", "one", "two")
+	assert.Equal(t, []string{"one", "two"}, runner.executed)
+	assert.Equal(t, []bool{false, false, false}, cacheHits(client.results(t)))
+	assert.Equal(t, []bool{false, false, false}, cacheOnPreviousResults(client.results(t)))
+	assertDeployed("v1")
+
+	// an unchanged build executes nothing:
+	runner, client = build("v1", "one", "two")
+	assert.Empty(t, runner.executed)
+	assert.Equal(t, []bool{true, true, true}, cacheHits(client.results(t)))
+
+	// a changed last step executes only the last step:
+	runner, client = build("v1", "one", "changed")
+	assert.Equal(t, []string{"changed"}, runner.executed)
+	assert.Equal(t, []bool{true, true, false}, cacheHits(client.results(t)))
+	// the previous results of the changed step are not rolled back:
+	assert.Equal(t, []bool{false, false, true}, cacheOnPreviousResults(client.results(t)))
+
+	// changed resources execute the step and everything after it, the resources are fetched once:
+	runner, client = build("v2", "one", "changed")
+	assert.Equal(t, []string{"changed"}, runner.executed)
+	assert.Equal(t, []bool{true, false, false}, cacheHits(client.results(t)))
+	assert.Equal(t, 1, client.fetches)
+	assertDeployed("v2")
+
+	cache, err := (&cacheFile{path: cachePath}).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(cache.Steps))
+	for index, step := range cache.Steps {
+		assert.Equal(t, index, step.Index)
+		assert.Equal(t, client.results(t)[index].Hash, step.Hash)
+	}
+
+	// a build without the cache removes it, the cache no longer describes the rootfs:
+	assert.Nil(t, NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{}).
+		WithCommandRunner(&failingCommandRunner{}).
+		WithCacheFile(cachePath).(*defaultBootstrapper).
+		execute(context.Background(), &recordingClient{commands: testCommands("one")}))
+	_, err = os.Stat(cachePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHashingClientHashesPartiallyReadContents(t *testing.T) {
+	newClient := func() *hashingClient {
+		return &hashingClient{ClientProvider: &recordingClient{
+			resources: map[string][]resources.ResolvedResource{
+				"file": {
+					resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+						return ioutil.NopCloser(strings.NewReader("contents")), nil
+					}, fs.FileMode(0644), "file", "/file", commands.DefaultWorkdir(), commands.DefaultUser()),
+				},
+			},
+		}}
+	}
+
+	spooling := newClient()
+	defer spooling.discard()
+	fetched, err := spooling.fetchResourcesHash("file")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, fetched)
+
+	// the spooled resources are served to the next fetch, the hash is the same:
+	input, err := spooling.Resource("file")
+	assert.Nil(t, err)
+	reader, err := (<-input).(resources.ResolvedResource).Contents()
+	assert.Nil(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, "contents", string(contents))
+	assert.Nil(t, <-input)
+	assert.Equal(t, fetched, spooling.hash())
+
+	// a resource read in part is hashed in full on close:
+	client := newClient()
+	input, err = client.Resource("file")
+	assert.Nil(t, err)
+	reader, err = (<-input).(resources.ResolvedResource).Contents()
+	assert.Nil(t, err)
+	_, err = reader.Read(make([]byte, 3))
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, <-input)
+	assert.Equal(t, fetched, client.hash())
+
+	// a resource never read can't be identified:
+	client = newClient()
+	input, err = client.Resource("file")
+	assert.Nil(t, err)
+	for range input {
+	}
+	assert.Empty(t, client.hash())
+}
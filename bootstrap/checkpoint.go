@@ -0,0 +1,126 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint records the commands of the bootstrap completed so far.
+type Checkpoint struct {
+	// CommandsHash is the hash of the complete command list.
+	CommandsHash string `json:"CommandsHash"`
+	// Steps are the completed commands, in order.
+	Steps []*CheckpointStep `json:"Steps"`
+}
+
+// CheckpointStep records a single completed command.
+type CheckpointStep struct {
+	Index       int       `json:"Index"`
+	CommandHash string    `json:"CommandHash"`
+	Resources   []string  `json:"Resources,omitempty"`
+	CompletedAt time.Time `json:"CompletedAt"`
+}
+
+// Completed returns the number of completed commands.
+func (c *Checkpoint) Completed() int {
+	return len(c.Steps)
+}
+
+// Resume is the status sent when the bootstrap resumes from the checkpoint.
+// The resume is decided from the local checkpoint only, the server is not asked.
+type Resume struct {
+	// CommandsHash is the hash of the complete command list.
+	CommandsHash string `json:"CommandsHash"`
+	// ResumeIndex is the index of the first executed command, the commands before it completed in a previous run.
+	ResumeIndex int `json:"ResumeIndex"`
+}
+
+// checkpointFile reads and writes the checkpoint, the zero value does not record anything.
+type checkpointFile struct {
+	path string
+}
+
+// load returns the checkpoint, nil if there is none.
+func (f *checkpointFile) load() (*Checkpoint, error) {
+	if f.path == "" {
+		return nil, nil
+	}
+	checkpointBytes, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed reading checkpoint")
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(checkpointBytes, checkpoint); err != nil {
+		return nil, errors.Wrap(err, "failed parsing checkpoint")
+	}
+	return checkpoint, nil
+}
+
+// save writes the checkpoint atomically.
+func (f *checkpointFile) save(checkpoint *Checkpoint) error {
+	if f.path == "" {
+		return nil
+	}
+	return errors.Wrap(fsutil.WriteJSONAtomically(f.path, checkpoint, 0600, 0700), "failed writing checkpoint")
+}
+
+// remove removes the checkpoint once the bootstrap finished.
+func (f *checkpointFile) remove() error {
+	if f.path == "" {
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed removing checkpoint")
+	}
+	return nil
+}
+
+// resumeIndex returns the index of the first command to execute given the checkpoint of a previous run.
+// The checkpoint must be recorded for the same commands.
+func resumeIndex(checkpoint *Checkpoint, commandsHash string, nCommands int) int {
+	if checkpoint == nil || checkpoint.CommandsHash != commandsHash {
+		return 0
+	}
+	index := checkpoint.Completed()
+	if index > nCommands {
+		index = nCommands
+	}
+	return index
+}
+
+// commandHash returns a stable hash of the command, including its type.
+func commandHash(command commands.VMInitSerializableCommand) (string, error) {
+	commandBytes, err := json.Marshal(command)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(append([]byte(fmt.Sprintf("%T:", command)), commandBytes...))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// commandsHash returns a stable hash of the command list and the hashes of the individual commands.
+func commandsHash(input []commands.VMInitSerializableCommand) (string, []string, error) {
+	hashes := []string{}
+	hash := sha256.New()
+	for _, command := range input {
+		single, err := commandHash(command)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed hashing command")
+		}
+		hashes = append(hashes, single)
+		hash.Write([]byte(single))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), hashes, nil
+}
@@ -0,0 +1,135 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingCommandRunner records the executed commands and fails the command given in failOn.
+type failingCommandRunner struct {
+	executed []string
+	failOn   string
+}
+
+func (r *failingCommandRunner) Execute(ctx context.Context, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	if cmd.Command == r.failOn {
+		return errors.New("failed on purpose")
+	}
+	r.executed = append(r.executed, cmd.Command)
+	return nil
+}
+
+func testCommands(input ...string) []commands.VMInitSerializableCommand {
+	output := []commands.VMInitSerializableCommand{}
+	for _, command := range input {
+		output = append(output, commands.RunWithDefaults(command))
+	}
+	return output
+}
+
+func TestBootstrapResumesFromCheckpoint(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	checkpointPath := filepath.Join(tempDir, "bootstrap/checkpoint.json")
+	newBootstrapper := func(runner CommandRunner) *defaultBootstrapper {
+		return NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{}).
+			WithCommandRunner(runner).
+			WithCheckpointFile(checkpointPath).(*defaultBootstrapper)
+	}
+
+	// the first execution fails on the third command:
+	runner := &failingCommandRunner{failOn: "three"}
+	client := &recordingClient{commands: testCommands("one", "two", "three", "four")}
+	assert.NotNil(t, newBootstrapper(runner).execute(context.Background(), client))
+	assert.NotNil(t, client.aborted)
+	assert.Equal(t, []string{"one", "two"}, runner.executed)
+
+	checkpoint, err := (&checkpointFile{path: checkpointPath}).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, checkpoint.Completed())
+	assert.Equal(t, 1, checkpoint.Steps[1].Index)
+
+	// the next execution skips the completed commands:
+	runner = &failingCommandRunner{}
+	client = &recordingClient{commands: testCommands("one", "two", "three", "four")}
+	assert.Nil(t, newBootstrapper(runner).execute(context.Background(), client))
+	assert.True(t, client.succeeded)
+	assert.Equal(t, []string{"three", "four"}, runner.executed)
+
+	// the server is told about the resume:
+	resumes := []*Resume{}
+	assert.Nil(t, client.statuses(StatusKindResume, func() interface{} {
+		resumes = append(resumes, &Resume{})
+		return resumes[len(resumes)-1]
+	}))
+	assert.Equal(t, []*Resume{{CommandsHash: checkpoint.CommandsHash, ResumeIndex: 2}}, resumes)
+
+	// the checkpoint is removed after a successful build:
+	_, err = os.Stat(checkpointPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBootstrapDiscardsCheckpointOfChangedCommands(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	checkpointPath := filepath.Join(tempDir, "checkpoint.json")
+	newBootstrapper := func(runner CommandRunner) *defaultBootstrapper {
+		return NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{}).
+			WithCommandRunner(runner).
+			WithCheckpointFile(checkpointPath).(*defaultBootstrapper)
+	}
+
+	assert.NotNil(t, newBootstrapper(&failingCommandRunner{failOn: "two"}).
+		execute(context.Background(), &recordingClient{commands: testCommands("one", "two")}))
+
+	// the stale checkpoint is discarded and the bootstrap starts over:
+	runner := &failingCommandRunner{}
+	client := &recordingClient{commands: testCommands("one", "changed")}
+	assert.Nil(t, newBootstrapper(runner).execute(context.Background(), client))
+	assert.True(t, client.succeeded)
+	assert.Equal(t, []string{"one", "changed"}, runner.executed)
+}
+
+func TestResumeIndex(t *testing.T) {
+	checkpoint := &Checkpoint{CommandsHash: "hash", Steps: []*CheckpointStep{{Index: 0}, {Index: 1}}}
+
+	assert.Equal(t, 0, resumeIndex(nil, "hash", 3))
+	assert.Equal(t, 2, resumeIndex(checkpoint, "hash", 3))
+	// a checkpoint of more commands resumes after the last one:
+	assert.Equal(t, 1, resumeIndex(checkpoint, "hash", 1))
+
+	// a checkpoint of other commands is not resumed:
+	assert.Equal(t, 0, resumeIndex(checkpoint, "other", 3))
+}
+
+func TestCommandsHash(t *testing.T) {
+	hash, hashes, err := commandsHash(testCommands("one", "two"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(hashes))
+
+	sameHash, _, err := commandsHash(testCommands("one", "two"))
+	assert.Nil(t, err)
+	assert.Equal(t, hash, sameHash)
+
+	otherHash, _, err := commandsHash(testCommands("two", "one"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, otherHash)
+}
@@ -0,0 +1,26 @@
+package bootstrap
+
+import (
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+)
+
+// clientWrapper is implemented by the client providers wrapping another client provider.
+type clientWrapper interface {
+	unwrap() rootfs.ClientProvider
+}
+
+// findClient returns the first of the client and the clients it wraps matching the predicate,
+// the optional interfaces of the server client are not implemented by the wrappers.
+func findClient(client rootfs.ClientProvider, matches func(rootfs.ClientProvider) bool) (rootfs.ClientProvider, bool) {
+	for client != nil {
+		if matches(client) {
+			return client, true
+		}
+		wrapper, ok := client.(clientWrapper)
+		if !ok {
+			break
+		}
+		client = wrapper.unwrap()
+	}
+	return nil, false
+}
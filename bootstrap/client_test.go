@@ -0,0 +1,103 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+)
+
+// recordingClient is a client provider recording the output and the outcome of a build.
+type recordingClient struct {
+	sync.Mutex
+	aborted   error
+	commands  []commands.VMInitSerializableCommand
+	resources map[string][]resources.ResolvedResource
+	stderr    []string
+	stdout    []string
+	succeeded bool
+}
+
+func (c *recordingClient) Abort(err error) error {
+	c.Lock()
+	defer c.Unlock()
+	c.aborted = err
+	return nil
+}
+
+func (c *recordingClient) Commands() error {
+	return nil
+}
+
+func (c *recordingClient) NextCommand() commands.VMInitSerializableCommand {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.commands) == 0 {
+		return nil
+	}
+	next := c.commands[0]
+	c.commands = c.commands[1:]
+	return next
+}
+
+func (c *recordingClient) Ping() error {
+	return nil
+}
+
+func (c *recordingClient) Resource(path string) (chan interface{}, error) {
+	output := make(chan interface{}, len(c.resources[path])+1)
+	for _, resource := range c.resources[path] {
+		output <- resource
+	}
+	output <- nil
+	return output, nil
+}
+
+func (c *recordingClient) StdErr(lines []string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.stderr = append(c.stderr, lines...)
+	return nil
+}
+
+func (c *recordingClient) StdOut(lines []string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.stdout = append(c.stdout, lines...)
+	return nil
+}
+
+// output returns the StdOut lines which are not status lines.
+func (c *recordingClient) output() []string {
+	c.Lock()
+	defer c.Unlock()
+	output := []string{}
+	for _, line := range c.stdout {
+		if _, _, ok := ParseStatusLine(line); !ok {
+			output = append(output, line)
+		}
+	}
+	return output
+}
+
+// statuses unmarshals the status lines of the kind sent to StdOut, into is called for a new value.
+func (c *recordingClient) statuses(kind string, into func() interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, line := range c.stdout {
+		if lineKind, status, ok := ParseStatusLine(line); ok && lineKind == kind {
+			if err := json.Unmarshal(status, into()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *recordingClient) Success() error {
+	c.Lock()
+	defer c.Unlock()
+	c.succeeded = true
+	return nil
+}
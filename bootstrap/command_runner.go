@@ -1,12 +1,22 @@
 package bootstrap
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/combust-labs/firebuild-mmds/passwd"
 	"github.com/combust-labs/firebuild-shared/build/commands"
 	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/combust-labs/firebuild-shared/env"
@@ -14,15 +24,25 @@ import (
 	"github.com/pkg/errors"
 )
 
+// defaultRunPath is the PATH of a RUN command unless set with ENV, the same as in Docker.
+const defaultRunPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// defaultPTYTerm is the TERM of a RUN command attached to a pseudo-terminal, the same as in Docker.
+const defaultPTYTerm = "xterm"
+
+// defaultKillGracePeriod is the time a RUN process group has to exit after SIGTERM before it is killed with SIGKILL.
+const defaultKillGracePeriod = time.Second * 10
+
 type CommandRunner interface {
-	Execute(commands.Run, rootfs.ClientProvider) error
+	// Execute executes the RUN command, the command is stopped when the context is done.
+	Execute(context.Context, commands.Run, rootfs.ClientProvider) error
 }
 
 type noopCommandRunner struct {
 	logger hclog.Logger
 }
 
-func (n *noopCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+func (n *noopCommandRunner) Execute(ctx context.Context, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
 
 	cmdEnv := env.NewBuildEnv()
 	for k, v := range cmd.Args {
@@ -52,18 +72,35 @@ func (n *noopCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientPr
 }
 
 type shellCommandRunner struct {
-	defaultUser commands.User
-	logger      hclog.Logger
+	defaultUser     commands.User
+	groupFile       string
+	killGracePeriod time.Duration
+	logger          hclog.Logger
+	passwdFile      string
+	pty             *PTYConfig
 }
 
 func NewShellCommandRunner(logger hclog.Logger) CommandRunner {
+	return NewShellCommandRunnerWithPTY(logger, nil)
+}
+
+// NewShellCommandRunnerWithPTY returns a runner executing the commands attached to a pseudo-terminal,
+// the commands are attached to pipes when the config is nil.
+func NewShellCommandRunnerWithPTY(logger hclog.Logger, pty *PTYConfig) CommandRunner {
 	return &shellCommandRunner{
-		defaultUser: commands.DefaultUser(),
-		logger:      logger,
+		defaultUser:     commands.DefaultUser(),
+		groupFile:       defaultGroupFile,
+		killGracePeriod: defaultKillGracePeriod,
+		logger:          logger,
+		passwdFile:      defaultPasswdFile,
+		pty:             pty,
 	}
 }
 
-func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+// Execute executes the RUN command in its own process group. When the context is done,
+// the process group receives SIGTERM and, after the grace period, SIGKILL.
+// Background processes left behind by the command are killed when the command exits.
+func (n *shellCommandRunner) Execute(ctx context.Context, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
 
 	logValues := []interface{}{
 		"workdir", cmd.Workdir.Value,
@@ -76,47 +113,135 @@ func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientP
 
 	n.logger.Debug("executing command", logValues...)
 
-	cmdEnv := env.NewBuildEnv()
-	for k, v := range cmd.Args {
-		cmdEnv.Put(k, v)
-	}
-	for k, v := range cmd.Env {
-		cmdEnv.Put(k, v)
+	userValue := cmd.User.Value
+	if userValue == "" {
+		userValue = n.defaultUser.Value
 	}
 
-	environment, commandToExecute, cleanupFunc := constructExecutableCommand(n.logger, cmdEnv, cmd.Command)
-	defer cleanupFunc()
+	// previous RUN commands may have created users so the database is loaded for every command:
+	db, err := passwd.NewDatabaseFromFiles(n.passwdFile, n.groupFile)
+	if err != nil {
+		n.logger.Error("failed loading users and groups database", "reason", err)
+		return errors.Wrap(err, "failed loading users and groups database")
+	}
+	user, err := resolveExecUser(db, userValue)
+	if err != nil {
+		n.logger.Error("failed resolving RUN user", "user", userValue, "reason", err)
+		return errors.Wrapf(err, "RUN user '%s' can't be resolved", userValue)
+	}
 
-	// TODO: https://github.com/combust-labs/firebuild/issues/2
+	// the secrets exist only while the command runs:
+	secrets, err := mountSecrets(n.logger.Named("secrets"), cmd, grpcClient)
+	if err != nil {
+		n.logger.Error("failed mounting secrets", "reason", err)
+		return errors.Wrap(err, "failed mounting secrets")
+	}
+	defer secrets.cleanup()
 
-	cmdargs := cmd.Shell.Commands
-	//cmdargs = append(cmdargs, fmt.Sprintf("'%s'", strings.ReplaceAll(envString+cmdEnv.Expand(cmd.Command), "'", "'\\''")))
-	cmdargs = append(cmdargs, commandToExecute)
+	// so do the cache mounts:
+	caches, err := mountCaches(n.logger.Named("caches"), cmd, grpcClient)
+	if err != nil {
+		n.logger.Error("failed mounting caches", "reason", err)
+		return errors.Wrap(err, "failed mounting caches")
+	}
+	defer caches.cleanup()
 
-	shellCmd := exec.Command(cmdargs[0], cmdargs[1:]...)
+	shellCmd, err := n.command(cmd, user)
+	if err != nil {
+		n.logger.Error("failed constructing command", "reason", err)
+		return err
+	}
 	shellCmd.Dir = cmd.Workdir.Value
-	shellCmd.Env = environment
-	shellCmd.Stderr = &shellCommandWriter{
-		writerFunc: func(p []byte) error {
-			n.logger.Trace("writing stderr", "data", string(p))
-			return grpcClient.StdErr([]string{string(p)})
-		},
+	// the command and everything it starts can be signalled together,
+	// with a PTY the command leads a new session, and with it a new process group:
+	shellCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: n.pty == nil, Setsid: n.pty != nil, Setctty: n.pty != nil}
+	if os.Getuid() != 0 {
+		// only root can switch users, vminit runs as root in the guest:
+		n.logger.Warn("not running as root, RUN command executes as the current user", "user", userValue)
+	} else if user.Uid != 0 || user.Gid != 0 || len(user.Groups) > 0 {
+		groups := []uint32{}
+		for _, gid := range user.Groups {
+			groups = append(groups, uint32(gid))
+		}
+		shellCmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    uint32(user.Uid),
+			Gid:    uint32(user.Gid),
+			Groups: groups,
+		}
+	}
+
+	// the output goes through pipes owned by us, not by exec.Cmd, otherwise Wait would
+	// block until every background process holding the output exits:
+	// the command is stopped when its output can't be sent:
+	ctx, cancelOutput := context.WithCancel(ctx)
+	defer cancelOutput()
+	var output *commandOutput
+	if n.pty != nil {
+		output, err = newPTYCommandOutput(n.logger, grpcClient, n.pty, secrets.redactions(), cancelOutput)
+	} else {
+		output, err = newCommandOutput(n.logger, grpcClient, secrets.redactions(), cancelOutput)
+	}
+	if err != nil {
+		n.logger.Error("failed creating command output", "reason", err)
+		return err
 	}
-	shellCmd.Stdout = &shellCommandWriter{
-		writerFunc: func(p []byte) error {
-			n.logger.Trace("writing stdout", "data", string(p))
-			return grpcClient.StdOut([]string{string(p)})
-		},
+	shellCmd.Stderr = output.stderr
+	shellCmd.Stdin = output.stdin
+	shellCmd.Stdout = output.stdout
+
+	if err := ctx.Err(); err != nil {
+		output.close()
+		n.logger.Error("command not started, context done", "reason", err)
+		return errors.Wrap(err, "command not started")
 	}
 
 	// Start the command
 	if err := shellCmd.Start(); err != nil {
+		output.close()
 		n.logger.Error("failed starting command", "reason", err)
 		return err
 	}
+	output.started()
+
+	chanWait := make(chan error, 1)
+	go func() {
+		chanWait <- shellCmd.Wait()
+	}()
+
+	var waitErr, stopErr error
+	select {
+	case waitErr = <-chanWait:
+	case <-ctx.Done():
+		n.logger.Warn("stopping command", "pid", shellCmd.Process.Pid, "reason", ctx.Err())
+		signalProcessGroup(n.logger, shellCmd.Process.Pid, syscall.SIGTERM)
+		timer := time.NewTimer(n.killGracePeriod)
+		select {
+		case <-chanWait:
+			timer.Stop()
+		case <-timer.C:
+			n.logger.Warn("command did not exit within the grace period, killing", "pid", shellCmd.Process.Pid, "grace-period", n.killGracePeriod)
+			signalProcessGroup(n.logger, shellCmd.Process.Pid, syscall.SIGKILL)
+			<-chanWait
+		}
+		stopErr = ctx.Err()
+	}
+
+	// background processes must not outlive the step:
+	signalProcessGroup(n.logger, shellCmd.Process.Pid, syscall.SIGKILL)
+	outputErr := output.wait(n.killGracePeriod)
+
+	if outputErr != nil {
+		n.logger.Error("command output was not sent", "reason", outputErr)
+		return errors.Wrap(outputErr, "failed sending command output")
+	}
+
+	if stopErr != nil {
+		n.logger.Error("command stopped", "reason", stopErr)
+		return errors.Wrap(stopErr, "command stopped")
+	}
 
-	if err := shellCmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
+	if waitErr != nil {
+		if exiterr, ok := waitErr.(*exec.ExitError); ok {
 
 			// The program has exited with an exit code != 0
 			// This works on both Unix and Windows. Although package
@@ -126,8 +251,8 @@ func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientP
 			n.logger.Error("command finished with error", "reason", exiterr)
 			return errors.Wrapf(exiterr, "command exited with code: %d, message %q", exiterr.ExitCode(), exiterr.String())
 		} else {
-			n.logger.Error("wait returned a non exec.ExitError error", "reason", err)
-			return err
+			n.logger.Error("wait returned a non exec.ExitError error", "reason", waitErr)
+			return waitErr
 		}
 	}
 
@@ -136,69 +261,293 @@ func (n *shellCommandRunner) Execute(cmd commands.Run, grpcClient rootfs.ClientP
 	return nil
 }
 
-type shellCommandWriter struct {
-	writerFunc func([]byte) error
+// commandOutput forwards the output of a command to the client.
+type commandOutput struct {
+	copiers  sync.WaitGroup
+	logger   hclog.Logger
+	readers  []*os.File
+	streamer *outputStreamer
+
+	// the files given to the command, stdin is nil without a PTY:
+	stderr *os.File
+	stdin  *os.File
+	stdout *os.File
 }
 
-func (e *shellCommandWriter) Write(p []byte) (n int, err error) {
-	if err := e.writerFunc(p); err != nil {
-		return 0, err
+// newCommandOutput attaches the command to pipes, the redactions are replaced in the output.
+// The cancel function is called when the output can't be sent.
+func newCommandOutput(logger hclog.Logger, grpcClient rootfs.ClientProvider, redactions []string, cancel func()) (*commandOutput, error) {
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stderrReader.Close()
+		stderrWriter.Close()
+		return nil, err
+	}
+	output := &commandOutput{
+		logger:   logger,
+		readers:  []*os.File{stderrReader, stdoutReader},
+		streamer: newOutputStreamer(logger, grpcClient).redacting(redactions).cancelling(cancel).start(),
+		stderr:   stderrWriter,
+		stdout:   stdoutWriter,
 	}
-	return len(p), nil
+	output.copy(stderrReader, output.streamer.writer(OutputStreamStderr))
+	output.copy(stdoutReader, output.streamer.writer(OutputStreamStdout))
+	return output, nil
 }
 
-// returns environment, command to execute and a cleanup function
-func constructExecutableCommand(logger hclog.Logger, cmdEnv env.BuildEnv, inputCommand string) ([]string, string, func()) {
-	environment := os.Environ()
-	for k, v := range cmdEnv.Snapshot() {
-		environment = append(environment, fmt.Sprintf("%s=\"%s\"", k, v))
+// newPTYCommandOutput attaches the command to a pseudo-terminal, the merged output is streamed as stdout.
+func newPTYCommandOutput(logger hclog.Logger, grpcClient rootfs.ClientProvider, config *PTYConfig, redactions []string, cancel func()) (*commandOutput, error) {
+	master, slave, err := openPTY(config)
+	if err != nil {
+		return nil, err
 	}
-	envFileContents := []string{}
-	for _, envItem := range environment {
-		envFileContents = append(envFileContents, fmt.Sprintf("export %s", envItem))
+	output := &commandOutput{
+		logger:   logger,
+		readers:  []*os.File{master},
+		streamer: newOutputStreamer(logger, grpcClient).redacting(redactions).cancelling(cancel).start(),
+		stderr:   slave,
+		stdin:    slave,
+		stdout:   slave,
 	}
+	var writer io.Writer = output.streamer.writer(OutputStreamStdout)
+	if !config.KeepANSI {
+		writer = &ansiStripWriter{next: writer}
+	}
+	output.copy(master, writer)
+	return output, nil
+}
+
+func (o *commandOutput) copy(reader io.Reader, writer io.Writer) {
+	o.copiers.Add(1)
+	go func() {
+		defer o.copiers.Done()
+		// the PTY master returns EIO once the command side is closed:
+		if _, err := io.Copy(writer, reader); err != nil && !errors.Is(err, os.ErrClosed) && !errors.Is(err, syscall.EIO) {
+			o.logger.Warn("failed forwarding command output", "reason", err)
+		}
+	}()
+}
 
-	expandedCommand := cmdEnv.Expand(inputCommand)
+// started closes the writing ends after the command started, the command holds its own copies.
+func (o *commandOutput) started() {
+	closed := map[*os.File]bool{}
+	for _, file := range []*os.File{o.stderr, o.stdin, o.stdout} {
+		if file != nil && !closed[file] {
+			file.Close()
+			closed[file] = true
+		}
+	}
+}
 
-	tempFile, tempFileErr := ioutil.TempFile("", "")
+// wait waits until all the output is forwarded, at most the timeout, and returns the error of forwarding the output.
+// The output of processes which escaped the process group is discarded.
+func (o *commandOutput) wait(timeout time.Duration) error {
+	chanCopied := make(chan struct{})
+	go func() {
+		o.copiers.Wait()
+		close(chanCopied)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-chanCopied:
+	case <-timer.C:
+		o.logger.Warn("command output still open after the command exited, discarding")
+	}
+	for _, reader := range o.readers {
+		reader.Close()
+	}
+	o.copiers.Wait()
+	return o.streamer.close()
+}
 
-	if tempFileErr != nil {
+func (o *commandOutput) close() {
+	o.started()
+	for _, reader := range o.readers {
+		reader.Close()
+	}
+	o.copiers.Wait()
+	o.streamer.close()
+}
 
-		// if we are not allowed to write to the file, try executing the command inline:
-		logger.Warn("failed creating temporary command file, passing command inline", "reason", tempFileErr)
-		return environment, strings.Join(envFileContents, "; ") + expandedCommand, func() {}
+// signalProcessGroup sends the signal to all processes in the process group led by the pid.
+func signalProcessGroup(logger hclog.Logger, pid int, signal syscall.Signal) {
+	if err := syscall.Kill(-pid, signal); err != nil && err != syscall.ESRCH {
+		logger.Warn("failed signalling process group", "pgid", pid, "signal", signal, "reason", err)
+	}
+}
 
+// command returns the command executing the RUN command. The exec form, a JSON array, is executed
+// directly, the shell form is passed to the shell. The command does not inherit the vminit environment.
+func (n *shellCommandRunner) command(cmd commands.Run, user *execUser) (*exec.Cmd, error) {
+	environment := n.environment(cmd, user)
+
+	args, isExecForm := execFormArgs(cmd)
+	if !isExecForm {
+		args = append([]string{}, cmd.Shell.Commands...)
+		if len(args) == 0 {
+			args = commands.DefaultShell().Commands
+		}
+		// the shell expands the variables, like in Docker:
+		args = append(args, cmd.Command)
+	}
+	if len(args) == 0 || args[0] == "" {
+		return nil, fmt.Errorf("RUN command has no executable: '%s'", cmd.OriginalCommand)
+	}
+
+	executable, err := lookPath(args[0], environmentValue(environment, "PATH"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "RUN executable '%s' not found", args[0])
+	}
+	return &exec.Cmd{Path: executable, Args: args, Env: environment}, nil
+}
+
+// environment returns the environment of the RUN command, a base environment equivalent to Docker's,
+// PATH, HOME, HOSTNAME and, with a PTY, TERM, overridden by the build arguments, overridden by ENV.
+// Like in Docker, an ARG never overrides an ENV of the same name, ARG and ENV values may refer to the
+// variables set before them.
+func (n *shellCommandRunner) environment(cmd commands.Run, user *execUser) []string {
+	cmdEnv := env.NewBuildEnv()
+	cmdEnv.Put("PATH", defaultRunPath)
+	cmdEnv.Put("HOME", user.Home)
+	if hostname, err := os.Hostname(); err != nil {
+		n.logger.Warn("failed reading hostname, HOSTNAME not set", "reason", err)
 	} else {
+		cmdEnv.Put("HOSTNAME", hostname)
+	}
+	if n.pty != nil {
+		cmdEnv.Put("TERM", defaultPTYTerm)
+	}
+	// the ENV overrides the ARG of the same name:
+	variables := map[string]string{}
+	for k, v := range cmd.Args {
+		variables[k] = v
+	}
+	for k, v := range cmd.Env {
+		variables[k] = v
+	}
+	putEnvironment(cmdEnv, variables)
 
-		deferredFunc := func() {
-			fileNameToCleanup := tempFile.Name()
-			if err := tempFile.Close(); err != nil {
-				logger.Warn("failed closing command temporary file", "reason", err)
-			}
-			if err := os.Remove(fileNameToCleanup); err != nil {
-				logger.Warn("failed removing command temporary file", "reason", err)
+	snapshot := cmdEnv.Snapshot()
+	environment := []string{}
+	for _, k := range sortedKeys(snapshot) {
+		environment = append(environment, k+"="+snapshot[k])
+	}
+	return environment
+}
+
+// environmentReference matches the $name and ${name} references of a value.
+var environmentReference = regexp.MustCompile(`\$(?:\{([^}]*)\}|([A-Za-z0-9_]+))`)
+
+// putEnvironment puts the variables into the build environment, every value is expanded against all the variables:
+// the command carries the variables in a map so their declaration order is not known.
+// The variables referenced by a value are put before it, a reference cycle is left unexpanded.
+func putEnvironment(buildEnv env.BuildEnv, variables map[string]string) {
+	visited := map[string]bool{}
+	var put func(string)
+	put = func(key string) {
+		if visited[key] {
+			return
+		}
+		visited[key] = true
+		for _, match := range environmentReference.FindAllStringSubmatch(variables[key], -1) {
+			for _, name := range match[1:] {
+				if _, ok := variables[name]; ok {
+					put(name)
+				}
 			}
 		}
+		buildEnv.Put(key, variables[key])
+	}
+	for _, key := range sortedKeys(variables) {
+		put(key)
+	}
+}
 
-		// we have the file created but we need it executable:
-		if err := tempFile.Chmod(0777); err != nil {
-			// if we can't make it executable, we have to try executing the command inline:
-			logger.Debug("failed chmoding command file, passing command inline", "reason", err)
-			return environment, strings.Join(envFileContents, "; ") + expandedCommand, deferredFunc
+// execFormArgs returns the arguments of an exec form RUN command, false for a shell form command.
+// A RUN command is in the exec form when the command following the flags is a JSON array of strings.
+func execFormArgs(cmd commands.Run) ([]string, bool) {
+	for _, candidate := range []string{runInstructionArgument(cmd.OriginalCommand), cmd.Command} {
+		candidate = strings.TrimSpace(candidate)
+		if !strings.HasPrefix(candidate, "[") {
+			continue
+		}
+		args := []string{}
+		if err := json.Unmarshal([]byte(candidate), &args); err == nil {
+			return args, true
 		}
+	}
+	return nil, false
+}
 
-		// we preferably want to execute this content separated by new lines:
-		fileContent := strings.Join(append(envFileContents, expandedCommand), "\n")
-		if _, err := tempFile.WriteString(fileContent); err != nil {
-			// but if we couldn't write to the file, we have to try best effort with an inline command:
-			logger.Warn("failed writing temporary environment file, passing command inline", "reason", err)
-			return environment, strings.Join(envFileContents, "; ") + expandedCommand, deferredFunc
-		} else {
-			// we're good, we have written to file so we can use the file as our command:
-			logger.Debug("using executable file command", "script-file", tempFile.Name())
-			return environment, fmt.Sprintf(". %s; ", tempFile.Name()), deferredFunc
+// runInstructionArgument returns the original command without the instruction and its flags.
+func runInstructionArgument(originalCommand string) string {
+	remaining := strings.TrimSpace(originalCommand)
+	if index := strings.IndexAny(remaining, " \t"); index > -1 {
+		remaining = strings.TrimSpace(remaining[index:])
+	} else {
+		return ""
+	}
+	for strings.HasPrefix(remaining, "--") {
+		index := strings.IndexAny(remaining, " \t")
+		if index == -1 {
+			return ""
 		}
+		remaining = strings.TrimSpace(remaining[index:])
+	}
+	return remaining
+}
 
+// lookPath resolves the executable in the PATH of the command, not the PATH of vminit.
+func lookPath(file, path string) (string, error) {
+	if strings.Contains(file, "/") {
+		if err := isExecutable(file); err != nil {
+			return "", err
+		}
+		return file, nil
+	}
+	for _, directory := range filepath.SplitList(path) {
+		if directory == "" {
+			directory = "."
+		}
+		candidate := filepath.Join(directory, file)
+		if isExecutable(candidate) == nil {
+			return candidate, nil
+		}
 	}
+	return "", exec.ErrNotFound
+}
 
+func isExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// environmentValue returns the value of the variable in the KEY=value list.
+func environmentValue(environment []string, key string) string {
+	for _, item := range environment {
+		if strings.HasPrefix(item, key+"=") {
+			return strings.TrimPrefix(item, key+"=")
+		}
+	}
+	return ""
+}
+
+func sortedKeys(input map[string]string) []string {
+	keys := []string{}
+	for k := range input {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
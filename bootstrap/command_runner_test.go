@@ -0,0 +1,192 @@
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/env"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func processRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// the state follows the command name in parentheses, a zombie is not running:
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// assertProcessExits asserts the process exits shortly, the signals are delivered asynchronously.
+func assertProcessExits(t *testing.T, pid int) {
+	assert.Eventually(t, func() bool {
+		return !processRunning(pid)
+	}, time.Second*2, time.Millisecond*10, "process %d still running", pid)
+}
+
+func mustReadPid(t *testing.T, path string) int {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("expected pid file, got error", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal("expected pid, got error", err)
+	}
+	return pid
+}
+
+func TestShellCommandRunnerTimeout(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	runner := newTestShellCommandRunner(t)
+	runner.killGracePeriod = time.Millisecond * 500
+
+	pidFile := filepath.Join(tempDir, "pid")
+
+	// a command ignoring SIGTERM is killed after the grace period, together with its children:
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	started := time.Now()
+	err = runner.Execute(ctx, commands.RunWithDefaults("trap '' TERM; sleep 30 & echo $! > "+pidFile+"; wait"), &recordingClient{})
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.True(t, time.Since(started) < time.Second*5)
+	assertProcessExits(t, mustReadPid(t, pidFile))
+
+	// background processes do not outlive a successful command:
+	client := &recordingClient{}
+	started = time.Now()
+	assert.Nil(t, runner.Execute(context.Background(), commands.RunWithDefaults("sleep 30 & echo $! > "+pidFile+"; echo done"), client))
+	assert.True(t, time.Since(started) < time.Second*5)
+	assertProcessExits(t, mustReadPid(t, pidFile))
+	assert.Equal(t, "done", strings.TrimSpace(strings.Join(client.stdout, "")))
+
+	// a command is not started with the context already done:
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, errors.Is(runner.Execute(ctx, commands.RunWithDefaults("exit 0"), &recordingClient{}), context.Canceled))
+}
+
+func TestShellCommandRunnerStopsWhenOutputFails(t *testing.T) {
+	runner := newTestShellCommandRunner(t)
+	runner.killGracePeriod = time.Millisecond * 500
+	client := &blockingClient{recordingClient: &recordingClient{}, chanRelease: make(chan struct{}), err: errors.New("server gone")}
+	close(client.chanRelease)
+
+	// a command writing forever is stopped, not blocked on a full pipe:
+	err := runner.Execute(context.Background(), commands.RunWithDefaults("while true; do echo output; done"), client)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed sending command output")
+}
+
+func newTestShellCommandRunner(t *testing.T) *shellCommandRunner {
+	runner := &shellCommandRunner{
+		defaultUser:     commands.DefaultUser(),
+		groupFile:       defaultGroupFile,
+		killGracePeriod: defaultKillGracePeriod,
+		logger:          hclog.Default(),
+		passwdFile:      defaultPasswdFile,
+	}
+	if _, err := os.Stat(runner.passwdFile); err != nil {
+		t.Skip("no users database", err)
+	}
+	return runner
+}
+
+func TestShellCommandRunnerEnvironment(t *testing.T) {
+	runner := newTestShellCommandRunner(t)
+
+	os.Setenv("VMINIT_TEST_LEAK", "leaked")
+	defer os.Unsetenv("VMINIT_TEST_LEAK")
+
+	cmd := commands.RunWithDefaults(`printf '%s|' "$QUOTED" "$SPACED" "$OVERRIDDEN" "$DERIVED" "$VMINIT_TEST_LEAK" "$PATH" "$HOME" "$ARCHIVE" "$PREFIX"`)
+	cmd.Args = map[string]string{
+		"OVERRIDDEN": "from arg",
+		"VERSION":    "1.2.3",
+	}
+	cmd.Env = map[string]string{
+		// a value can reference the variables regardless of the order of their names:
+		"ARCHIVE":    "${PREFIX}/app-$VERSION.tar",
+		"DERIVED":    "v${VERSION}",
+		"PREFIX":     "$HOME/opt",
+		"OVERRIDDEN": "from env",
+		"QUOTED":     `say "hi"`,
+		"SPACED":     "a  b",
+	}
+
+	client := &recordingClient{}
+	assert.Nil(t, runner.Execute(context.Background(), cmd, client))
+	assert.Equal(t, []string{`say "hi"|a  b|from env|v1.2.3||` + defaultRunPath + "|/root|/root/opt/app-1.2.3.tar|/root/opt|"}, client.stdout)
+
+	hostname, err := os.Hostname()
+	assert.Nil(t, err)
+	client = &recordingClient{}
+	assert.Nil(t, runner.Execute(context.Background(), commands.RunWithDefaults(`echo "$HOSTNAME"`), client))
+	assert.Equal(t, []string{hostname}, client.stdout)
+}
+
+func TestShellCommandRunnerExecForm(t *testing.T) {
+	runner := newTestShellCommandRunner(t)
+
+	// the exec form is not processed by a shell:
+	cmd := commands.RunWithDefaults(`["printf", "%s|", "$HOME", "a;b"]`)
+	cmd.Command = `printf %s| $HOME a;b`
+	client := &recordingClient{}
+	assert.Nil(t, runner.Execute(context.Background(), cmd, client))
+	assert.Equal(t, []string{"$HOME|a;b|"}, client.stdout)
+
+	cmd = commands.RunWithDefaults(`["does-not-exist"]`)
+	assert.NotNil(t, runner.Execute(context.Background(), cmd, &recordingClient{}))
+}
+
+func TestExecFormArgs(t *testing.T) {
+	for _, testCase := range []struct {
+		original string
+		args     []string
+		isExec   bool
+	}{
+		{original: `RUN ["echo", "hello world"]`, args: []string{"echo", "hello world"}, isExec: true},
+		{original: `RUN --network=none ["echo"]`, args: []string{"echo"}, isExec: true},
+		{original: `RUN echo ["not", "exec"]`},
+		{original: `RUN [ -f /etc/passwd ] && echo found`},
+	} {
+		args, isExec := execFormArgs(commands.Run{OriginalCommand: testCase.original})
+		assert.Equal(t, testCase.isExec, isExec, testCase.original)
+		assert.Equal(t, testCase.args, args, testCase.original)
+	}
+}
+
+func TestPutEnvironment(t *testing.T) {
+	buildEnv := env.NewBuildEnv()
+	buildEnv.Put("PATH", defaultRunPath)
+	putEnvironment(buildEnv, map[string]string{
+		"A":    "$B-a",
+		"B":    "${C}-b",
+		"C":    "c",
+		"PATH": "/opt/bin:$PATH",
+		"X":    "$Y",
+		"Y":    "$X",
+	})
+	snapshot := buildEnv.Snapshot()
+	assert.Equal(t, "c-b-a", snapshot["A"])
+	assert.Equal(t, "c-b", snapshot["B"])
+	assert.Equal(t, "/opt/bin:"+defaultRunPath, snapshot["PATH"])
+	// the cycle is left unexpanded:
+	assert.Equal(t, "$X", snapshot["X"])
+	assert.Equal(t, "$X", snapshot["Y"])
+}
@@ -0,0 +1,7 @@
+// Package bootstrap executes the build commands served by the firebuild rootfs gRPC server or by a local build plan.
+//
+// The rootfs gRPC protocol carries the commands, the resources, the output lines, the ping and the result.
+// The build status the protocol has no message for is sent as StdOut status lines, see StatusLinePrefix.
+// The optional ...Provider and ...Sender interfaces of this package are local extension points:
+// the rootfs gRPC client implements none of them, other clients, like the build plan client, may.
+package bootstrap
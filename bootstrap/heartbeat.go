@@ -0,0 +1,246 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Progress is the build progress sent as a status line with every heartbeat.
+type Progress struct {
+	// CommandIndex is the index of the command being executed, starting at 0.
+	CommandIndex int `json:"CommandIndex"`
+	// BytesTransferred is the number of resource bytes received and output bytes sent.
+	BytesTransferred int64 `json:"BytesTransferred"`
+}
+
+// HeartbeatError is the reason of the build abort when the server does not respond to the heartbeats.
+type HeartbeatError struct {
+	// Failures is the number of consecutive failed heartbeats.
+	Failures int
+	// LastErr is the error of the last failed heartbeat.
+	LastErr error
+}
+
+func (e *HeartbeatError) Error() string {
+	return fmt.Sprintf("heartbeat failed %d consecutive times: %v", e.Failures, e.LastErr)
+}
+
+// buildProgress tracks the progress of the build, safe for concurrent use.
+type buildProgress struct {
+	bytesTransferred int64
+	commandIndex     int64
+}
+
+func (p *buildProgress) addBytes(n int) {
+	atomic.AddInt64(&p.bytesTransferred, int64(n))
+}
+
+func (p *buildProgress) setCommand(index int) {
+	atomic.StoreInt64(&p.commandIndex, int64(index))
+}
+
+func (p *buildProgress) snapshot() Progress {
+	return Progress{
+		BytesTransferred: atomic.LoadInt64(&p.bytesTransferred),
+		CommandIndex:     int(atomic.LoadInt64(&p.commandIndex)),
+	}
+}
+
+// heartbeat pings the server in the configured interval and cancels the build
+// when the number of consecutive failures reaches the threshold.
+type heartbeat struct {
+	client           rootfs.ClientProvider
+	failureThreshold int
+	interval         time.Duration
+	jitter           time.Duration
+	logger           hclog.Logger
+	progress         *buildProgress
+
+	chanStop chan struct{}
+	failure  error
+	m        sync.Mutex
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newHeartbeat(logger hclog.Logger, client rootfs.ClientProvider, progress *buildProgress, bootstrapData *mmds.MMDSBootstrap) *heartbeat {
+	return &heartbeat{
+		client:           client,
+		failureThreshold: bootstrapData.SafePingFailureThreshold(),
+		interval:         bootstrapData.SafePingInterval(),
+		jitter:           bootstrapData.SafePingJitter(),
+		logger:           logger,
+		progress:         progress,
+		chanStop:         make(chan struct{}),
+	}
+}
+
+// start starts the heartbeat, cancel is called when the heartbeat fails.
+func (h *heartbeat) start(cancel context.CancelFunc) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		failures := 0
+		timer := time.NewTimer(h.nextInterval())
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				progress := h.progress.snapshot()
+				h.logger.Debug("pinging server", "command-index", progress.CommandIndex, "bytes-transferred", progress.BytesTransferred)
+				if err := h.ping(progress); err != nil {
+					failures = failures + 1
+					h.logger.Warn("ping returned an error", "consecutive-failures", failures, "failure-threshold", h.failureThreshold, "reason", err)
+					if failures >= h.failureThreshold {
+						h.m.Lock()
+						h.failure = &HeartbeatError{Failures: failures, LastErr: err}
+						h.m.Unlock()
+						h.logger.Error("heartbeat failed, aborting build", "reason", err)
+						cancel()
+						return
+					}
+				} else {
+					failures = 0
+				}
+				timer.Reset(h.nextInterval())
+			case <-h.chanStop:
+				h.logger.Debug("ping stopped, program finished")
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the heartbeat and waits for it to finish, safe to call more than once.
+func (h *heartbeat) stop() {
+	h.stopOnce.Do(func() {
+		close(h.chanStop)
+	})
+	h.wg.Wait()
+}
+
+// err returns the HeartbeatError if the heartbeat failed.
+func (h *heartbeat) err() error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.failure
+}
+
+func (h *heartbeat) nextInterval() time.Duration {
+	if h.jitter <= 0 {
+		return h.interval
+	}
+	return h.interval + time.Duration(rand.Int63n(int64(h.jitter)))
+}
+
+// ping pings the server and sends the progress, the ping has no payload.
+func (h *heartbeat) ping(progress Progress) error {
+	if err := h.client.Ping(); err != nil {
+		return err
+	}
+	return sendStatus(h.client, StatusKindProgress, progress)
+}
+
+// progressClient is a client provider counting the bytes transferred with the server
+// and recording the resources received for the current command.
+type progressClient struct {
+	rootfs.ClientProvider
+	progress *buildProgress
+
+	m         sync.Mutex
+	resources []string
+}
+
+func (c *progressClient) unwrap() rootfs.ClientProvider {
+	return c.ClientProvider
+}
+
+// takeResources returns the target paths of the resources received since the last call.
+func (c *progressClient) takeResources() []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	resources := c.resources
+	c.resources = nil
+	return resources
+}
+
+func (c *progressClient) Resource(path string) (chan interface{}, error) {
+	input, err := c.ClientProvider.Resource(path)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan interface{})
+	go func() {
+		// the client closes the channel or sends nil when finished:
+		defer close(output)
+		for item := range input {
+			if item == nil {
+				return
+			}
+			if resource, ok := item.(resources.ResolvedResource); ok {
+				c.m.Lock()
+				c.resources = append(c.resources, resource.TargetPath())
+				c.m.Unlock()
+				item = &progressResource{ResolvedResource: resource, progress: c.progress}
+			}
+			output <- item
+		}
+	}()
+	return output, nil
+}
+
+func (c *progressClient) StdErr(lines []string) error {
+	c.addLines(lines)
+	return c.ClientProvider.StdErr(lines)
+}
+
+func (c *progressClient) StdOut(lines []string) error {
+	c.addLines(lines)
+	return c.ClientProvider.StdOut(lines)
+}
+
+func (c *progressClient) addLines(lines []string) {
+	for _, line := range lines {
+		c.progress.addBytes(len(line))
+	}
+}
+
+// progressResource counts the bytes read from the resource contents.
+type progressResource struct {
+	resources.ResolvedResource
+	progress *buildProgress
+}
+
+func (r *progressResource) Contents() (io.ReadCloser, error) {
+	reader, err := r.ResolvedResource.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{ReadCloser: reader, progress: r.progress}, nil
+}
+
+// Metadata passes the metadata of the wrapped resource through.
+func (r *progressResource) Metadata() *ResourceMetadata {
+	return resourceMetadata(r.ResolvedResource)
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress *buildProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.progress.addBytes(n)
+	return n, err
+}
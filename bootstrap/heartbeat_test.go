@@ -0,0 +1,151 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// pingingClient fails the pings while failing is set and counts them.
+type pingingClient struct {
+	*recordingClient
+	m       sync.Mutex
+	failing bool
+	pings   int
+}
+
+func (c *pingingClient) Ping() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.pings = c.pings + 1
+	if c.failing {
+		return errors.New("server gone")
+	}
+	return nil
+}
+
+func (c *pingingClient) setFailing(failing bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.failing = failing
+}
+
+func (c *pingingClient) pinged() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.pings
+}
+
+// received returns the progress of the status lines.
+func (c *pingingClient) received(t *testing.T) []Progress {
+	received := []*Progress{}
+	assert.Nil(t, c.statuses(StatusKindProgress, func() interface{} {
+		received = append(received, &Progress{})
+		return received[len(received)-1]
+	}))
+	progress := []Progress{}
+	for _, item := range received {
+		progress = append(progress, *item)
+	}
+	return progress
+}
+
+func TestHeartbeatFailureCancelsBuild(t *testing.T) {
+	client := &pingingClient{recordingClient: &recordingClient{}, failing: true}
+	beat := newHeartbeat(hclog.Default(), client, &buildProgress{}, &mmds.MMDSBootstrap{
+		PingFailureThreshold: "3",
+		PingInterval:         "10ms",
+		PingJitter:           "5ms",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	beat.start(cancel)
+	defer beat.stop()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the heartbeat to cancel the build")
+	}
+
+	heartbeatErr, ok := beat.err().(*HeartbeatError)
+	assert.True(t, ok)
+	assert.Equal(t, 3, heartbeatErr.Failures)
+	assert.Equal(t, 3, client.pinged())
+	assert.Empty(t, client.received(t))
+}
+
+func TestHeartbeatCarriesProgress(t *testing.T) {
+	client := &pingingClient{recordingClient: &recordingClient{}}
+	progress := &buildProgress{}
+	progress.setCommand(2)
+	progress.addBytes(1024)
+
+	beat := newHeartbeat(hclog.Default(), client, progress, &mmds.MMDSBootstrap{
+		PingFailureThreshold: "5",
+		PingInterval:         "10ms",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	beat.start(cancel)
+
+	// failures below the threshold do not cancel the build:
+	client.setFailing(true)
+	time.Sleep(time.Millisecond * 15)
+	client.setFailing(false)
+	time.Sleep(time.Millisecond * 50)
+	beat.stop()
+
+	assert.Nil(t, ctx.Err())
+	assert.Nil(t, beat.err())
+	received := client.received(t)
+	assert.True(t, len(received) > 1)
+	assert.True(t, client.pinged() > len(received))
+	assert.Equal(t, Progress{CommandIndex: 2, BytesTransferred: 1024}, received[len(received)-1])
+}
+
+func TestProgressClientCountsBytes(t *testing.T) {
+	workdir := commands.DefaultWorkdir()
+	resource := &metadataResource{
+		ResolvedResource: resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("0123456789")), nil
+		}, fs.FileMode(0644), "data", "/data", workdir, commands.DefaultUser()),
+		metadata: &ResourceMetadata{SymlinkTarget: "/target"},
+	}
+	progress := &buildProgress{}
+	client := &progressClient{
+		ClientProvider: &recordingClient{
+			resources: map[string][]resources.ResolvedResource{"data": {resource}},
+		},
+		progress: progress,
+	}
+
+	chanResources, err := client.Resource("data")
+	assert.Nil(t, err)
+	item := <-chanResources
+	wrapped, ok := item.(resources.ResolvedResource)
+	assert.True(t, ok)
+	// the metadata passes through:
+	assert.Equal(t, "/target", resourceMetadata(wrapped).SymlinkTarget)
+	reader, err := wrapped.Contents()
+	assert.Nil(t, err)
+	ioutil.ReadAll(reader)
+	assert.Nil(t, <-chanResources)
+
+	assert.Nil(t, client.StdOut([]string{"hello"}))
+	assert.Equal(t, Progress{BytesTransferred: 15}, progress.snapshot())
+}
@@ -0,0 +1,54 @@
+package bootstrap
+
+import (
+	"os"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/pkg/errors"
+)
+
+// ImageConfigProvider is implemented by clients able to serve the final image config.
+type ImageConfigProvider interface {
+	// ImageConfig returns the image config, nil when there is none.
+	ImageConfig() (*mmds.MMDSImageConfig, error)
+}
+
+// imageConfig returns the final image config served by the client, nil when the client serves none.
+// The commands carry only a part of the config so it is never derived from them.
+func imageConfig(client rootfs.ClientProvider) (*mmds.MMDSImageConfig, error) {
+	provider, ok := client.(ImageConfigProvider)
+	if !ok {
+		return nil, nil
+	}
+	config, err := provider.ImageConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed fetching image config")
+	}
+	return config, nil
+}
+
+// imageConfigFile is the file in the rootfs the final image config is written to, nothing is written without a path.
+type imageConfigFile struct {
+	path string
+}
+
+// save writes the image config atomically.
+func (f *imageConfigFile) save(config *mmds.MMDSImageConfig) error {
+	if f.path == "" {
+		return nil
+	}
+	return errors.Wrap(fsutil.WriteJSONAtomically(f.path, config, 0644, 0755), "failed writing image config")
+}
+
+// remove removes the image config of a previous build.
+func (f *imageConfigFile) remove() error {
+	if f.path == "" {
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed removing image config")
+	}
+	return nil
+}
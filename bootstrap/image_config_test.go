@@ -0,0 +1,78 @@
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// imageConfigClient serves the image config.
+type imageConfigClient struct {
+	*recordingClient
+	config *mmds.MMDSImageConfig
+}
+
+func (c *imageConfigClient) ImageConfig() (*mmds.MMDSImageConfig, error) {
+	return c.config, nil
+}
+
+func mustReadImageConfig(t *testing.T, path string) *mmds.MMDSImageConfig {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("expected image config, got error", err)
+	}
+	config, err := mmds.NewMMDSImageConfigFromJSON(string(configBytes))
+	if err != nil {
+		t.Fatal("expected image config to parse, got error", err)
+	}
+	return config
+}
+
+func TestBootstrapWritesImageConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	configPath := filepath.Join(tempDir, "etc/firebuild/image-config.json")
+	newBootstrapper := func() *defaultBootstrapper {
+		return NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{}).
+			WithCommandRunner(&failingCommandRunner{}).
+			WithImageConfigFile(configPath).(*defaultBootstrapper)
+	}
+
+	// the config served by the server is written as it is:
+	served := &mmds.MMDSImageConfig{
+		MMDSRootfsEntrypointInfo: mmds.MMDSRootfsEntrypointInfo{
+			Cmd:        []string{"--help"},
+			Entrypoint: []string{"/usr/bin/start.sh"},
+			Workdir:    "/",
+		},
+		ExposedPorts: []string{"2379/tcp"},
+		Labels:       map[string]string{"maintainer": "firebuild"},
+		StopSignal:   "SIGQUIT",
+		Volumes:      []string{"/data"},
+	}
+	assert.Nil(t, newBootstrapper().execute(context.Background(), &imageConfigClient{
+		recordingClient: &recordingClient{commands: testCommands("one")},
+		config:          served,
+	}))
+	assert.Equal(t, served, mustReadImageConfig(t, configPath))
+
+	// without the config from the server, no partial config is written and the stale config is removed:
+	assert.Nil(t, newBootstrapper().execute(context.Background(), &recordingClient{commands: testCommands("one")}))
+	_, err = os.Stat(configPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, newBootstrapper().execute(context.Background(), &imageConfigClient{
+		recordingClient: &recordingClient{commands: testCommands("one")},
+	}))
+	_, err = os.Stat(configPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,263 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// ManifestEntry is a path created, modified or deleted by a step.
+type ManifestEntry struct {
+	Path string `json:"Path"`
+	// Mode is the mode of the path, the mode before the step for a deleted path.
+	Mode string `json:"Mode"`
+	Size int64  `json:"Size"`
+	// SHA256 is the hash of the contents of a created or modified regular file.
+	SHA256 string `json:"SHA256,omitempty"`
+	// LinkTarget is the target of a created or modified symbolic link.
+	LinkTarget string `json:"LinkTarget,omitempty"`
+}
+
+// StepManifest lists the paths changed by a single step in the scanned directories.
+type StepManifest struct {
+	Index    int              `json:"Index"`
+	Command  string           `json:"Command"`
+	Created  []*ManifestEntry `json:"Created"`
+	Modified []*ManifestEntry `json:"Modified"`
+	Deleted  []*ManifestEntry `json:"Deleted"`
+}
+
+// manifestStatusEntries is the maximum number of entries of a manifest status line,
+// the manifest of a step with more entries is sent in several lines of the same Index.
+const manifestStatusEntries = 500
+
+// sendManifest sends the manifest to the server as manifest status lines.
+func sendManifest(client rootfs.ClientProvider, manifest *StepManifest) error {
+	for _, part := range splitManifest(manifest, manifestStatusEntries) {
+		if err := sendStatus(client, StatusKindManifest, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitManifest splits the manifest into the manifests of at most maxEntries entries each.
+func splitManifest(manifest *StepManifest, maxEntries int) []*StepManifest {
+	if len(manifest.Created)+len(manifest.Modified)+len(manifest.Deleted) <= maxEntries {
+		return []*StepManifest{manifest}
+	}
+	parts := []*StepManifest{}
+	var part *StepManifest
+	nEntries := 0
+	for list, entries := range [][]*ManifestEntry{manifest.Created, manifest.Modified, manifest.Deleted} {
+		for _, entry := range entries {
+			if part == nil || nEntries == maxEntries {
+				part = &StepManifest{Index: manifest.Index, Command: manifest.Command, Created: []*ManifestEntry{}, Modified: []*ManifestEntry{}, Deleted: []*ManifestEntry{}}
+				parts = append(parts, part)
+				nEntries = 0
+			}
+			switch list {
+			case 0:
+				part.Created = append(part.Created, entry)
+			case 1:
+				part.Modified = append(part.Modified, entry)
+			default:
+				part.Deleted = append(part.Deleted, entry)
+			}
+			nEntries = nEntries + 1
+		}
+	}
+	return parts
+}
+
+// pathState is the state of a path used to tell if the path was modified.
+type pathState struct {
+	linkTarget string
+	mode       fs.FileMode
+	modTime    int64
+	size       int64
+}
+
+// filesystemSnapshot is the state of all paths in the scanned directories.
+type filesystemSnapshot map[string]*pathState
+
+// manifestScanner scans the configured directories before and after every step.
+// The directories are not scanned beyond their file system, mounts inside of them are skipped.
+type manifestScanner struct {
+	logger hclog.Logger
+	paths  []string
+
+	previous filesystemSnapshot
+}
+
+// newManifestScanner returns a scanner of the clean absolute paths, paths inside of other paths are scanned once.
+func newManifestScanner(logger hclog.Logger, paths []string) *manifestScanner {
+	scanned := []string{}
+	for _, path := range paths {
+		nested := false
+		for _, other := range paths {
+			if other != path && isBeneath(other, path) {
+				nested = true
+				break
+			}
+		}
+		if !nested && !containsString(scanned, path) {
+			scanned = append(scanned, path)
+		}
+	}
+	return &manifestScanner{logger: logger, paths: scanned}
+}
+
+// start takes the snapshot the first step is compared to.
+func (s *manifestScanner) start() error {
+	snapshot, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	s.previous = snapshot
+	return nil
+}
+
+// step returns the changes since the previous step, only the created and modified regular files are hashed.
+func (s *manifestScanner) step(index int, command string) (*StepManifest, error) {
+	current, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	manifest := &StepManifest{
+		Index:    index,
+		Command:  command,
+		Created:  []*ManifestEntry{},
+		Modified: []*ManifestEntry{},
+		Deleted:  []*ManifestEntry{},
+	}
+	for _, path := range sortedPaths(current) {
+		state := current[path]
+		previousState, existed := s.previous[path]
+		if existed && *previousState == *state {
+			continue
+		}
+		entry, err := s.entry(path, state)
+		if err != nil {
+			return nil, err
+		}
+		if existed {
+			manifest.Modified = append(manifest.Modified, entry)
+		} else {
+			manifest.Created = append(manifest.Created, entry)
+		}
+	}
+	for _, path := range sortedPaths(s.previous) {
+		if _, exists := current[path]; !exists {
+			state := s.previous[path]
+			manifest.Deleted = append(manifest.Deleted, &ManifestEntry{Path: path, Mode: state.mode.String(), Size: state.size})
+		}
+	}
+	s.previous = current
+	return manifest, nil
+}
+
+func (s *manifestScanner) entry(path string, state *pathState) (*ManifestEntry, error) {
+	entry := &ManifestEntry{Path: path, Mode: state.mode.String(), Size: state.size, LinkTarget: state.linkTarget}
+	if state.mode.IsRegular() {
+		hash, err := fileSHA256(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed by a background process after the scan, reported as of the scan:
+				return entry, nil
+			}
+			return nil, errors.Wrapf(err, "failed hashing '%s'", path)
+		}
+		entry.SHA256 = hash
+	}
+	return entry, nil
+}
+
+func (s *manifestScanner) snapshot() (filesystemSnapshot, error) {
+	snapshot := filesystemSnapshot{}
+	for _, root := range s.paths {
+		rootInfo, err := os.Lstat(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // may be created by a later step
+			}
+			return nil, errors.Wrapf(err, "failed scanning '%s'", root)
+		}
+		rootDevice := deviceOf(rootInfo)
+		if err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil // removed while scanning
+				}
+				return err
+			}
+			if info.IsDir() && path != root && deviceOf(info) != rootDevice {
+				s.logger.Trace("skipping mount point", "path", path)
+				return filepath.SkipDir
+			}
+			state := &pathState{mode: info.Mode()}
+			if !info.IsDir() {
+				// a directory changes with its contents, those are listed on their own:
+				state.modTime = info.ModTime().UnixNano()
+				state.size = info.Size()
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if state.linkTarget, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			snapshot[path] = state
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "failed scanning '%s'", root)
+		}
+	}
+	return snapshot, nil
+}
+
+func deviceOf(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func sortedPaths(snapshot filesystemSnapshot) []string {
+	paths := []string{}
+	for path := range snapshot {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// writingCommandRunner writes the file named by the command.
+type writingCommandRunner struct{}
+
+func (r *writingCommandRunner) Execute(ctx context.Context, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	return ioutil.WriteFile(cmd.Command, []byte(cmd.Command), 0644)
+}
+
+// sentManifests returns the manifests of the status lines.
+func sentManifests(t *testing.T, client *recordingClient) []*StepManifest {
+	manifests := []*StepManifest{}
+	assert.Nil(t, client.statuses(StatusKindManifest, func() interface{} {
+		manifests = append(manifests, &StepManifest{})
+		return manifests[len(manifests)-1]
+	}))
+	return manifests
+}
+
+func manifestPaths(entries []*ManifestEntry) []string {
+	paths := []string{}
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+func TestManifestScannerListsChanges(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mustWrite := func(path, content string) {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, path), []byte(content), 0644); err != nil {
+			t.Fatal("expected file to be written, got error", err)
+		}
+	}
+	mustWrite("unchanged", "unchanged")
+	mustWrite("modified", "before")
+	mustWrite("deleted", "deleted")
+	mustWrite("chmoded", "chmoded")
+
+	// nested paths are scanned once:
+	scanner := newManifestScanner(hclog.Default(), []string{tempDir, filepath.Join(tempDir, "nested"), tempDir})
+	assert.Equal(t, []string{tempDir}, scanner.paths)
+	assert.Nil(t, scanner.start())
+
+	mustWrite("modified", "after, longer")
+	assert.Nil(t, os.Remove(filepath.Join(tempDir, "deleted")))
+	assert.Nil(t, os.Chmod(filepath.Join(tempDir, "chmoded"), 0600))
+	assert.Nil(t, os.Mkdir(filepath.Join(tempDir, "created"), 0755))
+	mustWrite("created/file", "created")
+	assert.Nil(t, os.Symlink("file", filepath.Join(tempDir, "created/link")))
+
+	manifest, err := scanner.step(0, "RUN change")
+	assert.Nil(t, err)
+	assert.Equal(t, "RUN change", manifest.Command)
+	assert.Equal(t, []string{
+		filepath.Join(tempDir, "created"),
+		filepath.Join(tempDir, "created/file"),
+		filepath.Join(tempDir, "created/link"),
+	}, manifestPaths(manifest.Created))
+	assert.Equal(t, []string{
+		filepath.Join(tempDir, "chmoded"),
+		filepath.Join(tempDir, "modified"),
+	}, manifestPaths(manifest.Modified))
+	assert.Equal(t, []string{filepath.Join(tempDir, "deleted")}, manifestPaths(manifest.Deleted))
+
+	created := manifest.Created[1]
+	assert.Equal(t, "-rw-r--r--", created.Mode)
+	assert.Equal(t, int64(7), created.Size)
+	// sha256 of "created":
+	assert.Equal(t, "406effb1e9c59672c66a598c2b21e331b23b16c54024e96d6df3e7c173549791", created.SHA256)
+	assert.Equal(t, "file", manifest.Created[2].LinkTarget)
+	assert.Equal(t, "-rw-------", manifest.Modified[0].Mode)
+	assert.Empty(t, manifest.Deleted[0].SHA256)
+
+	// the next step is compared to the previous one:
+	manifest, err = scanner.step(1, "RUN nothing")
+	assert.Nil(t, err)
+	assert.Empty(t, manifest.Created)
+	assert.Empty(t, manifest.Modified)
+	assert.Empty(t, manifest.Deleted)
+}
+
+func TestBootstrapWritesBuildReport(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	scannedDirectory := filepath.Join(tempDir, "scanned")
+	assert.Nil(t, os.Mkdir(scannedDirectory, 0755))
+	reportPath := filepath.Join(tempDir, "bootstrap/report.json")
+	newBootstrapper := func(runner CommandRunner) *defaultBootstrapper {
+		return NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{ManifestPaths: scannedDirectory + ", relative"}).
+			WithCommandRunner(runner).
+			WithBuildReportFile(reportPath).(*defaultBootstrapper)
+	}
+	readReport := func() *BuildReport {
+		reportBytes, err := ioutil.ReadFile(reportPath)
+		if err != nil {
+			t.Fatal("expected build report, got error", err)
+		}
+		report := &BuildReport{}
+		if err := json.Unmarshal(reportBytes, report); err != nil {
+			t.Fatal("expected build report to parse, got error", err)
+		}
+		return report
+	}
+
+	client := &recordingClient{
+		commands: testCommands(filepath.Join(scannedDirectory, "one"), filepath.Join(scannedDirectory, "two")),
+	}
+	assert.Nil(t, newBootstrapper(&writingCommandRunner{}).execute(context.Background(), client))
+
+	report := readReport()
+	assert.Equal(t, BuildStatusSucceeded, report.Status)
+	assert.Equal(t, []string{scannedDirectory}, report.ManifestPaths)
+	assert.Equal(t, 2, len(report.Steps))
+	assert.Equal(t, []string{filepath.Join(scannedDirectory, "two")}, manifestPaths(report.Steps[1].Created))
+	assert.Equal(t, report.Steps, sentManifests(t, client))
+
+	// a failed build is reported too:
+	assert.NotNil(t, newBootstrapper(&failingCommandRunner{failOn: "one"}).
+		execute(context.Background(), &recordingClient{commands: testCommands("one")}))
+	report = readReport()
+	assert.Equal(t, BuildStatusFailed, report.Status)
+	assert.Equal(t, "failed on purpose", report.Error)
+	assert.Empty(t, report.Steps)
+}
+
+func TestSplitManifest(t *testing.T) {
+	entries := func(paths ...string) []*ManifestEntry {
+		output := []*ManifestEntry{}
+		for _, path := range paths {
+			output = append(output, &ManifestEntry{Path: path})
+		}
+		return output
+	}
+	manifest := &StepManifest{Index: 1, Command: "RUN make", Created: entries("a", "b", "c"), Modified: entries("d"), Deleted: entries("e")}
+	assert.Equal(t, []*StepManifest{manifest}, splitManifest(manifest, 5))
+
+	parts := splitManifest(manifest, 2)
+	assert.Equal(t, 3, len(parts))
+	assert.Equal(t, []string{"a", "b"}, manifestPaths(parts[0].Created))
+	assert.Equal(t, []string{"c"}, manifestPaths(parts[1].Created))
+	assert.Equal(t, []string{"d"}, manifestPaths(parts[1].Modified))
+	assert.Equal(t, []string{"e"}, manifestPaths(parts[2].Deleted))
+	for _, part := range parts {
+		assert.Equal(t, 1, part.Index)
+		assert.Equal(t, "RUN make", part.Command)
+	}
+}
+
+func TestBootstrapSendsManifestsToServer(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logger := hclog.Default()
+	createdPath := filepath.Join(tempDir, "created")
+	testServer, bootstrapConfig := startTestServer(t, logger, &rootfs.WorkContext{
+		ExecutableCommands: []commands.VMInitSerializableCommand{commands.RunWithDefaults("echo hello && touch " + createdPath)},
+	})
+	bootstrapConfig.ManifestPaths = tempDir
+
+	bootstrapper := NewDefaultBoostrapper(logger.Named("bootstrapper"), bootstrapConfig).
+		WithCommandRunner(NewShellCommandRunner(logger.Named("shell-runner")))
+	assert.Nil(t, bootstrapper.Execute())
+	<-testServer.FinishedNotify()
+
+	output := []string{}
+	manifests := []*StepManifest{}
+	for _, line := range testServer.ReceivedStdout() {
+		kind, status, ok := ParseStatusLine(line)
+		if !ok {
+			output = append(output, line)
+			continue
+		}
+		if kind == StatusKindManifest {
+			manifest := &StepManifest{}
+			assert.Nil(t, json.Unmarshal(status, manifest))
+			manifests = append(manifests, manifest)
+		}
+	}
+	assert.Equal(t, []string{"hello"}, output)
+	assert.Equal(t, 1, len(manifests))
+	assert.Equal(t, []string{createdPath}, manifestPaths(manifests[0].Created))
+}
@@ -0,0 +1,74 @@
+package bootstrap
+
+import (
+	"sort"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ResourceMetadata is the file system metadata of a resource beyond its contents and mode.
+type ResourceMetadata struct {
+	// HardlinkTarget is the source path of another resource of the same ADD or COPY command
+	// this resource is a hardlink to. The other resource is always sent first.
+	HardlinkTarget string
+	// ModTime is the modification time, the zero value leaves the time of the deployment.
+	ModTime time.Time
+	// SymlinkTarget is set when the resource is a symlink, the target is written as it is.
+	SymlinkTarget string
+	// Xattrs are the extended attributes, for example security.capability.
+	Xattrs map[string][]byte
+}
+
+// ResourceMetadataProvider is implemented by resolved resources describing their file system metadata.
+// Only the build plan resources implement it, the resources of the rootfs server carry the contents and the mode only.
+type ResourceMetadataProvider interface {
+	Metadata() *ResourceMetadata
+}
+
+// resourceMetadata returns the metadata of the resource, nil if the resource does not provide any.
+func resourceMetadata(titem resources.ResolvedResource) *ResourceMetadata {
+	if provider, ok := titem.(ResourceMetadataProvider); ok {
+		return provider.Metadata()
+	}
+	return nil
+}
+
+// applyMetadata sets the extended attributes and the modification time of the metadata on the path.
+// Directory times change when the directory content changes so they have to be set again once everything is written.
+func applyMetadata(path string, metadata *ResourceMetadata) error {
+	if metadata == nil {
+		return nil
+	}
+	if err := setXattrs(path, metadata.Xattrs); err != nil {
+		return err
+	}
+	if metadata.ModTime.IsZero() {
+		return nil
+	}
+	return errors.Wrap(setModTime(path, metadata.ModTime), "failed setting modification time")
+}
+
+// setXattrs sets the extended attributes on the path without following a symlink.
+// Must be called after changing the ownership, chown clears security.capability.
+func setXattrs(path string, xattrs map[string][]byte) error {
+	names := []string{}
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := unix.Lsetxattr(path, name, xattrs[name], 0); err != nil {
+			return errors.Wrapf(err, "failed setting extended attribute '%s'", name)
+		}
+	}
+	return nil
+}
+
+// setModTime sets the access and modification times of the path without following a symlink.
+func setModTime(path string, modTime time.Time) error {
+	timespec := unix.NsecToTimespec(modTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{timespec, timespec}, unix.AT_SYMLINK_NOFOLLOW)
+}
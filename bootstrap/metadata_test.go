@@ -0,0 +1,149 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+type metadataResource struct {
+	resources.ResolvedResource
+	metadata *ResourceMetadata
+}
+
+func (r *metadataResource) Metadata() *ResourceMetadata {
+	return r.metadata
+}
+
+func mustSupportXattrs(t *testing.T, dir string) {
+	if err := unix.Lsetxattr(dir, "user.firebuild-test", []byte("1"), 0); err != nil {
+		t.Skip("extended attributes not supported in", dir, err)
+	}
+}
+
+func mustGetXattr(t *testing.T, path, name string) string {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		t.Fatal("expected extended attribute", name, "of", path, "got error", err)
+	}
+	return string(buf[0:n])
+}
+
+func TestDeployerPreservesMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mustSupportXattrs(t, tempDir)
+
+	workdir := commands.DefaultWorkdir()
+	deployer := newTestResourceDeployer(hclog.Default(), tempDir)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	withMetadata := func(resource resources.ResolvedResource, metadata *ResourceMetadata) resources.ResolvedResource {
+		return &metadataResource{ResolvedResource: resource, metadata: metadata}
+	}
+	fileResource := func(source, target, content string) resources.ResolvedResource {
+		return resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		}, fs.FileMode(0644), source, target, workdir, commands.DefaultUser())
+	}
+
+	assert.Nil(t, deployer.Copy(commands.Copy{
+		OriginalCommand: "COPY app /opt/app",
+		OriginalSource:  "app",
+		Source:          "app",
+		Target:          "/opt/app",
+		User:            commands.DefaultUser(),
+		Workdir:         workdir,
+	}, &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"app": {
+				withMetadata(resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755), "app", "app", "/opt/app", workdir, commands.DefaultUser()),
+					&ResourceMetadata{ModTime: modTime}),
+				withMetadata(fileResource("app/bin", "/opt/app/bin", "binary"),
+					&ResourceMetadata{ModTime: modTime, Xattrs: map[string][]byte{"user.origin": []byte("build")}}),
+				withMetadata(fileResource("app/bin-link", "/opt/app/bin-link", ""),
+					&ResourceMetadata{HardlinkTarget: "app/bin"}),
+				withMetadata(fileResource("app/current", "/opt/app/current", ""),
+					&ResourceMetadata{ModTime: modTime, SymlinkTarget: "/opt/app/bin"}),
+			},
+		},
+	}))
+
+	appDir := filepath.Join(tempDir, "opt/app")
+	binInfo, err := os.Stat(filepath.Join(appDir, "bin"))
+	assert.Nil(t, err)
+	assert.True(t, modTime.Equal(binInfo.ModTime()))
+	assert.Equal(t, "build", mustGetXattr(t, filepath.Join(appDir, "bin"), "user.origin"))
+
+	linkInfo, err := os.Stat(filepath.Join(appDir, "bin-link"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(binInfo, linkInfo))
+
+	target, err := os.Readlink(filepath.Join(appDir, "current"))
+	assert.Nil(t, err)
+	assert.Equal(t, "/opt/app/bin", target)
+	symlinkInfo, err := os.Lstat(filepath.Join(appDir, "current"))
+	assert.Nil(t, err)
+	assert.True(t, modTime.Equal(symlinkInfo.ModTime()))
+
+	// directory times are set after the content is written:
+	dirInfo, err := os.Stat(appDir)
+	assert.Nil(t, err)
+	assert.True(t, modTime.Equal(dirInfo.ModTime()))
+
+	// a hardlink to a resource which was not deployed fails:
+	assert.NotNil(t, deployer.Copy(commands.Copy{
+		OriginalCommand: "COPY orphan /opt/orphan",
+		OriginalSource:  "orphan",
+		Source:          "orphan",
+		Target:          "/opt/orphan",
+		User:            commands.DefaultUser(),
+		Workdir:         workdir,
+	}, &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"orphan": {
+				withMetadata(fileResource("orphan", "/opt/orphan", ""), &ResourceMetadata{HardlinkTarget: "missing"}),
+			},
+		},
+	}))
+}
+
+func TestExtractArchivePreservesMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mustSupportXattrs(t, tempDir)
+
+	archive := mustBuildTestArchive(t, []testArchiveEntry{
+		{header: &tar.Header{Name: "bin", Typeflag: tar.TypeReg, Mode: 0755, PAXRecords: map[string]string{
+			paxXattrPrefix + "user.origin": "archive",
+		}}, content: "binary"},
+		{header: &tar.Header{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "bin", Mode: 0777}},
+	})
+
+	cmd, client := addTestResource(t, "app.tar", "/opt/", archive)
+	assert.Nil(t, newTestResourceDeployer(hclog.Default(), tempDir).Add(cmd, client))
+
+	assert.Equal(t, "archive", mustGetXattr(t, filepath.Join(tempDir, "opt/bin"), "user.origin"))
+	symlinkInfo, err := os.Lstat(filepath.Join(tempDir, "opt/current"))
+	assert.Nil(t, err)
+	assert.True(t, testArchiveModTime.Equal(symlinkInfo.ModTime()))
+}
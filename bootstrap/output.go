@@ -0,0 +1,307 @@
+package bootstrap
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Output streams.
+const (
+	OutputStreamStderr = "stderr"
+	OutputStreamStdout = "stdout"
+)
+
+const (
+	// defaultOutputBatchBytes is the size of the output sent to the server in a single call.
+	defaultOutputBatchBytes = 32 * 1024
+	// defaultOutputFlushInterval is the longest time the output waits before being sent to the server.
+	defaultOutputFlushInterval = time.Millisecond * 100
+	// defaultOutputMaxLineBytes is the length above which a line without the line break is sent as it is.
+	defaultOutputMaxLineBytes = 16 * 1024
+	// defaultOutputQueueLines is the number of lines waiting for the server before the command output blocks.
+	defaultOutputQueueLines = 1024
+)
+
+// OutputLine is a single line of the command output.
+type OutputLine struct {
+	// Sequence orders the lines of all streams of a command, starting at 1.
+	Sequence uint64
+	// Stream is one of the OutputStream... streams.
+	Stream string
+	// Text is the line without the line break.
+	Text string
+	// Timestamp is the time the line was read from the command.
+	Timestamp time.Time
+}
+
+// OutputLineSender is implemented by clients able to carry the stream, the sequence and the timestamp of the output lines.
+// Without it, the consecutive lines of the same stream are sent to StdOut or StdErr together, in the order they were read.
+type OutputLineSender interface {
+	OutputLines([]OutputLine) error
+}
+
+// outputStreamer splits the command output into lines and sends them to the server in batches.
+// The batch is sent when it reaches the batch size or when the flush interval passes.
+// The writers block while the queue is full so a slow server slows the command down.
+type outputStreamer struct {
+	batchBytes    int
+	client        rootfs.ClientProvider
+	flushInterval time.Duration
+	logger        hclog.Logger
+	maxLineBytes  int
+	onFailure     func()
+	redactions    []string
+
+	chanLines chan OutputLine
+	chanDone  chan struct{}
+	failure   error
+	failureM  sync.Mutex
+	// m guards the partial lines, the unredacted output and the sequence,
+	// the lines are queued with m held so they are queued in the sequence order:
+	m          sync.Mutex
+	partial    map[string]*bytes.Buffer
+	sequence   uint64
+	unredacted map[string][]byte
+}
+
+func newOutputStreamer(logger hclog.Logger, client rootfs.ClientProvider) *outputStreamer {
+	return &outputStreamer{
+		batchBytes:    defaultOutputBatchBytes,
+		client:        client,
+		flushInterval: defaultOutputFlushInterval,
+		logger:        logger,
+		maxLineBytes:  defaultOutputMaxLineBytes,
+		chanLines:     make(chan OutputLine, defaultOutputQueueLines),
+		chanDone:      make(chan struct{}),
+		partial:       map[string]*bytes.Buffer{},
+		unredacted:    map[string][]byte{},
+	}
+}
+
+// redacting replaces the values with a redaction in the output, must be called before start.
+func (s *outputStreamer) redacting(values []string) *outputStreamer {
+	s.redactions = append([]string{}, values...)
+	// the longest values first, a value may contain another:
+	sort.SliceStable(s.redactions, func(i, j int) bool {
+		return len(s.redactions[i]) > len(s.redactions[j])
+	})
+	return s
+}
+
+// cancelling calls the cancel function when the server fails, must be called before start.
+// The output is then discarded so the command doesn't block on a full pipe.
+func (s *outputStreamer) cancelling(cancel func()) *outputStreamer {
+	s.onFailure = cancel
+	return s
+}
+
+// start starts sending the output to the server.
+func (s *outputStreamer) start() *outputStreamer {
+	go s.send()
+	return s
+}
+
+// writer returns the writer of the stream, the writers of different streams can be used concurrently.
+func (s *outputStreamer) writer(stream string) *outputStreamWriter {
+	return &outputStreamWriter{stream: stream, streamer: s}
+}
+
+// close sends the incomplete lines and the lines waiting in the queue, returns the first error of the server.
+// The writers must not be used after close.
+func (s *outputStreamer) close() error {
+	s.m.Lock()
+	for _, stream := range []string{OutputStreamStdout, OutputStreamStderr} {
+		s.split(stream, s.redact(stream, nil, true))
+		if buffer, ok := s.partial[stream]; ok && buffer.Len() > 0 {
+			s.chanLines <- s.nextLine(stream, buffer.String())
+			buffer.Reset()
+		}
+	}
+	close(s.chanLines)
+	s.m.Unlock()
+	<-s.chanDone
+	return s.err()
+}
+
+func (s *outputStreamer) err() error {
+	s.failureM.Lock()
+	defer s.failureM.Unlock()
+	return s.failure
+}
+
+func (s *outputStreamer) write(stream string, p []byte) {
+	if s.err() != nil {
+		return // the server failed, the output is discarded
+	}
+
+	// sequence numbers are assigned in the order the lines are complete:
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.split(stream, s.redact(stream, p, false))
+}
+
+// redact returns the redacted output of the stream, the values are redacted before the output is split into lines
+// so a value spanning writes or lines is redacted too. The output which may be the start of a value is held back
+// until the next write, or until close when final is true. Must be called with the lock held.
+func (s *outputStreamer) redact(stream string, p []byte, final bool) []byte {
+	if len(s.redactions) == 0 {
+		return p
+	}
+	data := append(s.unredacted[stream], p...)
+	// a value starting before safe is complete, the redactions are sorted, the first is the longest:
+	safe := len(data)
+	if !final {
+		safe = len(data) - (len(s.redactions[0]) - 1)
+	}
+	output := []byte{}
+	index := 0
+	for index < safe {
+		matchIndex, matchLength := -1, 0
+		for _, value := range s.redactions {
+			if found := bytes.Index(data[index:], []byte(value)); found > -1 && (matchIndex < 0 || index+found < matchIndex) {
+				matchIndex, matchLength = index+found, len(value)
+			}
+		}
+		if matchIndex < 0 || matchIndex >= safe {
+			output = append(output, data[index:safe]...)
+			index = safe
+			continue
+		}
+		output = append(append(output, data[index:matchIndex]...), secretRedaction...)
+		index = matchIndex + matchLength
+	}
+	s.unredacted[stream] = append([]byte{}, data[index:]...)
+	return output
+}
+
+// split queues the complete lines of the stream, must be called with the lock held.
+func (s *outputStreamer) split(stream string, p []byte) {
+	buffer, ok := s.partial[stream]
+	if !ok {
+		buffer = bytes.NewBuffer([]byte{})
+		s.partial[stream] = buffer
+	}
+	buffer.Write(p)
+	for {
+		index := bytes.IndexByte(buffer.Bytes(), '\n')
+		if index < 0 {
+			if buffer.Len() >= s.maxLineBytes {
+				s.chanLines <- s.nextLine(stream, string(buffer.Next(s.maxLineBytes)))
+				continue
+			}
+			break
+		}
+		line := buffer.Next(index + 1)
+		s.chanLines <- s.nextLine(stream, string(bytes.TrimSuffix(line[:index], []byte{'\r'})))
+	}
+}
+
+// nextLine must be called with the lock held.
+func (s *outputStreamer) nextLine(stream, text string) OutputLine {
+	s.sequence = s.sequence + 1
+	return OutputLine{
+		Sequence:  s.sequence,
+		Stream:    stream,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+func (s *outputStreamer) send() {
+	defer close(s.chanDone)
+
+	batch := []OutputLine{}
+	nBatchBytes := 0
+	timer := time.NewTimer(s.flushInterval)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			if err := s.sendBatch(batch); err != nil {
+				s.logger.Error("failed sending command output", "reason", err)
+				s.failureM.Lock()
+				first := s.failure == nil
+				if first {
+					s.failure = err
+				}
+				s.failureM.Unlock()
+				if first && s.onFailure != nil {
+					s.onFailure()
+				}
+			}
+		}
+		batch = []OutputLine{}
+		nBatchBytes = 0
+	}
+
+	for {
+		select {
+		case line, ok := <-s.chanLines:
+			if !ok {
+				flush()
+				return
+			}
+			if s.err() != nil {
+				continue // the server failed, the output is discarded
+			}
+			batch = append(batch, line)
+			nBatchBytes = nBatchBytes + len(line.Text)
+			if nBatchBytes >= s.batchBytes {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(s.flushInterval)
+		}
+	}
+}
+
+func (s *outputStreamer) sendBatch(batch []OutputLine) error {
+	if sender, ok := findClient(s.client, func(client rootfs.ClientProvider) bool {
+		_, ok := client.(OutputLineSender)
+		return ok
+	}); ok {
+		return sender.(OutputLineSender).OutputLines(batch)
+	}
+	// consecutive lines of the same stream go together:
+	for start := 0; start < len(batch); {
+		end := start
+		texts := []string{}
+		for end < len(batch) && batch[end].Stream == batch[start].Stream {
+			texts = append(texts, batch[end].Text)
+			end = end + 1
+		}
+		s.logger.Trace("writing output", "stream", batch[start].Stream, "lines", len(texts))
+		var err error
+		if batch[start].Stream == OutputStreamStderr {
+			err = s.client.StdErr(texts)
+		} else {
+			for index, text := range texts {
+				texts[index] = escapeOutputLine(text)
+			}
+			err = s.client.StdOut(texts)
+		}
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// outputStreamWriter writes a single stream of the command output.
+type outputStreamWriter struct {
+	stream   string
+	streamer *outputStreamer
+}
+
+// Write never fails, the output is discarded after the server fails.
+func (w *outputStreamWriter) Write(p []byte) (int, error) {
+	w.streamer.write(w.stream, p)
+	return len(p), nil
+}
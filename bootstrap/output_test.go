@@ -0,0 +1,204 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchingClient records the batches of output lines.
+type batchingClient struct {
+	*recordingClient
+	batches [][]OutputLine
+	m       sync.Mutex
+}
+
+func (c *batchingClient) OutputLines(lines []OutputLine) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.batches = append(c.batches, lines)
+	return nil
+}
+
+// blockingClient blocks the output until released.
+type blockingClient struct {
+	*recordingClient
+	chanRelease chan struct{}
+	err         error
+}
+
+func (c *blockingClient) StdOut(lines []string) error {
+	<-c.chanRelease
+	if c.err != nil {
+		return c.err
+	}
+	return c.recordingClient.StdOut(lines)
+}
+
+func TestOutputStreamerLines(t *testing.T) {
+	client := &recordingClient{}
+	streamer := newOutputStreamer(hclog.Default(), client)
+	streamer.start()
+	stdout := streamer.writer(OutputStreamStdout)
+	stderr := streamer.writer(OutputStreamStderr)
+
+	// lines are reassembled from arbitrary chunks:
+	stdout.Write([]byte("hel"))
+	stdout.Write([]byte("lo\r\nwor"))
+	stderr.Write([]byte("warning\n"))
+	stdout.Write([]byte("ld\nincomplete"))
+	assert.Nil(t, streamer.close())
+
+	assert.Equal(t, []string{"hello", "world", "incomplete"}, client.stdout)
+	assert.Equal(t, []string{"warning"}, client.stderr)
+}
+
+func TestOutputStreamerEscapesStatusLines(t *testing.T) {
+	client := &recordingClient{}
+	streamer := newOutputStreamer(hclog.Default(), client)
+	streamer.start()
+	streamer.writer(OutputStreamStdout).Write([]byte(StatusLinePrefix + "progress {}\nhello\n"))
+	streamer.writer(OutputStreamStderr).Write([]byte(StatusLinePrefix + "progress {}\n"))
+	assert.Nil(t, streamer.close())
+
+	// a command can't send a status line:
+	assert.Equal(t, []string{"#" + StatusLinePrefix + "progress {}", "hello"}, client.stdout)
+	assert.Equal(t, []string{StatusLinePrefix + "progress {}"}, client.stderr)
+	_, _, ok := ParseStatusLine(client.stdout[0])
+	assert.False(t, ok)
+}
+
+func TestOutputStreamerSequence(t *testing.T) {
+	client := &batchingClient{recordingClient: &recordingClient{}}
+	streamer := newOutputStreamer(hclog.Default(), client)
+	streamer.maxLineBytes = 4
+	streamer.start()
+	stdout := streamer.writer(OutputStreamStdout)
+	stderr := streamer.writer(OutputStreamStderr)
+
+	started := time.Now().UTC()
+	stdout.Write([]byte("a\n"))
+	stderr.Write([]byte("b\n"))
+	stdout.Write([]byte("longer"))
+	assert.Nil(t, streamer.close())
+
+	lines := []OutputLine{}
+	for _, batch := range client.batches {
+		lines = append(lines, batch...)
+	}
+	assert.Equal(t, 4, len(lines))
+	for index, line := range lines {
+		assert.Equal(t, uint64(index+1), line.Sequence)
+		assert.False(t, line.Timestamp.Before(started))
+	}
+	assert.Equal(t, []string{OutputStreamStdout, OutputStreamStderr, OutputStreamStdout, OutputStreamStdout},
+		[]string{lines[0].Stream, lines[1].Stream, lines[2].Stream, lines[3].Stream})
+	// a line longer than the limit is sent in parts:
+	assert.Equal(t, []string{"a", "b", "long", "er"}, []string{lines[0].Text, lines[1].Text, lines[2].Text, lines[3].Text})
+	// no bare output calls with a line sender:
+	assert.Empty(t, client.stdout)
+}
+
+func TestOutputStreamerBatches(t *testing.T) {
+	client := &batchingClient{recordingClient: &recordingClient{}}
+	streamer := newOutputStreamer(hclog.Default(), client)
+	streamer.flushInterval = time.Hour
+	streamer.start()
+	stdout := streamer.writer(OutputStreamStdout)
+
+	for i := 0; i < 100; i++ {
+		stdout.Write([]byte(fmt.Sprintf("line %d\n", i)))
+	}
+	assert.Nil(t, streamer.close())
+	// all lines fit in a single batch:
+	assert.Equal(t, 1, len(client.batches))
+	assert.Equal(t, 100, len(client.batches[0]))
+}
+
+func TestOutputStreamerBackpressure(t *testing.T) {
+	client := &blockingClient{recordingClient: &recordingClient{}, chanRelease: make(chan struct{})}
+	streamer := newOutputStreamer(hclog.Default(), client)
+	// every line is sent on its own:
+	streamer.batchBytes = 1
+	streamer.start()
+	stdout := streamer.writer(OutputStreamStdout)
+
+	chanWritten := make(chan struct{})
+	go func() {
+		stdout.Write([]byte(strings.Repeat("line\n", defaultOutputQueueLines*2)))
+		close(chanWritten)
+	}()
+
+	select {
+	case <-chanWritten:
+		t.Fatal("expected the writer to block while the server does not accept the output")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(client.chanRelease)
+	<-chanWritten
+	assert.Nil(t, streamer.close())
+	assert.Equal(t, defaultOutputQueueLines*2, len(client.stdout))
+}
+
+func TestOutputStreamerFailure(t *testing.T) {
+	client := &blockingClient{recordingClient: &recordingClient{}, chanRelease: make(chan struct{}), err: errors.New("server gone")}
+	close(client.chanRelease)
+	chanCancelled := make(chan struct{})
+	streamer := newOutputStreamer(hclog.Default(), client).cancelling(func() { close(chanCancelled) })
+	streamer.flushInterval = time.Millisecond
+	streamer.start()
+	stdout := streamer.writer(OutputStreamStdout)
+
+	stdout.Write([]byte("lost\n"))
+	select {
+	case <-chanCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the command to be cancelled")
+	}
+
+	// the output is drained and discarded so the command never blocks:
+	for i := 0; i < defaultOutputQueueLines*2; i++ {
+		written, err := stdout.Write([]byte("more\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, 5, written)
+	}
+	assert.NotNil(t, streamer.close())
+}
+
+func TestOutputStreamerRedactsAcrossWrites(t *testing.T) {
+	client := &recordingClient{}
+	streamer := newOutputStreamer(hclog.Default(), client).redacting([]string{"secret", "hunter2-long"}).start()
+	stdout := streamer.writer(OutputStreamStdout)
+	stderr := streamer.writer(OutputStreamStderr)
+
+	// a value split between writes, across the streams and at the end of the output:
+	for _, chunk := range []string{"a sec", "ret b hun", "ter2-", "long c\nse", "cret\nend sec"} {
+		stdout.Write([]byte(chunk))
+		stderr.Write([]byte(chunk))
+	}
+	stdout.Write([]byte("ret"))
+	assert.Nil(t, streamer.close())
+
+	assert.Equal(t, []string{"a " + secretRedaction + " b " + secretRedaction + " c", secretRedaction, "end " + secretRedaction}, client.stdout)
+	assert.Equal(t, []string{"a " + secretRedaction + " b " + secretRedaction + " c", secretRedaction, "end sec"}, client.stderr)
+}
+
+func TestOutputStreamerUnwrapsClients(t *testing.T) {
+	client := &batchingClient{recordingClient: &recordingClient{}}
+	wrapped := &runClient{ClientProvider: &progressClient{ClientProvider: client, progress: &buildProgress{}}}
+	streamer := newOutputStreamer(hclog.Default(), wrapped).start()
+	streamer.writer(OutputStreamStderr).Write([]byte("line\n"))
+	assert.Nil(t, streamer.close())
+
+	// the lines reach the sender behind the wrappers, with their stream:
+	assert.Equal(t, 1, len(client.batches))
+	assert.Equal(t, OutputStreamStderr, client.batches[0][0].Stream)
+	assert.Equal(t, 0, len(client.stderr))
+}
@@ -0,0 +1,157 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSymlinksFollowed is the maximum number of symlinks followed while resolving a single path, same as Linux.
+const maxSymlinksFollowed = 40
+
+// Path violation reasons.
+const (
+	PathViolationEscapesDestination = "escapes-destination"
+	PathViolationEscapesRoot        = "escapes-root"
+	PathViolationTooManySymlinks    = "too-many-symlinks"
+)
+
+// PathViolationError is returned when a resource path would resolve outside of the directory it is confined to.
+type PathViolationError struct {
+	// Root is the directory the path is confined to.
+	Root string `json:"Root"`
+	// Path is the offending path as requested.
+	Path string `json:"Path"`
+	// Reason is one of the PathViolation... reasons.
+	Reason string `json:"Reason"`
+}
+
+func (e *PathViolationError) Error() string {
+	return fmt.Sprintf("path violation: %s: path '%s' not confined to '%s'", e.Reason, e.Path, e.Root)
+}
+
+// AbortError is the error the server receives when a build is aborted because of a path violation.
+// The abort request carries a single string so the error is sent as a JSON document.
+type AbortError struct {
+	Message       string              `json:"Message"`
+	PathViolation *PathViolationError `json:"PathViolation"`
+}
+
+func (e *AbortError) Error() string {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
+	}
+	return string(encoded)
+}
+
+// abortError returns the error sent to the server with the abort request, structured for a path violation.
+func abortError(err error) error {
+	violation := &PathViolationError{}
+	if errors.As(err, &violation) {
+		return &AbortError{Message: err.Error(), PathViolation: violation}
+	}
+	return err
+}
+
+// resolveInRoot resolves the path under the root directory the way openat2 with RESOLVE_IN_ROOT does:
+// absolute symlinks are resolved relative to the root and .. never goes above the root so the result
+// is always confined to the root. A requested path which lexically escapes the root is a violation.
+// The final component is followed only when followFinal is true, components which do not exist are taken as they are.
+func resolveInRoot(root, unsafePath string, followFinal bool) (string, error) {
+	root = filepath.Clean(root)
+
+	cleaned, err := cleanConfinedPath(root, unsafePath)
+	if err != nil {
+		return "", err
+	}
+
+	remaining := splitPath(cleaned)
+	current := ""
+	nSymlinks := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		if part == ".." {
+			// only symlink targets bring .. here, it stops at the root:
+			current = parentInRoot(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		if len(remaining) == 0 && !followFinal {
+			current = next
+			break
+		}
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		nSymlinks = nSymlinks + 1
+		if nSymlinks > maxSymlinksFollowed {
+			return "", &PathViolationError{Root: root, Path: unsafePath, Reason: PathViolationTooManySymlinks}
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = ""
+		}
+		remaining = append(splitPath(target), remaining...)
+	}
+
+	return filepath.Join(root, current), nil
+}
+
+// cleanConfinedPath cleans the path relative to the root, a path which escapes the root is a violation.
+// An absolute path is taken as relative to the root.
+func cleanConfinedPath(root, unsafePath string) (string, error) {
+	cleaned := filepath.Clean(strings.TrimLeft(filepath.FromSlash(unsafePath), string(filepath.Separator)))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", &PathViolationError{Root: root, Path: unsafePath, Reason: PathViolationEscapesRoot}
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// isBeneath returns true if the path is the directory or is in the directory, both must be clean.
+func isBeneath(directory, path string) bool {
+	return path == directory || strings.HasPrefix(path, strings.TrimSuffix(directory, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func parentInRoot(current string) string {
+	parent := filepath.Dir(current)
+	if parent == "." || parent == string(filepath.Separator) {
+		return ""
+	}
+	return parent
+}
+
+func splitPath(input string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(filepath.ToSlash(input), "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,166 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	root := filepath.Join(tempDir, "root")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "usr/lib"), 0755))
+	assert.Nil(t, os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	assert.Nil(t, os.Symlink("../../../../..", filepath.Join(root, "usr/lib/up")))
+	assert.Nil(t, os.Symlink(tempDir, filepath.Join(root, "outside")))
+	assert.Nil(t, os.Symlink("loop2", filepath.Join(root, "loop1")))
+	assert.Nil(t, os.Symlink("loop1", filepath.Join(root, "loop2")))
+
+	for input, expected := range map[string]string{
+		"/":                "",
+		"/etc/passwd":      "etc/passwd",
+		"etc/../etc/group": "etc/group",
+		// absolute symlinks resolve relative to the root:
+		"/lib/file":     "usr/lib/file",
+		"/outside/file": strings.TrimPrefix(filepath.Join(tempDir, "file"), "/"),
+		// .. in symlinks stops at the root:
+		"/usr/lib/up/etc/shadow": "etc/shadow",
+	} {
+		resolved, err := resolveInRoot(root, input, false)
+		assert.Nil(t, err, input)
+		assert.Equal(t, filepath.Join(root, expected), resolved, input)
+	}
+
+	// the final component is followed only when asked to:
+	resolved, err := resolveInRoot(root, "/lib", false)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "lib"), resolved)
+	resolved, err = resolveInRoot(root, "/lib", true)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "usr/lib"), resolved)
+
+	for input, reason := range map[string]string{
+		"../etc/shadow":        PathViolationEscapesRoot,
+		"etc/../../etc/shadow": PathViolationEscapesRoot,
+		"loop1/file":           PathViolationTooManySymlinks,
+	} {
+		_, err := resolveInRoot(root, input, false)
+		violation := &PathViolationError{}
+		assert.True(t, errors.As(err, &violation), input)
+		assert.Equal(t, reason, violation.Reason, input)
+	}
+}
+
+func TestDeployerConfinesDestinations(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	root := filepath.Join(tempDir, "root")
+	outsideDir := filepath.Join(tempDir, "outside")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	assert.Nil(t, os.MkdirAll(outsideDir, 0755))
+	// planted symlinks pointing outside of the root:
+	assert.Nil(t, os.Symlink(outsideDir, filepath.Join(root, "planted")))
+	assert.Nil(t, os.Symlink(filepath.Join(outsideDir, "target"), filepath.Join(root, "etc/config")))
+
+	workdir := commands.Workdir{Value: "/srv"}
+	deployer := newTestResourceDeployer(hclog.Default(), root)
+	copyFile := func(target string) error {
+		return deployer.Copy(commands.Copy{
+			OriginalCommand: "COPY file " + target,
+			OriginalSource:  "file",
+			Source:          "file",
+			Target:          target,
+			User:            commands.DefaultUser(),
+			Workdir:         workdir,
+		}, &recordingClient{
+			resources: map[string][]resources.ResolvedResource{
+				"file": {resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("content")), nil
+				}, fs.FileMode(0644), "file", target, workdir, commands.DefaultUser())},
+			},
+		})
+	}
+
+	// like with Docker, .. stops at the root:
+	assert.Nil(t, copyFile("../../../etc/shadow"))
+	_, err = os.Stat(filepath.Join(root, "etc/shadow"))
+	assert.Nil(t, err)
+
+	// a directory symlink is resolved within the root:
+	assert.Nil(t, copyFile("/planted/file"))
+	_, err = os.Stat(filepath.Join(root, outsideDir, "file"))
+	assert.Nil(t, err)
+
+	// a file symlink is replaced, not followed:
+	assert.Nil(t, copyFile("/etc/config"))
+	info, err := os.Lstat(filepath.Join(root, "etc/config"))
+	assert.Nil(t, err)
+	assert.True(t, info.Mode().IsRegular())
+
+	outsideEntries, err := ioutil.ReadDir(outsideDir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(outsideEntries))
+}
+
+func TestBootstrapReportsPathViolations(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	assert.Nil(t, os.Symlink("loop2", filepath.Join(tempDir, "loop1")))
+	assert.Nil(t, os.Symlink("loop1", filepath.Join(tempDir, "loop2")))
+
+	workdir := commands.DefaultWorkdir()
+	client := &recordingClient{
+		commands: []commands.VMInitSerializableCommand{commands.Copy{
+			OriginalCommand: "COPY file /loop1/file",
+			OriginalSource:  "file",
+			Source:          "file",
+			Target:          "/loop1/file",
+			User:            commands.DefaultUser(),
+			Workdir:         workdir,
+		}},
+		resources: map[string][]resources.ResolvedResource{
+			"file": {resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("content")), nil
+			}, fs.FileMode(0644), "file", "/loop1/file", workdir, commands.DefaultUser())},
+		},
+	}
+	err = NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{}).
+		WithCommandRunner(&failingCommandRunner{}).
+		WithResourceDeployer(newTestResourceDeployer(hclog.Default(), tempDir)).(*defaultBootstrapper).
+		execute(context.Background(), client)
+	assert.NotNil(t, err)
+
+	// the server receives the violation as a JSON document:
+	abortErr := &AbortError{}
+	assert.Nil(t, json.Unmarshal([]byte(client.aborted.Error()), abortErr))
+	assert.NotNil(t, abortErr.PathViolation)
+	assert.Equal(t, PathViolationTooManySymlinks, abortErr.PathViolation.Reason)
+	assert.Equal(t, "/loop1/file", abortErr.PathViolation.Path)
+	assert.Equal(t, err.Error(), abortErr.Message)
+}
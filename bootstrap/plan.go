@@ -0,0 +1,399 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// Build plan layout. A build plan is a directory, or a tar archive of the directory, with:
+//   - commands.json: a JSON array of the ADD, COPY and RUN commands, serialized the way the rootfs server sends them,
+//   - context/: the build context the ADD and COPY sources are resolved in,
+//   - bootstrap.json: optional bootstrap settings, the timeouts, ping and PTY settings of the MMDS bootstrap data,
+//   - image.json: optional final image config, no image config is written when missing.
+//
+// The outcome of the build is written to the output directory.
+const (
+	PlanBootstrapFile    = "bootstrap.json"
+	PlanCommandsFile     = "commands.json"
+	PlanContextDirectory = "context"
+	PlanImageConfigFile  = "image.json"
+	PlanReportFile       = "report.json"
+	PlanResultFile       = "result.json"
+	PlanStderrFile       = "stderr.log"
+	PlanStdoutFile       = "stdout.log"
+)
+
+// Build plan result statuses.
+const (
+	PlanStatusAborted = "aborted"
+	PlanStatusSuccess = "success"
+)
+
+// PlanResult is the outcome of a build executed from a build plan.
+type PlanResult struct {
+	Status     string    `json:"Status"`
+	Error      string    `json:"Error,omitempty"`
+	FinishedAt time.Time `json:"FinishedAt"`
+	// PathViolation is the cause of a build aborted because a resource path was not confined to its root.
+	PathViolation *PathViolationError `json:"PathViolation,omitempty"`
+}
+
+// PlanClient is a client provider serving a local build plan instead of the rootfs gRPC server.
+type PlanClient interface {
+	rootfs.ClientProvider
+	// Bootstrap returns the bootstrap settings of the plan, defaults when the plan has none.
+	Bootstrap() *mmds.MMDSBootstrap
+	// Close closes the output files and removes the plan extracted from an archive.
+	Close() error
+	// OutputDirectory returns the directory the output and the result are written to.
+	OutputDirectory() string
+}
+
+type planClient struct {
+	bootstrapData    *mmds.MMDSBootstrap
+	cleanupDirectory string
+	contextDirectory string
+	fetchedCommands  []commands.VMInitSerializableCommand
+	logger           hclog.Logger
+	outputDirectory  string
+	planDirectory    string
+
+	m       sync.Mutex
+	sources map[string]commands.VMInitSerializableCommand
+	stderr  *os.File
+	stdout  *os.File
+}
+
+// NewPlanClient returns a client serving the build plan from a directory or a tar archive.
+// Output and the result go to the output directory, the plan directory if empty.
+func NewPlanClient(logger hclog.Logger, planPath, outputDirectory string) (PlanClient, error) {
+	planInfo, err := os.Stat(planPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "build plan not found")
+	}
+
+	client := &planClient{
+		logger:          logger,
+		outputDirectory: outputDirectory,
+		planDirectory:   planPath,
+	}
+
+	if !planInfo.IsDir() {
+		extractDirectory, err := ioutil.TempDir("", "firebuild-plan-")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed creating build plan directory")
+		}
+		if err := extractArchive(logger, planPath, extractDirectory, extractDirectory, &deploySettings{uid: -1, gid: -1}); err != nil {
+			os.RemoveAll(extractDirectory)
+			return nil, errors.Wrap(err, "failed extracting build plan archive")
+		}
+		client.cleanupDirectory = extractDirectory
+		client.planDirectory = extractDirectory
+		if client.outputDirectory == "" {
+			client.outputDirectory = filepath.Dir(planPath)
+		}
+	}
+	if client.outputDirectory == "" {
+		client.outputDirectory = client.planDirectory
+	}
+	client.contextDirectory = filepath.Join(client.planDirectory, PlanContextDirectory)
+
+	client.bootstrapData = &mmds.MMDSBootstrap{}
+	bootstrapBytes, err := ioutil.ReadFile(filepath.Join(client.planDirectory, PlanBootstrapFile))
+	if err != nil && !os.IsNotExist(err) {
+		client.Close()
+		return nil, errors.Wrap(err, "failed reading build plan bootstrap settings")
+	}
+	if err == nil {
+		if err := json.Unmarshal(bootstrapBytes, client.bootstrapData); err != nil {
+			client.Close()
+			return nil, errors.Wrap(err, "failed parsing build plan bootstrap settings")
+		}
+	}
+
+	if err := os.MkdirAll(client.outputDirectory, 0755); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "failed creating output directory")
+	}
+	for _, output := range []struct {
+		file **os.File
+		name string
+	}{{&client.stderr, PlanStderrFile}, {&client.stdout, PlanStdoutFile}} {
+		file, err := os.OpenFile(filepath.Join(client.outputDirectory, output.name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			client.Close()
+			return nil, errors.Wrapf(err, "failed creating output file '%s'", output.name)
+		}
+		*output.file = file
+	}
+
+	return client, nil
+}
+
+func (c *planClient) Abort(input error) error {
+	result := &PlanResult{Status: PlanStatusAborted, Error: input.Error()}
+	if abortErr, ok := input.(*AbortError); ok {
+		result.Error, result.PathViolation = abortErr.Message, abortErr.PathViolation
+	}
+	return c.writeResult(result)
+}
+
+func (c *planClient) Bootstrap() *mmds.MMDSBootstrap {
+	return c.bootstrapData
+}
+
+func (c *planClient) Close() error {
+	var err error
+	for _, file := range []*os.File{c.stderr, c.stdout} {
+		if file != nil {
+			if closeErr := file.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if c.cleanupDirectory != "" {
+		if removeErr := os.RemoveAll(c.cleanupDirectory); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// Commands reads the commands of the build plan.
+func (c *planClient) Commands() error {
+	commandsBytes, err := ioutil.ReadFile(filepath.Join(c.planDirectory, PlanCommandsFile))
+	if err != nil {
+		return errors.Wrap(err, "failed reading build plan commands")
+	}
+	rawItems := []map[string]interface{}{}
+	if err := json.Unmarshal(commandsBytes, &rawItems); err != nil {
+		return errors.Wrap(err, "failed parsing build plan commands")
+	}
+	c.fetchedCommands = []commands.VMInitSerializableCommand{}
+	c.sources = map[string]commands.VMInitSerializableCommand{}
+	for index, rawItem := range rawItems {
+		originalCommand := fmt.Sprintf("%v", rawItem["OriginalCommand"])
+		var command commands.VMInitSerializableCommand
+		var err error
+		switch {
+		case strings.HasPrefix(originalCommand, "ADD"):
+			add := commands.Add{}
+			err = mapstructure.Decode(rawItem, &add)
+			command = add
+			c.addSource(add.Source, add)
+		case strings.HasPrefix(originalCommand, "COPY"):
+			copy := commands.Copy{}
+			err = mapstructure.Decode(rawItem, &copy)
+			command = copy
+			c.addSource(copy.Source, copy)
+		case strings.HasPrefix(originalCommand, "RUN"):
+			run := commands.Run{}
+			err = mapstructure.Decode(rawItem, &run)
+			command = run
+		default:
+			return fmt.Errorf("build plan command %d is not an ADD, COPY or RUN command: '%s'", index, originalCommand)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed decoding build plan command %d", index)
+		}
+		c.fetchedCommands = append(c.fetchedCommands, command)
+	}
+	return nil
+}
+
+// addSource records the command resolving the resource, the first command with the source wins like on the server.
+func (c *planClient) addSource(source string, command commands.VMInitSerializableCommand) {
+	if _, ok := c.sources[source]; !ok {
+		c.sources[source] = command
+	}
+}
+
+// ImageConfig returns the image config of the plan, nil when the plan has none.
+func (c *planClient) ImageConfig() (*mmds.MMDSImageConfig, error) {
+	configBytes, err := ioutil.ReadFile(filepath.Join(c.planDirectory, PlanImageConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed reading build plan image config")
+	}
+	config, err := mmds.NewMMDSImageConfigFromJSON(string(configBytes))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing build plan image config")
+	}
+	return config, nil
+}
+
+func (c *planClient) NextCommand() commands.VMInitSerializableCommand {
+	if len(c.fetchedCommands) == 0 {
+		return nil
+	}
+	result := c.fetchedCommands[0]
+	c.fetchedCommands = c.fetchedCommands[1:]
+	return result
+}
+
+func (c *planClient) OutputDirectory() string {
+	return c.outputDirectory
+}
+
+func (c *planClient) Ping() error {
+	return nil
+}
+
+// Resource resolves the source of an ADD or COPY command in the build context, directories are walked.
+// The channel is closed once all the resources are sent.
+func (c *planClient) Resource(path string) (chan interface{}, error) {
+	c.m.Lock()
+	command := c.sources[path]
+	c.m.Unlock()
+
+	var targetPath string
+	var workdir commands.Workdir
+	var user commands.User
+	switch vCommand := command.(type) {
+	case commands.Add:
+		targetPath, workdir, user = vCommand.Target, vCommand.Workdir, vCommand.User
+		if vCommand.UserFromLocalChown != nil {
+			user = *vCommand.UserFromLocalChown
+		}
+	case commands.Copy:
+		targetPath, workdir, user = vCommand.Target, vCommand.Workdir, vCommand.User
+		if vCommand.UserFromLocalChown != nil {
+			user = *vCommand.UserFromLocalChown
+		}
+	default:
+		return nil, fmt.Errorf("resource '%s' is not a source of an ADD or COPY command", path)
+	}
+
+	if isRemoteSource(path) {
+		return nil, fmt.Errorf("remote resource '%s' not available in a build plan", path)
+	}
+	cleaned, err := cleanConfinedPath(c.contextDirectory, path)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(c.contextDirectory, cleaned))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid resource pattern '%s'", path)
+	}
+
+	chanResources := make(chan interface{})
+	go func() {
+		defer close(chanResources)
+		for _, match := range matches {
+			sourcePath, err := filepath.Rel(c.contextDirectory, match)
+			if err != nil {
+				chanResources <- err
+				return
+			}
+			if err := c.walkResource(chanResources, match, sourcePath, targetPath, workdir, user); err != nil {
+				chanResources <- err
+				return
+			}
+		}
+	}()
+	return chanResources, nil
+}
+
+// walkResource sends the resource, and everything in it if it is a directory, the way the rootfs server does.
+func (c *planClient) walkResource(chanResources chan interface{}, match, sourcePath, targetPath string, workdir commands.Workdir, user commands.User) error {
+	return filepath.Walk(match, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		remainingPath, err := filepath.Rel(match, path)
+		if err != nil {
+			return err
+		}
+		entrySourcePath, entryTargetPath := sourcePath, targetPath
+		if remainingPath != "." {
+			entrySourcePath = filepath.Join(sourcePath, remainingPath)
+			entryTargetPath = filepath.Join(targetPath, remainingPath)
+		}
+
+		metadata := &ResourceMetadata{ModTime: info.ModTime()}
+		var resource resources.ResolvedResource
+		switch {
+		case info.IsDir():
+			resource = resources.NewResolvedDirectoryResourceWithPath(info.Mode().Perm(), path, entrySourcePath, entryTargetPath, workdir, user)
+		case info.Mode()&os.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			metadata.SymlinkTarget = linkTarget
+			resource = resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("")), nil
+			}, info.Mode().Perm(), entrySourcePath, entryTargetPath, workdir, user, path)
+		case info.Mode().IsRegular():
+			filePath := path
+			resource = resources.NewResolvedFileResourceWithPath(func() (io.ReadCloser, error) {
+				return os.Open(filePath)
+			}, info.Mode().Perm(), entrySourcePath, entryTargetPath, workdir, user, path)
+		default:
+			c.logger.Warn("unsupported build context entry, skipping", "path", path, "mode", info.Mode().String())
+			return nil
+		}
+		chanResources <- &planResource{ResolvedResource: resource, metadata: metadata}
+		return nil
+	})
+}
+
+func (c *planClient) StdErr(lines []string) error {
+	return c.writeLines(c.stderr, lines)
+}
+
+func (c *planClient) StdOut(lines []string) error {
+	return c.writeLines(c.stdout, lines)
+}
+
+func (c *planClient) Success() error {
+	return c.writeResult(&PlanResult{Status: PlanStatusSuccess})
+}
+
+func (c *planClient) writeLines(file *os.File, lines []string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, line := range lines {
+		if _, err := io.WriteString(file, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *planClient) writeResult(result *PlanResult) error {
+	result.FinishedAt = time.Now().UTC()
+	resultBytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.outputDirectory, PlanResultFile), resultBytes, 0644)
+}
+
+// planResource is a build context resource with its file system metadata.
+type planResource struct {
+	resources.ResolvedResource
+	metadata *ResourceMetadata
+}
+
+func (r *planResource) Metadata() *ResourceMetadata {
+	return r.metadata
+}
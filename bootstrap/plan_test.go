@@ -0,0 +1,170 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustWritePlan(t *testing.T, planDirectory string, planCommands []commands.VMInitSerializableCommand, contextFiles map[string]string) {
+	commandsBytes, err := json.Marshal(planCommands)
+	if err != nil {
+		t.Fatal("expected commands to serialize, got error", err)
+	}
+	if err := os.MkdirAll(filepath.Join(planDirectory, PlanContextDirectory), 0755); err != nil {
+		t.Fatal("expected context directory, got error", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(planDirectory, PlanCommandsFile), commandsBytes, 0644); err != nil {
+		t.Fatal("expected commands file, got error", err)
+	}
+	for path, content := range contextFiles {
+		fullPath := filepath.Join(planDirectory, PlanContextDirectory, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal("expected context file directory, got error", err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal("expected context file, got error", err)
+		}
+	}
+}
+
+func mustReadPlanResult(t *testing.T, outputDirectory string) *PlanResult {
+	resultBytes, err := ioutil.ReadFile(filepath.Join(outputDirectory, PlanResultFile))
+	if err != nil {
+		t.Fatal("expected result file, got error", err)
+	}
+	result := &PlanResult{}
+	if err := json.Unmarshal(resultBytes, result); err != nil {
+		t.Fatal("expected result to parse, got error", err)
+	}
+	return result
+}
+
+func executePlan(t *testing.T, planPath, outputDirectory string) error {
+	client, err := NewPlanClient(hclog.Default(), planPath, outputDirectory)
+	if err != nil {
+		t.Fatal("expected plan client, got error", err)
+	}
+	defer client.Close()
+	return NewDefaultBoostrapper(hclog.Default(), client.Bootstrap()).
+		WithCommandRunner(NewShellCommandRunner(hclog.Default())).
+		WithResourceDeployer(NewExecutingResourceDeployer(hclog.Default())).
+		ExecuteWithClient(context.Background(), client)
+}
+
+func testCopy(source, target string) commands.Copy {
+	return commands.Copy{
+		OriginalCommand: "COPY " + source + " " + target,
+		OriginalSource:  source,
+		Source:          source,
+		Target:          target,
+		User:            commands.DefaultUser(),
+		Workdir:         commands.DefaultWorkdir(),
+	}
+}
+
+func TestPlanClientExecutesPlan(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	planDirectory := filepath.Join(tempDir, "plan")
+	rootDirectory := filepath.Join(tempDir, "root")
+	mustWritePlan(t, planDirectory, []commands.VMInitSerializableCommand{
+		testCopy("app", filepath.Join(rootDirectory, "opt/app")),
+		testCopy("config.txt", filepath.Join(rootDirectory, "etc/config.txt")),
+		commands.RunWithDefaults("cat " + filepath.Join(rootDirectory, "opt/app/bin/run") + " && echo failure >&2"),
+	}, map[string]string{
+		"app/bin/run": "hello from the plan",
+		"config.txt":  "config",
+	})
+
+	assert.Nil(t, executePlan(t, planDirectory, ""))
+
+	for path, expected := range map[string]string{
+		"opt/app/bin/run": "hello from the plan",
+		"etc/config.txt":  "config",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(rootDirectory, path))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	stdout, err := ioutil.ReadFile(filepath.Join(planDirectory, PlanStdoutFile))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello from the plan\n", string(stdout))
+	stderr, err := ioutil.ReadFile(filepath.Join(planDirectory, PlanStderrFile))
+	assert.Nil(t, err)
+	assert.Equal(t, "failure\n", string(stderr))
+
+	result := mustReadPlanResult(t, planDirectory)
+	assert.Equal(t, PlanStatusSuccess, result.Status)
+	assert.Empty(t, result.Error)
+}
+
+func TestPlanClientRecordsAbort(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	planDirectory := filepath.Join(tempDir, "plan")
+	outputDirectory := filepath.Join(tempDir, "output")
+	mustWritePlan(t, planDirectory, []commands.VMInitSerializableCommand{
+		testCopy("../outside", filepath.Join(tempDir, "outside")),
+	}, map[string]string{})
+
+	assert.NotNil(t, executePlan(t, planDirectory, outputDirectory))
+
+	result := mustReadPlanResult(t, outputDirectory)
+	assert.Equal(t, PlanStatusAborted, result.Status)
+	assert.NotEmpty(t, result.Error)
+}
+
+func TestPlanClientExtractsPlanArchive(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	commandsBytes, err := json.Marshal([]commands.VMInitSerializableCommand{
+		commands.RunWithDefaults("echo archived plan"),
+	})
+	if err != nil {
+		t.Fatal("expected commands to serialize, got error", err)
+	}
+	archivePath := filepath.Join(tempDir, "plan.tar")
+	if err := ioutil.WriteFile(archivePath, mustBuildTestArchive(t, []testArchiveEntry{
+		{header: &tar.Header{Name: PlanCommandsFile, Typeflag: tar.TypeReg, Mode: 0644}, content: string(commandsBytes)},
+		{header: &tar.Header{Name: PlanBootstrapFile, Typeflag: tar.TypeReg, Mode: 0644}, content: `{"CommandTimeout":"1m"}`},
+	}), 0644); err != nil {
+		t.Fatal("expected plan archive, got error", err)
+	}
+
+	client, err := NewPlanClient(hclog.Default(), archivePath, "")
+	if err != nil {
+		t.Fatal("expected plan client, got error", err)
+	}
+	assert.Equal(t, "1m", client.Bootstrap().CommandTimeout)
+	assert.Nil(t, client.Close())
+
+	assert.Nil(t, executePlan(t, archivePath, ""))
+
+	// the output goes next to the archive:
+	stdout, err := ioutil.ReadFile(filepath.Join(tempDir, PlanStdoutFile))
+	assert.Nil(t, err)
+	assert.Equal(t, "archived plan\n", string(stdout))
+	assert.Equal(t, PlanStatusSuccess, mustReadPlanResult(t, tempDir).Status)
+}
@@ -0,0 +1,128 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// PTYConfig configures RUN commands attached to a pseudo-terminal.
+// The command output is merged and streamed as stdout.
+type PTYConfig struct {
+	// Columns is the terminal width.
+	Columns uint16
+	// KeepANSI keeps the ANSI escape sequences in the output, they are stripped otherwise.
+	KeepANSI bool
+	// Rows is the terminal height.
+	Rows uint16
+}
+
+// NewPTYConfig returns the PTY configuration of the bootstrap, nil if the commands do not run in a PTY.
+func NewPTYConfig(bootstrapData *mmds.MMDSBootstrap) *PTYConfig {
+	if !bootstrapData.SafePTY() {
+		return nil
+	}
+	rows, columns := bootstrapData.SafePTYSize()
+	return &PTYConfig{
+		Columns:  columns,
+		KeepANSI: bootstrapData.SafePTYKeepANSI(),
+		Rows:     rows,
+	}
+}
+
+// openPTY opens a new pseudo-terminal pair with the window size of the config.
+func openPTY(config *PTYConfig) (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed opening pseudo-terminal master")
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed unlocking pseudo-terminal")
+	}
+	number, err := unix.IoctlGetUint32(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed reading pseudo-terminal number")
+	}
+	if err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: config.Rows, Col: config.Columns}); err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed setting pseudo-terminal window size")
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, errors.Wrap(err, "failed opening pseudo-terminal slave")
+	}
+	return master, slave, nil
+}
+
+// ANSI escape sequence parser states.
+const (
+	ansiStateText = iota
+	ansiStateEscape
+	ansiStateCSI
+	ansiStateString
+	ansiStateStringEscape
+)
+
+// ansiStripWriter removes the ANSI escape sequences from the output, the sequences may span many writes.
+// It removes CSI sequences (colors, cursor movement), OSC, DCS, PM and APC strings and the other escapes.
+type ansiStripWriter struct {
+	next  io.Writer
+	state int
+}
+
+func (w *ansiStripWriter) Write(p []byte) (int, error) {
+	output := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch w.state {
+		case ansiStateText:
+			if b == 0x1b {
+				w.state = ansiStateEscape
+				continue
+			}
+			output = append(output, b)
+		case ansiStateEscape:
+			switch b {
+			case '[':
+				w.state = ansiStateCSI
+			case ']', 'P', '^', '_':
+				w.state = ansiStateString
+			default:
+				// intermediate bytes, as in a character set designation, precede the final byte:
+				if b < 0x20 || b > 0x2f {
+					w.state = ansiStateText
+				}
+			}
+		case ansiStateCSI:
+			// parameter and intermediate bytes until the final byte:
+			if b >= 0x40 && b <= 0x7e {
+				w.state = ansiStateText
+			}
+		case ansiStateString:
+			// terminated with BEL or ST:
+			if b == 0x07 {
+				w.state = ansiStateText
+			} else if b == 0x1b {
+				w.state = ansiStateStringEscape
+			}
+		case ansiStateStringEscape:
+			if b == '\\' {
+				w.state = ansiStateText
+			} else {
+				w.state = ansiStateString
+			}
+		}
+	}
+	if len(output) > 0 {
+		if _, err := w.next.Write(output); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestANSIStripWriter(t *testing.T) {
+	buffer := bytes.NewBuffer([]byte{})
+	writer := &ansiStripWriter{next: buffer}
+
+	// sequences split across writes:
+	for _, chunk := range []string{
+		"\x1b[1;3", "1mred\x1b[0m ",
+		"\x1b]0;title\x07plain ",
+		"\x1b]8;;http://example.com\x1b\\link\x1b]8;;\x1b", "\\ ",
+		"\x1b(Bcharset\r\n",
+	} {
+		n, err := writer.Write([]byte(chunk))
+		assert.Nil(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, "red plain link charset\r\n", buffer.String())
+}
+
+func TestShellCommandRunnerPTY(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("pseudo-terminals not available", err)
+	}
+	if _, err := os.Stat(defaultPasswdFile); err != nil {
+		t.Skip("no users database", err)
+	}
+
+	for _, keepANSI := range []bool{false, true} {
+		runner := NewShellCommandRunnerWithPTY(hclog.Default(), &PTYConfig{Columns: 100, KeepANSI: keepANSI, Rows: 30})
+		client := &recordingClient{}
+		err := runner.Execute(context.Background(),
+			commands.RunWithDefaults("test -t 0 && test -t 1 && test -t 2 && echo terminal; stty size; printf '\\033[31mred\\033[0m\\n'; echo error >&2"),
+			client)
+		if err != nil {
+			t.Skip("pseudo-terminal not usable", err, client.stdout)
+		}
+		expectedColor := "red"
+		if keepANSI {
+			expectedColor = "\x1b[31mred\x1b[0m"
+		}
+		assert.Equal(t, []string{"terminal", "30 100", expectedColor, "error"}, client.stdout)
+		assert.Empty(t, client.stderr)
+	}
+}
@@ -0,0 +1,59 @@
+package bootstrap
+
+import (
+	"os"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/pkg/errors"
+)
+
+// Build report statuses.
+const (
+	BuildStatusFailed    = "failed"
+	BuildStatusSucceeded = "succeeded"
+)
+
+// BuildReport is the JSON report of a bootstrap, written when the bootstrap finishes.
+type BuildReport struct {
+	Status     string    `json:"Status"`
+	Error      string    `json:"Error,omitempty"`
+	StartedAt  time.Time `json:"StartedAt"`
+	FinishedAt time.Time `json:"FinishedAt"`
+	// PathViolation is the cause of a build failed because a resource path was not confined to its root.
+	PathViolation *PathViolationError `json:"PathViolation,omitempty"`
+	// ManifestPaths are the directories scanned for the changes of every step.
+	ManifestPaths []string `json:"ManifestPaths,omitempty"`
+	// Steps are the changes of the steps executed by this bootstrap, resumed steps are not included.
+	Steps []*StepManifest `json:"Steps,omitempty"`
+	// Cache lists the cache hits and misses of the executed steps when the build cache is enabled.
+	Cache []*CacheResult `json:"Cache,omitempty"`
+	// CacheMounts is the usage of the RUN --mount=type=cache directories.
+	CacheMounts []*CacheMountStats `json:"CacheMounts,omitempty"`
+	// Seal lists the actions of the rootfs sealing after a successful build.
+	Seal []*SealAction `json:"Seal,omitempty"`
+}
+
+// buildReportFile is the file the build report is written to, nothing is written without a path.
+type buildReportFile struct {
+	path string
+}
+
+// save writes the report atomically.
+func (f *buildReportFile) save(report *BuildReport) error {
+	if f.path == "" {
+		return nil
+	}
+	return errors.Wrap(fsutil.WriteJSONAtomically(f.path, report, 0600, 0700), "failed writing build report")
+}
+
+// remove removes the report of a previous build.
+func (f *buildReportFile) remove() error {
+	if f.path == "" {
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed removing build report")
+	}
+	return nil
+}
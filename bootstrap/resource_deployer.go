@@ -3,15 +3,21 @@ package bootstrap
 import (
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/passwd"
 	"github.com/combust-labs/firebuild-shared/build/commands"
 	"github.com/combust-labs/firebuild-shared/build/resources"
 	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
 )
 
 type ResourceDeployer interface {
@@ -33,27 +39,109 @@ func (n *noopResourceDeployer) Copy(cmd commands.Copy, grpcClient rootfs.ClientP
 }
 
 type executingResourceDeployer struct {
-	defaultUser commands.User
-	logger      hclog.Logger
+	groupFile  string
+	logger     hclog.Logger
+	passwdFile string
+	// root is the directory the resources are confined to, the rootfs root
+	root string
 }
 
 func NewExecutingResourceDeployer(logger hclog.Logger) ResourceDeployer {
 	return &executingResourceDeployer{
-		defaultUser: commands.DefaultUser(),
-		logger:      logger,
+		groupFile:  defaultGroupFile,
+		logger:     logger,
+		passwdFile: defaultPasswdFile,
+		root:       "/",
 	}
 }
 
+// deploySettings carries the ownership and mode overrides of a single ADD or COPY command.
+type deploySettings struct {
+	// uid and gid are -1 when the ownership does not change
+	uid  int
+	gid  int
+	mode *fs.FileMode
+	// extractArchives is set for ADD, local tar archives are extracted instead of copied
+	extractArchives bool
+}
+
 func (n *executingResourceDeployer) Add(cmd commands.Add, grpcClient rootfs.ClientProvider) error {
 	n.logger.Debug("executing ADD command", "command", cmd)
-	return n.deployResources(cmd.Source, grpcClient)
+	settings, err := n.settingsFor(cmd.OriginalCommand, cmd.UserFromLocalChown)
+	if err != nil {
+		return err
+	}
+	settings.extractArchives = true
+	return n.deployResources(cmd.Source, settings, grpcClient)
 }
 func (n *executingResourceDeployer) Copy(cmd commands.Copy, grpcClient rootfs.ClientProvider) error {
 	n.logger.Debug("executing COPY command", "command", cmd)
-	return n.deployResources(cmd.Source, grpcClient)
+	settings, err := n.settingsFor(cmd.OriginalCommand, cmd.UserFromLocalChown)
+	if err != nil {
+		return err
+	}
+	return n.deployResources(cmd.Source, settings, grpcClient)
 }
 
-func (n *executingResourceDeployer) deployResources(source string, grpcClient rootfs.ClientProvider) error {
+// settingsFor resolves the --chown user against the users and groups database and parses the --chmod flag.
+// Like with Docker, resources without --chown are owned by root regardless of the USER instruction.
+func (n *executingResourceDeployer) settingsFor(originalCommand string, chown *commands.User) (*deploySettings, error) {
+	settings := &deploySettings{uid: -1, gid: -1}
+
+	mode, err := parseChmodFlag(originalCommand)
+	if err != nil {
+		n.logger.Error("invalid --chmod flag", "command", originalCommand, "reason", err)
+		return nil, err
+	}
+	settings.mode = mode
+
+	if chown == nil || chown.Value == "" {
+		return settings, nil
+	}
+
+	// previous RUN commands may have created users so the database is loaded for every command:
+	db, err := passwd.NewDatabaseFromFiles(n.passwdFile, n.groupFile)
+	if err != nil {
+		n.logger.Error("failed loading users and groups database", "reason", err)
+		return nil, errors.Wrap(err, "failed loading users and groups database")
+	}
+
+	userPart, groupPart := chown.Value, ""
+	if idx := strings.Index(chown.Value, ":"); idx > -1 {
+		userPart, groupPart = chown.Value[0:idx], chown.Value[idx+1:]
+	}
+	if userPart == "" {
+		return nil, fmt.Errorf("invalid --chown value: '%s'", chown.Value)
+	}
+
+	uid, gid, err := db.ResolveOwner(userPart, groupPart)
+	if err != nil {
+		n.logger.Error("failed resolving --chown ownership", "chown", chown.Value, "reason", err)
+		return nil, errors.Wrapf(err, "--chown '%s' can't be resolved", chown.Value)
+	}
+	settings.uid = uid
+	settings.gid = gid
+
+	return settings, nil
+}
+
+// apply changes the ownership and the mode of a deployed file or directory.
+func (s *deploySettings) apply(path string) error {
+	if s.uid > -1 || s.gid > -1 {
+		if err := os.Lchown(path, s.uid, s.gid); err != nil {
+			return err
+		}
+	}
+	if s.mode != nil {
+		// chmod after chown, chown clears the setuid and setgid bits:
+		if err := os.Chmod(path, *s.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *executingResourceDeployer) deployResources(source string, settings *deploySettings, grpcClient rootfs.ClientProvider) error {
 
 	resourceChannel, err := grpcClient.Resource(source)
 
@@ -62,6 +150,11 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 	}
 
 	nResourcesTransferred := 0
+	destinations := &copyDestinations{root: n.root}
+	// hardlinks refer to the resources already deployed by their source path:
+	deployed := map[string]string{}
+	// directory times must be set after all the content is written:
+	directoryTimes := map[string]time.Time{}
 
 	for {
 		select {
@@ -74,6 +167,14 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 						"resource-path", source)
 					return os.ErrNotExist
 				}
+				for path, modTime := range directoryTimes {
+					if err := setModTime(path, modTime); err != nil {
+						n.logger.Error("error while changing directory times",
+							"on-disk-path", path,
+							"reason", err)
+						return err
+					}
+				}
 				n.logger.Debug("resource deployed",
 					"resource-path", source,
 					"number-of-resources", nResourcesTransferred)
@@ -82,9 +183,62 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 
 				nResourcesTransferred = nResourcesTransferred + 1
 
+				destination, err := destinations.resolve(titem)
+				if err != nil {
+					n.logger.Error("invalid resource destination",
+						"resource-path", titem.TargetPath(),
+						"source-path", titem.SourcePath(),
+						"reason", err)
+					return err
+				}
+
+				metadata := resourceMetadata(titem)
+
+				if metadata != nil && metadata.SymlinkTarget != "" {
+					if err := n.deploySymlink(metadata, destination, settings); err != nil {
+						n.logger.Error("error while creating symlink",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", destination,
+							"symlink-target", metadata.SymlinkTarget,
+							"reason", err)
+						return err
+					}
+					deployed[titem.SourcePath()] = destination
+					continue
+				}
+
+				if metadata != nil && metadata.HardlinkTarget != "" {
+					linkTarget, ok := deployed[metadata.HardlinkTarget]
+					if !ok {
+						n.logger.Error("hardlink target not deployed",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", destination,
+							"hardlink-target", metadata.HardlinkTarget)
+						return fmt.Errorf("hardlink target '%s' of '%s' not deployed", metadata.HardlinkTarget, titem.SourcePath())
+					}
+					if err := removeIfNotDirectory(destination); err != nil {
+						n.logger.Error("error while replacing hardlink destination",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", destination,
+							"reason", err)
+						return err
+					}
+					// a hardlink shares ownership, mode, times and extended attributes with the target:
+					if err := os.Link(linkTarget, destination); err != nil {
+						n.logger.Error("error while creating hardlink",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", destination,
+							"hardlink-target", linkTarget,
+							"reason", err)
+						return err
+					}
+					deployed[titem.SourcePath()] = destination
+					continue
+				}
+
 				if titem.IsDir() {
 
-					fullTargetResourcePath := filepath.Join(titem.TargetWorkdir().Value, titem.TargetPath())
+					fullTargetResourcePath := destination
 
 					// create a directory:
 					if err := os.MkdirAll(fullTargetResourcePath, titem.TargetMode()); err != nil {
@@ -98,33 +252,26 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 						"resource-path", titem.TargetPath(),
 						"on-disk-path", fullTargetResourcePath)
 
-					if titem.TargetUser().Value != n.defaultUser.Value {
-						uid, gid, err := stringToUidAndGid(titem.TargetUser().Value)
-						if err != nil {
-							n.logger.Error("error while chowning directory",
-								"resource-path", titem.TargetPath(),
-								"on-disk-path", fullTargetResourcePath,
-								"reason", err)
-							return err
-						}
-						if err := os.Chown(fullTargetResourcePath, uid, gid); err != nil {
-							n.logger.Error("error while chowning directory",
-								"resource-path", titem.TargetPath(),
-								"on-disk-path", fullTargetResourcePath,
-								"reason", err)
-							return err
-						}
+					if err := settings.apply(fullTargetResourcePath); err != nil {
+						n.logger.Error("error while changing directory ownership or mode",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", fullTargetResourcePath,
+							"reason", err)
+						return err
+					}
+					if err := applyMetadata(fullTargetResourcePath, metadata); err != nil {
+						n.logger.Error("error while applying directory metadata",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", fullTargetResourcePath,
+							"reason", err)
+						return err
+					}
+					if metadata != nil && !metadata.ModTime.IsZero() {
+						directoryTimes[fullTargetResourcePath] = metadata.ModTime
 					}
 					continue
 				}
 
-				destination := filepath.Join(titem.TargetWorkdir().Value, titem.TargetPath())
-				targetFileName := filepath.Base(titem.SourcePath())
-				if filepath.Base(destination) != targetFileName {
-					// ensure that we always have a full target path:
-					destination = filepath.Join(destination, targetFileName)
-				}
-
 				// make sure we have the parent directory
 				// this is the default Docker behavior, it creates intermediate directories for ADD / COPY commands
 				if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
@@ -144,7 +291,32 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 				}
 				defer resourceReader.Close()
 
-				targetFile, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR, titem.TargetMode())
+				// like Docker, only the local ADD sources are extracted, never the remote ones or the entries of a directory:
+				if settings.extractArchives && !isRemoteSource(titem.SourcePath()) && !destinations.isEntry(titem.SourcePath()) {
+					if err := n.deployAddFile(titem, resourceReader, destination, settings, metadata); err != nil {
+						n.logger.Error("error while deploying ADD resource",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", destination,
+							"reason", err)
+						return err
+					}
+					deployed[titem.SourcePath()] = destination
+					continue
+				}
+
+				// the destination was resolved without following the final component,
+				// a symlink in its place is replaced, never followed:
+				if info, err := os.Lstat(destination); err == nil && info.Mode()&os.ModeSymlink != 0 {
+					if err := os.Remove(destination); err != nil {
+						n.logger.Error("error while replacing symlink with a file",
+							"resource-path", titem.TargetPath(),
+							"on-disk-path", destination,
+							"reason", err)
+						return err
+					}
+				}
+
+				targetFile, err := os.OpenFile(destination, os.O_CREATE|os.O_RDWR|os.O_TRUNC|syscall.O_NOFOLLOW, titem.TargetMode())
 
 				if err != nil {
 					n.logger.Error("error while creating target file",
@@ -166,31 +338,38 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 
 				targetFile.Close()
 
+				// the mode is only used when the file is created:
+				if err := os.Chmod(destination, titem.TargetMode()); err != nil {
+					n.logger.Error("error while changing file mode",
+						"resource-path", titem.TargetPath(),
+						"on-disk-path", destination,
+						"reason", err)
+					return err
+				}
+
 				n.logger.Info("file written",
 					"resource-path", titem.TargetPath(),
 					"on-disk-path", destination,
 					"written-bytes", written)
 
-				// chown the file:
+				if err := settings.apply(destination); err != nil {
+					n.logger.Error("error while changing file ownership or mode",
+						"resource-path", titem.TargetPath(),
+						"on-disk-path", destination,
+						"reason", err)
+					return err
+				}
 
-				if titem.TargetUser().Value != n.defaultUser.Value {
-					uid, gid, err := stringToUidAndGid(titem.TargetUser().Value)
-					if err != nil {
-						n.logger.Error("error while chowning file",
-							"resource-path", titem.TargetPath(),
-							"on-disk-path", destination,
-							"reason", err)
-						return err
-					}
-					if err := os.Chown(destination, uid, gid); err != nil {
-						n.logger.Error("error while chowning file",
-							"resource-path", titem.TargetPath(),
-							"on-disk-path", destination,
-							"reason", err)
-						return err
-					}
+				if err := applyMetadata(destination, metadata); err != nil {
+					n.logger.Error("error while applying file metadata",
+						"resource-path", titem.TargetPath(),
+						"on-disk-path", destination,
+						"reason", err)
+					return err
 				}
 
+				deployed[titem.SourcePath()] = destination
+
 			case error:
 				return titem
 			}
@@ -199,23 +378,174 @@ func (n *executingResourceDeployer) deployResources(source string, grpcClient ro
 
 }
 
-func stringToUidAndGid(input string) (int, int, error) {
-	parts := strings.Split(input, ":")
-	if len(parts) == 0 {
-		return -1, -1, fmt.Errorf("empty uid:gid")
+// copyDestinations applies the Docker destination rules to the resources of a single ADD or COPY command.
+// The server walks directory sources and sends every entry with the target path already pointing
+// at the entry within the destination, so the contents of a directory are copied, not the directory itself.
+type copyDestinations struct {
+	directorySources []string
+	nSources         int
+	root             string
+}
+
+// resolve returns the on disk destination of the resource:
+//   - a file copied to a path ending with / or to an existing directory keeps its name
+//   - a file copied to any other path is written to that path
+//   - more than one source, for example from a wildcard, requires a destination ending with /
+func (d *copyDestinations) resolve(titem resources.ResolvedResource) (string, error) {
+	root := d.root
+	targetPath := targetPathInRoot(titem)
+
+	if d.isEntry(titem.SourcePath()) {
+		return resolveInRoot(root, targetPath, titem.IsDir())
+	}
+
+	d.nSources = d.nSources + 1
+	if d.nSources > 1 && !strings.HasSuffix(titem.TargetPath(), "/") {
+		return "", fmt.Errorf("when copying more than one source, the destination must be a directory and end with a /: '%s'", titem.TargetPath())
+	}
+
+	if titem.IsDir() {
+		d.directorySources = append(d.directorySources, strings.TrimSuffix(titem.SourcePath(), "/"))
+		return resolveInRoot(root, targetPath, true)
+	}
+
+	if strings.HasSuffix(titem.TargetPath(), "/") {
+		return resolveInRoot(root, filepath.Join(targetPath, filepath.Base(titem.SourcePath())), false)
+	}
+	resolvedTarget, err := resolveInRoot(root, targetPath, true)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(resolvedTarget); err == nil && info.IsDir() {
+		return resolveInRoot(root, filepath.Join(targetPath, filepath.Base(titem.SourcePath())), false)
+	}
+	return resolveInRoot(root, targetPath, false)
+}
+
+// targetPathInRoot returns the absolute target path of the resource, a relative target is relative to the WORKDIR.
+// Like with Docker, .. stops at the root.
+func targetPathInRoot(titem resources.ResolvedResource) string {
+	targetPath := titem.TargetPath()
+	if !filepath.IsAbs(targetPath) {
+		targetPath = filepath.Join(titem.TargetWorkdir().Value, targetPath)
+	}
+	return filepath.Join("/", targetPath)
+}
+
+// isEntry returns true if the source path is an entry of a directory source.
+func (d *copyDestinations) isEntry(sourcePath string) bool {
+	for _, directorySource := range d.directorySources {
+		if strings.HasPrefix(sourcePath, directorySource+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// deployAddFile spools the resource into a temporary file next to the destination
+// and extracts it into the target directory when the content is a tar archive.
+// Resources which are not archives are moved into place.
+func (n *executingResourceDeployer) deployAddFile(titem resources.ResolvedResource, resourceReader io.Reader, destination string, settings *deploySettings, metadata *ResourceMetadata) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(destination), ".firebuild-add-")
+	if err != nil {
+		return errors.Wrap(err, "failed creating temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+
+	written, err := io.Copy(tempFile, resourceReader)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed writing temporary file")
+	}
+
+	archive, err := isArchive(tempFile.Name())
+	if err != nil {
+		return err
+	}
+
+	if archive {
+		// an archive is extracted into the target directory, the source name is irrelevant:
+		extractDirectory, err := resolveInRoot(n.root, targetPathInRoot(titem), true)
+		if err != nil {
+			return err
+		}
+		if err := extractArchive(n.logger, tempFile.Name(), n.root, extractDirectory, settings); err != nil {
+			return err
+		}
+		n.logger.Info("archive extracted",
+			"resource-path", titem.TargetPath(),
+			"on-disk-path", extractDirectory,
+			"archive-bytes", written)
+		return nil
+	}
+
+	if err := os.Chmod(tempFile.Name(), titem.TargetMode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), destination); err != nil {
+		return errors.Wrap(err, "failed moving file into place")
+	}
+	if err := settings.apply(destination); err != nil {
+		return err
+	}
+	if err := applyMetadata(destination, metadata); err != nil {
+		return err
+	}
+
+	n.logger.Info("file written",
+		"resource-path", titem.TargetPath(),
+		"on-disk-path", destination,
+		"written-bytes", written)
+
+	return nil
+}
+
+// deploySymlink replaces whatever is at the destination, unless it is a directory, with a symlink.
+// The target is written as it is, it is resolved in the guest.
+func (n *executingResourceDeployer) deploySymlink(metadata *ResourceMetadata, destination string, settings *deploySettings) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+	if err := removeIfNotDirectory(destination); err != nil {
+		return err
+	}
+	if err := os.Symlink(metadata.SymlinkTarget, destination); err != nil {
+		return err
 	}
-	if len(parts) == 1 {
-		// uid only:
-		uid, err := strconv.Atoi(parts[0])
-		return uid, -1, err
+	// symlinks have no mode of their own:
+	if settings.uid > -1 || settings.gid > -1 {
+		if err := os.Lchown(destination, settings.uid, settings.gid); err != nil {
+			return err
+		}
 	}
-	if len(parts) == 2 {
-		uid, uiderr := strconv.Atoi(parts[0])
-		if uiderr != nil {
-			return uid, -1, uiderr
+	return applyMetadata(destination, metadata)
+}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// parseChmodFlag returns the mode given with the --chmod flag of the original ADD or COPY command, nil if there is no such flag.
+func parseChmodFlag(originalCommand string) (*fs.FileMode, error) {
+	fields := strings.Fields(originalCommand)
+	if len(fields) > 0 {
+		fields = fields[1:] // the instruction
+	}
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "--") {
+			break // flags precede the sources
+		}
+		if !strings.HasPrefix(field, "--chmod=") {
+			continue
+		}
+		value := strings.TrimPrefix(field, "--chmod=")
+		mode, err := fsutil.ParseOctalMode(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --chmod value: '%s', expected an octal mode", value)
 		}
-		gid, giderr := strconv.Atoi(parts[1])
-		return uid, gid, giderr
+		return &mode, nil
 	}
-	return -1, -1, fmt.Errorf("invalid uid:gid")
+	return nil, nil
 }
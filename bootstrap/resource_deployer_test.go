@@ -1,33 +1,207 @@
 package bootstrap
 
 import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/resources"
+	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestUidGidParser(t *testing.T) {
+// newTestResourceDeployer returns an executing resource deployer confined to the root.
+func newTestResourceDeployer(logger hclog.Logger, root string) *executingResourceDeployer {
+	deployer := NewExecutingResourceDeployer(logger).(*executingResourceDeployer)
+	deployer.root = root
+	return deployer
+}
+
+func TestDeploySettings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	passwdFile, groupFile := mustWriteTestDatabase(t, tempDir)
+	deployer := &executingResourceDeployer{
+		groupFile:  groupFile,
+		logger:     hclog.Default(),
+		passwdFile: passwdFile,
+	}
+
+	settingsForChown := func(chown string) (*deploySettings, error) {
+		return deployer.settingsFor("COPY --chown="+chown+" src /dst", &commands.User{Value: chown})
+	}
+
+	// no --chown means root ownership left as is:
+	settings, err := deployer.settingsFor("COPY src /dst", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &deploySettings{uid: -1, gid: -1}, settings)
+
+	for chown, expected := range map[string][]int{
+		"10":          {10, 10},
+		"10:20":       {10, 20},
+		"app":         {1000, 1000},
+		"1000":        {1000, 1000},
+		"app:docker":  {1000, 998},
+		"app:20":      {1000, 20},
+		"10:docker":   {10, 998},
+		"root:wheel":  {0, 10},
+		"1000:docker": {1000, 998},
+	} {
+		settings, err := settingsForChown(chown)
+		assert.Nil(t, err, chown)
+		assert.Equal(t, expected, []int{settings.uid, settings.gid}, chown)
+	}
+
+	for _, chown := range []string{"unknown", "app:unknown", ":app", "-1"} {
+		_, err := settingsForChown(chown)
+		assert.NotNil(t, err, chown)
+	}
+
+	settings, err = deployer.settingsFor("ADD --chown=app --chmod=0640 src /dst", &commands.User{Value: "app"})
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0640), *settings.mode)
+
+	settings, err = deployer.settingsFor("COPY --chmod=4755 src /dst", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0755)|fs.ModeSetuid, *settings.mode)
+
+	// flags end at the first source:
+	settings, err = deployer.settingsFor("COPY src --chmod=0640 /dst", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, settings.mode)
+
+	for _, chmod := range []string{"rwx", "0999", "17777", ""} {
+		_, err := deployer.settingsFor("COPY --chmod="+chmod+" src /dst", nil)
+		assert.NotNil(t, err, chmod)
+	}
+}
+
+func TestCopyDestinations(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	workdir := commands.DefaultWorkdir()
+	deployer := newTestResourceDeployer(hclog.Default(), tempDir)
+
+	fileResource := func(source, target, content string) resources.ResolvedResource {
+		return resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		}, fs.FileMode(0644), source, target, workdir, commands.DefaultUser())
+	}
+	copyCommand := func(source, target string) commands.Copy {
+		return commands.Copy{
+			OriginalCommand: "COPY " + source + " " + target,
+			OriginalSource:  source,
+			Source:          source,
+			Target:          target,
+			User:            commands.DefaultUser(),
+			Workdir:         workdir,
+		}
+	}
+	assertContent := func(path, expected string) {
+		content, err := ioutil.ReadFile(filepath.Join(tempDir, path))
+		assert.Nil(t, err, path)
+		assert.Equal(t, expected, string(content), path)
+	}
 
-	_, _, err1 := stringToUidAndGid("")
-	assert.NotNil(t, err1)
+	// a file copied to a file path is renamed:
+	assert.Nil(t, deployer.Copy(copyCommand("config.yml", "/etc/app/app.yml"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"config.yml": {fileResource("config.yml", "/etc/app/app.yml", "config")},
+		},
+	}))
+	assertContent("etc/app/app.yml", "config")
 
-	_, _, err2 := stringToUidAndGid("a:b:c")
-	assert.NotNil(t, err2)
+	// a file copied to a path ending with a slash keeps its name:
+	assert.Nil(t, deployer.Copy(copyCommand("config.yml", "/etc/slash/"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"config.yml": {fileResource("config.yml", "/etc/slash/", "config")},
+		},
+	}))
+	assertContent("etc/slash/config.yml", "config")
 
-	_, _, err3 := stringToUidAndGid("0:a")
-	assert.NotNil(t, err3)
+	// a file copied to an existing directory keeps its name:
+	assert.Nil(t, os.MkdirAll(filepath.Join(tempDir, "etc/existing"), 0755))
+	assert.Nil(t, deployer.Copy(copyCommand("config.yml", "/etc/existing"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"config.yml": {fileResource("config.yml", "/etc/existing", "config")},
+		},
+	}))
+	assertContent("etc/existing/config.yml", "config")
 
-	_, _, err4 := stringToUidAndGid("a")
-	assert.NotNil(t, err4)
+	// overwriting a longer file:
+	assert.Nil(t, deployer.Copy(copyCommand("short.yml", "/etc/app/app.yml"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"short.yml": {fileResource("short.yml", "/etc/app/app.yml", "new")},
+		},
+	}))
+	assertContent("etc/app/app.yml", "new")
 
-	uid, gid, err5 := stringToUidAndGid("10")
-	assert.Nil(t, err5)
-	assert.Equal(t, 10, uid)
-	assert.Equal(t, -1, gid)
+	// more than one source requires a destination ending with a slash:
+	assert.NotNil(t, deployer.Copy(copyCommand("*.yml", "/etc/multi"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"*.yml": {
+				fileResource("a.yml", "/etc/multi", "a"),
+				fileResource("b.yml", "/etc/multi", "b"),
+			},
+		},
+	}))
+	assert.Nil(t, deployer.Copy(copyCommand("*.yml", "/etc/multi-dir/"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"*.yml": {
+				fileResource("a.yml", "/etc/multi-dir/", "a"),
+				fileResource("b.yml", "/etc/multi-dir/", "b"),
+			},
+		},
+	}))
+	assertContent("etc/multi-dir/a.yml", "a")
+	assertContent("etc/multi-dir/b.yml", "b")
 
-	uid, gid, err6 := stringToUidAndGid("10:10")
-	assert.Nil(t, err6)
-	assert.Equal(t, 10, uid)
-	assert.Equal(t, 10, gid)
+	// the contents of a directory are copied, not the directory itself:
+	assert.Nil(t, deployer.Copy(copyCommand("conf.d", "/etc/conf"), &recordingClient{
+		resources: map[string][]resources.ResolvedResource{
+			"conf.d": {
+				resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755), "conf.d", "conf.d", "/etc/conf", workdir, commands.DefaultUser()),
+				fileResource("conf.d/a.conf", "/etc/conf/a.conf", "a"),
+				resources.NewResolvedDirectoryResourceWithPath(fs.FileMode(0755), "conf.d/sub", "conf.d/sub", "/etc/conf/sub", workdir, commands.DefaultUser()),
+				fileResource("conf.d/sub/b.conf", "/etc/conf/sub/b.conf", "b"),
+			},
+		},
+	}))
+	assertContent("etc/conf/a.conf", "a")
+	assertContent("etc/conf/sub/b.conf", "b")
+	_, err = os.Stat(filepath.Join(tempDir, "etc/conf/conf.d"))
+	assert.True(t, os.IsNotExist(err))
 
+	// relative targets are relative to the WORKDIR, absolute targets to the root:
+	srv := commands.Workdir{Value: "/srv"}
+	for target, expected := range map[string]string{
+		"app/":          "srv/app/config.yml",
+		"./app.yml":     "srv/app.yml",
+		"/etc/srv.yml":  "etc/srv.yml",
+		"../../var.yml": "var.yml",
+	} {
+		command := copyCommand("config.yml", target)
+		command.Workdir = srv
+		assert.Nil(t, deployer.Copy(command, &recordingClient{
+			resources: map[string][]resources.ResolvedResource{
+				"config.yml": {resources.NewResolvedFileResource(func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(target)), nil
+				}, fs.FileMode(0644), "config.yml", target, srv, commands.DefaultUser())},
+			},
+		}), target)
+		assertContent(expected, target)
+	}
 }
@@ -0,0 +1,109 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+)
+
+// Mount types of RUN --mount.
+const (
+	runMountTypeBind   = "bind"
+	runMountTypeCache  = "cache"
+	runMountTypeSecret = "secret"
+)
+
+// runClient is the client provider of the RUN commands, serving the secrets and mounting the caches.
+type runClient struct {
+	rootfs.ClientProvider
+	caches   *cacheStore
+	provider SecretProvider
+	secrets  map[string]string
+}
+
+func (c *runClient) cacheStore() *cacheStore {
+	return c.caches
+}
+
+func (c *runClient) unwrap() rootfs.ClientProvider {
+	return c.ClientProvider
+}
+
+// runMount is a single --mount flag of a RUN command.
+type runMount struct {
+	Type    string
+	Options map[string]string
+}
+
+// option returns the first of the options found under any of the keys.
+func (m *runMount) option(keys ...string) (string, bool) {
+	for _, key := range keys {
+		if value, ok := m.Options[key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// parseRunMounts returns the --mount flags of the original RUN command.
+// A mount is a comma separated list of key=value options, an option without a value is true.
+func parseRunMounts(originalCommand string) ([]*runMount, error) {
+	mounts := []*runMount{}
+	fields := strings.Fields(originalCommand)
+	if len(fields) > 0 {
+		fields = fields[1:] // the instruction
+	}
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "--") {
+			break // flags precede the command
+		}
+		if !strings.HasPrefix(field, "--mount=") {
+			continue
+		}
+		mount := &runMount{Type: runMountTypeBind, Options: map[string]string{}}
+		for _, option := range strings.Split(strings.TrimPrefix(field, "--mount="), ",") {
+			if option == "" {
+				continue
+			}
+			parts := strings.SplitN(option, "=", 2)
+			key := strings.ToLower(parts[0])
+			value := "true"
+			if len(parts) == 2 {
+				value = parts[1]
+			}
+			if key == "type" {
+				mount.Type = strings.ToLower(value)
+				continue
+			}
+			if _, ok := mount.Options[key]; ok {
+				return nil, fmt.Errorf("duplicate mount option '%s' in '%s'", key, field)
+			}
+			mount.Options[key] = value
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// createMountDirectories creates the missing parents of the mount target, the bind mount needs an existing target.
+// The created directories are returned from the outermost so they can be removed in the reverse order.
+func createMountDirectories(target string) ([]string, error) {
+	missingDirectories := []string{}
+	for directory := target; ; directory = filepath.Dir(directory) {
+		if _, err := os.Lstat(directory); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		missingDirectories = append([]string{directory}, missingDirectories...)
+	}
+	created := []string{}
+	for _, directory := range missingDirectories {
+		if err := os.Mkdir(directory, 0755); err != nil {
+			return created, err
+		}
+		created = append(created, directory)
+	}
+	return created, nil
+}
@@ -0,0 +1,234 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Sealing actions listed in the build report.
+const (
+	SealActionClean             = "clean"
+	SealActionRemoveSSHHostKeys = "remove-ssh-host-keys"
+	SealActionResetMachineID    = "reset-machine-id"
+	SealActionTruncateLogs      = "truncate-logs"
+	SealActionZeroFreeSpace     = "zero-free-space"
+)
+
+const (
+	sealDBusMachineIDFile = "/var/lib/dbus/machine-id"
+	sealLogDirectory      = "/var/log"
+	sealMachineIDFile     = "/etc/machine-id"
+	sealSSHHostKeys       = "/etc/ssh/ssh_host_*"
+	// sealZeroFile is filled with zeros until the rootfs is full and removed.
+	sealZeroFile       = "/.firebuild-zero"
+	sealZeroChunkBytes = 1024 * 1024
+)
+
+// SealAction is a single action of the rootfs sealing.
+type SealAction struct {
+	Action string `json:"Action"`
+	// Path is the path or the glob pattern the action applied to.
+	Path string `json:"Path"`
+	// Count is the number of the removed, truncated or reset paths.
+	Count int `json:"Count"`
+	// Bytes is the size of the removed or truncated files, or the zeroed free space.
+	Bytes int64  `json:"Bytes"`
+	Error string `json:"Error,omitempty"`
+}
+
+// sealPatterns returns the clean glob patterns of SealPaths, a pattern which could remove a whole top-level directory
+// of the rootfs, like /*, is refused: the pattern must be absolute, without .., and its first directory must be literal.
+func sealPatterns(patterns []string) ([]string, error) {
+	cleaned := []string{}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			return nil, fmt.Errorf("seal path '%s' is not absolute", pattern)
+		}
+		for _, part := range strings.Split(filepath.ToSlash(pattern), "/") {
+			if part == ".." {
+				return nil, fmt.Errorf("seal path '%s' contains ..", pattern)
+			}
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "seal path '%s' is not a valid pattern", pattern)
+		}
+		parts := splitPath(pattern)
+		if len(parts) < 2 || strings.ContainsAny(parts[0], `*?[\`) {
+			return nil, fmt.Errorf("seal path '%s' must be under a literal top-level directory", pattern)
+		}
+		cleaned = append(cleaned, filepath.Clean(pattern))
+	}
+	return cleaned, nil
+}
+
+// sealFailure returns the error of the first failed action, nil if all actions completed.
+func sealFailure(actions []*SealAction) error {
+	for _, action := range actions {
+		if action.Error != "" {
+			return fmt.Errorf("sealing action %s of '%s' failed: %s", action.Action, action.Path, action.Error)
+		}
+	}
+	return nil
+}
+
+// sealer removes the build-time state shared by every clone of the image from the rootfs.
+// A failed action doesn't stop the following ones, the build fails when they are done.
+type sealer struct {
+	logger        hclog.Logger
+	paths         []string
+	root          string
+	zeroFreeSpace bool
+}
+
+// seal executes the sealing actions, the free space is zeroed last so it covers what the other actions removed.
+func (s *sealer) seal() []*SealAction {
+	actions := []*SealAction{}
+	for _, pattern := range s.paths {
+		actions = append(actions, s.execute(SealActionClean, pattern, s.clean))
+	}
+	actions = append(actions,
+		s.execute(SealActionResetMachineID, sealMachineIDFile, s.resetMachineID),
+		s.execute(SealActionRemoveSSHHostKeys, sealSSHHostKeys, s.removeSSHHostKeys),
+		s.execute(SealActionTruncateLogs, sealLogDirectory, s.truncateLogs))
+	if s.zeroFreeSpace {
+		actions = append(actions, s.execute(SealActionZeroFreeSpace, sealZeroFile, s.fillWithZeros))
+	}
+	return actions
+}
+
+func (s *sealer) execute(name, path string, action func(*SealAction, string) error) *SealAction {
+	result := &SealAction{Action: name, Path: path}
+	if err := action(result, filepath.Join(s.root, path)); err != nil {
+		result.Error = err.Error()
+		s.logger.Warn("sealing action failed", "action", name, "path", path, "reason", err)
+		return result
+	}
+	s.logger.Info("sealing action completed", "action", name, "path", path, "count", result.Count, "bytes", result.Bytes)
+	return result
+}
+
+// clean removes the paths matching the pattern, the mounts are left alone.
+func (s *sealer) clean(result *SealAction, pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.Wrap(err, "invalid pattern")
+	}
+	var firstErr error
+	for _, match := range matches {
+		info, err := os.Lstat(match)
+		if err != nil {
+			continue // removed with an earlier match
+		}
+		if parent, err := os.Lstat(filepath.Dir(match)); err == nil && deviceOf(parent) != deviceOf(info) {
+			s.logger.Debug("not cleaning a mount", "path", match)
+			continue
+		}
+		_, size, _ := directoryUsage(match)
+		if err := os.RemoveAll(match); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		result.Count = result.Count + 1
+		result.Bytes = result.Bytes + size
+	}
+	return firstErr
+}
+
+// resetMachineID empties the machine ID so every clone generates its own on the first boot,
+// the D-Bus machine ID is removed unless it links to the machine ID.
+func (s *sealer) resetMachineID(result *SealAction, path string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		if err := os.Truncate(path, 0); err != nil {
+			return err
+		}
+		result.Count = result.Count + 1
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dbusPath := filepath.Join(s.root, sealDBusMachineIDFile)
+	if info, err := os.Lstat(dbusPath); err == nil && info.Mode().IsRegular() {
+		if err := os.Remove(dbusPath); err != nil {
+			return err
+		}
+		result.Count = result.Count + 1
+	}
+	return nil
+}
+
+// removeSSHHostKeys removes the SSH host keys, the SSH server of every clone generates its own.
+func (s *sealer) removeSSHHostKeys(result *SealAction, pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.Wrap(err, "invalid pattern")
+	}
+	for _, match := range matches {
+		info, err := os.Lstat(match)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if err := os.Remove(match); err != nil {
+			return err
+		}
+		result.Count = result.Count + 1
+		result.Bytes = result.Bytes + info.Size()
+	}
+	return nil
+}
+
+// truncateLogs truncates the log files, the files are kept for the services expecting them.
+func (s *sealer) truncateLogs(result *SealAction, directory string) error {
+	err := filepath.Walk(directory, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		if err := os.Truncate(path, 0); err != nil {
+			return err
+		}
+		result.Count = result.Count + 1
+		result.Bytes = result.Bytes + info.Size()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// fillWithZeros writes zeros to a file until the file system is full and removes the file,
+// the blocks freed by the earlier actions no longer hold their old contents.
+func (s *sealer) fillWithZeros(result *SealAction, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer file.Close()
+	zeros := make([]byte, sealZeroChunkBytes)
+	for {
+		written, err := file.Write(zeros)
+		result.Bytes = result.Bytes + int64(written)
+		if err != nil {
+			if errors.Is(err, unix.ENOSPC) {
+				break
+			}
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil && !errors.Is(err, unix.ENOSPC) {
+		return err
+	}
+	result.Count = 1
+	return nil
+}
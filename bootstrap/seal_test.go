@@ -0,0 +1,255 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// mustWriteRootfs writes the files relative to the root.
+func mustWriteRootfs(t *testing.T, root string, files map[string]string) {
+	for path, contents := range files {
+		fullPath := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal("expected directory, got error", err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(contents), 0644); err != nil {
+			t.Fatal("expected file, got error", err)
+		}
+	}
+}
+
+func TestSealerSealsRootfs(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(root)
+
+	mustWriteRootfs(t, root, map[string]string{
+		"etc/machine-id":                  "0123456789abcdef\n",
+		"etc/ssh/ssh_host_rsa_key":        "private",
+		"etc/ssh/ssh_host_rsa_key.pub":    "public",
+		"etc/ssh/sshd_config":             "Port 22\n",
+		"home/alpine/.ash_history":        "ls\n",
+		"tmp/build/artifact":              "1234",
+		"tmp/file":                        "12",
+		"var/cache/apt/archives/curl.deb": "deb",
+		"var/cache/apt/archives/lock":     "",
+		"var/lib/dbus/machine-id":         "0123456789abcdef\n",
+		"var/log/apt/history.log":         "installed\n",
+		"var/log/empty.log":               "",
+	})
+
+	actions := (&sealer{
+		logger: hclog.Default(),
+		paths:  (&mmds.MMDSBootstrap{}).SafeSealPaths(),
+		root:   root,
+	}).seal()
+
+	results := map[string]*SealAction{}
+	for _, action := range actions {
+		assert.Empty(t, action.Error, action.Action, action.Path)
+		results[action.Action+" "+action.Path] = action
+	}
+	assert.Equal(t, &SealAction{Action: SealActionClean, Path: "/tmp/*", Count: 2, Bytes: 6}, results["clean /tmp/*"])
+	assert.Equal(t, &SealAction{Action: SealActionClean, Path: "/var/cache/apt/archives/*.deb", Count: 1, Bytes: 3}, results["clean /var/cache/apt/archives/*.deb"])
+	assert.Equal(t, &SealAction{Action: SealActionClean, Path: "/home/*/.ash_history", Count: 1, Bytes: 3}, results["clean /home/*/.ash_history"])
+	assert.Equal(t, &SealAction{Action: SealActionResetMachineID, Path: sealMachineIDFile, Count: 2}, results["reset-machine-id /etc/machine-id"])
+	assert.Equal(t, &SealAction{Action: SealActionRemoveSSHHostKeys, Path: sealSSHHostKeys, Count: 2, Bytes: 13}, results["remove-ssh-host-keys /etc/ssh/ssh_host_*"])
+	assert.Equal(t, &SealAction{Action: SealActionTruncateLogs, Path: sealLogDirectory, Count: 1, Bytes: 10}, results["truncate-logs /var/log"])
+	_, ok := results["zero-free-space "+sealZeroFile]
+	assert.False(t, ok)
+
+	for path, expected := range map[string]bool{
+		"etc/machine-id":               true,
+		"etc/ssh/ssh_host_rsa_key":     false,
+		"etc/ssh/ssh_host_rsa_key.pub": false,
+		"etc/ssh/sshd_config":          true,
+		"home/alpine/.ash_history":     false,
+		"tmp":                          true,
+		"tmp/file":                     false,
+		"var/cache/apt/archives/lock":  true,
+		"var/lib/dbus/machine-id":      false,
+		"var/log/apt/history.log":      true,
+	} {
+		_, err := os.Stat(filepath.Join(root, path))
+		assert.Equal(t, expected, err == nil, path)
+	}
+	machineID, err := ioutil.ReadFile(filepath.Join(root, "etc/machine-id"))
+	assert.Nil(t, err)
+	assert.Empty(t, machineID)
+	log, err := ioutil.ReadFile(filepath.Join(root, "var/log/apt/history.log"))
+	assert.Nil(t, err)
+	assert.Empty(t, log)
+}
+
+func TestSealerZeroesFreeSpace(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(root)
+	mustSupportMounts(t, root)
+	if err := unix.Mount("tmpfs", root, "tmpfs", 0, "size=4m"); err != nil {
+		t.Fatal("expected tmpfs, got error", err)
+	}
+	defer unix.Unmount(root, unix.MNT_DETACH)
+
+	actions := (&sealer{logger: hclog.Default(), root: root, zeroFreeSpace: true}).seal()
+	zeroed := actions[len(actions)-1]
+	assert.Equal(t, SealActionZeroFreeSpace, zeroed.Action)
+	assert.Empty(t, zeroed.Error)
+	assert.Equal(t, int64(4*1024*1024), zeroed.Bytes)
+	_, err = os.Stat(filepath.Join(root, sealZeroFile))
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+// sealCheckingClient records if the rootfs was sealed when the build succeeded.
+type sealCheckingClient struct {
+	*recordingClient
+	sealedPath  string
+	sealedFirst bool
+}
+
+func (c *sealCheckingClient) Success() error {
+	_, err := os.Stat(c.sealedPath)
+	c.sealedFirst = os.IsNotExist(err)
+	return c.recordingClient.Success()
+}
+
+func TestBootstrapSealsBeforeSuccess(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	root := filepath.Join(tempDir, "rootfs")
+	reportPath := filepath.Join(root, "var/lib/vminit/bootstrap/report.json")
+	cachePath := filepath.Join(root, "var/lib/vminit/bootstrap/cache.json")
+	sealedReportPath := filepath.Join(tempDir, "run/report.json")
+	newBootstrapper := func(runner CommandRunner) *defaultBootstrapper {
+		bootstrapper := NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{Cache: "true", Seal: "true", SealPaths: "/tmp/*"}).
+			WithCommandRunner(runner).
+			WithCacheFile(cachePath).
+			WithBuildReportFile(reportPath).
+			WithSealedBuildReportFile(sealedReportPath).(*defaultBootstrapper)
+		bootstrapper.sealRoot = root
+		return bootstrapper
+	}
+
+	// a failed build is not sealed:
+	mustWriteRootfs(t, root, map[string]string{"tmp/file": "build"})
+	client := &recordingClient{commands: testCommands("one", "two")}
+	assert.NotNil(t, newBootstrapper(&failingCommandRunner{failOn: "two"}).execute(context.Background(), client))
+	_, err = os.Stat(filepath.Join(root, "tmp/file"))
+	assert.Nil(t, err)
+
+	_, err = os.Stat(reportPath)
+	assert.Nil(t, err)
+
+	// the rootfs is sealed before the server has the result:
+	sealing := &sealCheckingClient{recordingClient: &recordingClient{commands: testCommands("one", "two")}, sealedPath: filepath.Join(root, "tmp/file")}
+	assert.Nil(t, newBootstrapper(&failingCommandRunner{}).execute(context.Background(), sealing))
+	assert.True(t, sealing.succeeded)
+	assert.True(t, sealing.sealedFirst)
+
+	// the bootstrap state is removed and the report is written outside of the rootfs:
+	for _, path := range []string{reportPath, cachePath} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	report := &BuildReport{}
+	reportBytes, err := ioutil.ReadFile(sealedReportPath)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(reportBytes, report))
+	assert.Equal(t, []*SealAction{
+		{Action: SealActionClean, Path: "/tmp/*", Count: 1, Bytes: 5},
+		{Action: SealActionResetMachineID, Path: sealMachineIDFile},
+		{Action: SealActionRemoveSSHHostKeys, Path: sealSSHHostKeys},
+		{Action: SealActionTruncateLogs, Path: sealLogDirectory},
+	}, report.Seal)
+}
+
+func TestBootstrapRefusesSealingWithoutRoot(t *testing.T) {
+	runner := &failingCommandRunner{}
+	client := &recordingClient{commands: testCommands("one")}
+	bootstrapper := NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{Seal: "true"}).
+		WithCommandRunner(runner).(*defaultBootstrapper)
+	assert.NotNil(t, bootstrapper.execute(context.Background(), client))
+	assert.NotNil(t, client.aborted)
+	assert.False(t, client.succeeded)
+	assert.Empty(t, runner.executed)
+}
+
+func TestSealPatterns(t *testing.T) {
+	patterns, err := sealPatterns([]string{"/tmp/*", "/home/*/.ash_history", "/var/cache//apk/*/"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/tmp/*", "/home/*/.ash_history", "/var/cache/apk/*"}, patterns)
+
+	for _, pattern := range []string{"/*", "/", "/tmp", "/*/cache", "/t?p/*", "relative/*", "/tmp/../*", "/tmp/../etc/*", "/tmp/[", ""} {
+		_, err := sealPatterns([]string{pattern})
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func TestBootstrapFailsWhenSealingFails(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// /etc is a file, the machine ID can't be reset:
+	root := filepath.Join(tempDir, "rootfs")
+	mustWriteRootfs(t, root, map[string]string{"tmp/file": "build", "etc": "not a directory"})
+	sealedReportPath := filepath.Join(tempDir, "run/report.json")
+
+	client := &recordingClient{commands: testCommands("one")}
+	bootstrapper := NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{Seal: "true", SealPaths: "/tmp/*"}).
+		WithCommandRunner(&failingCommandRunner{}).
+		WithBuildReportFile(filepath.Join(root, "var/lib/vminit/bootstrap/report.json")).
+		WithSealedBuildReportFile(sealedReportPath).(*defaultBootstrapper)
+	bootstrapper.sealRoot = root
+	assert.NotNil(t, bootstrapper.execute(context.Background(), client))
+	assert.NotNil(t, client.aborted)
+	assert.False(t, client.succeeded)
+
+	// the other actions still run:
+	_, err = os.Stat(filepath.Join(root, "tmp/file"))
+	assert.True(t, os.IsNotExist(err))
+	report := &BuildReport{}
+	reportBytes, err := ioutil.ReadFile(sealedReportPath)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(reportBytes, report))
+	assert.Equal(t, BuildStatusFailed, report.Status)
+	assert.Equal(t, 4, len(report.Seal))
+	assert.NotEmpty(t, report.Seal[1].Error)
+}
+
+func TestBootstrapRefusesInvalidSealPaths(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	runner := &failingCommandRunner{}
+	client := &recordingClient{commands: testCommands("one")}
+	bootstrapper := NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{Seal: "true", SealPaths: "/tmp/*, /*"}).
+		WithCommandRunner(runner).
+		WithSealRoot(tempDir).(*defaultBootstrapper)
+	assert.NotNil(t, bootstrapper.execute(context.Background(), client))
+	assert.NotNil(t, client.aborted)
+	assert.False(t, client.succeeded)
+	assert.Empty(t, runner.executed)
+}
@@ -0,0 +1,248 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultSecretsDirectory is the directory the secrets are mounted in unless the target is given, the same as in Docker.
+	defaultSecretsDirectory = "/run/secrets"
+	// defaultSecretMode is the mode of a mounted secret unless the mode is given, the same as in Docker.
+	defaultSecretMode = fs.FileMode(0400)
+	// secretRedaction replaces the secret values in the command output.
+	secretRedaction = "[REDACTED]"
+)
+
+// SecretProvider is implemented by clients able to serve the build secrets, without it the secrets come from the bootstrap data only.
+type SecretProvider interface {
+	// Secret returns the secret with the ID, false if there is no such secret.
+	Secret(id string) ([]byte, bool, error)
+}
+
+// Secret serves the secrets of the bootstrap data,
+// the secrets not in the bootstrap data are served by the provider, if any.
+func (c *runClient) Secret(id string) ([]byte, bool, error) {
+	if value, ok := c.secrets[id]; ok {
+		return []byte(value), true, nil
+	}
+	if c.provider != nil {
+		return c.provider.Secret(id)
+	}
+	return nil, false, nil
+}
+
+// secretMount is a RUN --mount=type=secret flag.
+type secretMount struct {
+	id       string
+	target   string
+	required bool
+	mode     fs.FileMode
+	uid      int
+	gid      int
+}
+
+// parseSecretMounts returns the secret mounts of the RUN command, relative targets are in the workdir.
+func parseSecretMounts(cmd commands.Run) ([]*secretMount, error) {
+	mounts, err := parseRunMounts(cmd.OriginalCommand)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []*secretMount{}
+	for _, mount := range mounts {
+		if mount.Type != runMountTypeSecret {
+			continue
+		}
+		secret := &secretMount{mode: defaultSecretMode}
+		secret.id, _ = mount.option("id")
+		secret.target, _ = mount.option("target", "dst", "destination")
+		if secret.id == "" && secret.target == "" {
+			return nil, fmt.Errorf("secret mount requires an id or a target")
+		}
+		if secret.id == "" {
+			secret.id = filepath.Base(secret.target)
+		}
+		if secret.target == "" {
+			secret.target = filepath.Join(defaultSecretsDirectory, secret.id)
+		}
+		if !filepath.IsAbs(secret.target) {
+			secret.target = filepath.Join(cmd.Workdir.Value, secret.target)
+		}
+		secret.target = filepath.Clean(secret.target)
+		if value, ok := mount.option("required"); ok {
+			if secret.required, err = strconv.ParseBool(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid required flag of secret '%s'", secret.id)
+			}
+		}
+		if value, ok := mount.option("mode"); ok {
+			if secret.mode, err = fsutil.ParseOctalMode(value); err != nil {
+				return nil, errors.Wrapf(err, "invalid mode of secret '%s'", secret.id)
+			}
+		}
+		for _, owner := range []struct {
+			key   string
+			value *int
+		}{{"uid", &secret.uid}, {"gid", &secret.gid}} {
+			if value, ok := mount.option(owner.key); ok {
+				if *owner.value, err = strconv.Atoi(value); err != nil {
+					return nil, errors.Wrapf(err, "invalid %s of secret '%s'", owner.key, secret.id)
+				}
+			}
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// mountedSecrets are the secrets mounted for a single RUN command.
+// The secrets are written to a tmpfs and bind mounted read-only at their targets, they never reach the rootfs.
+type mountedSecrets struct {
+	logger hclog.Logger
+	// values are the mounted secret values, redacted from the output:
+	values []string
+
+	createdDirectories []string
+	createdFiles       []string
+	mountedTargets     []string
+	staging            string
+	stagingMounted     bool
+}
+
+// mountSecrets mounts the secrets of the RUN command, missing secrets fail the command only when required.
+func mountSecrets(logger hclog.Logger, cmd commands.Run, grpcClient rootfs.ClientProvider) (*mountedSecrets, error) {
+	mounted := &mountedSecrets{logger: logger}
+	secrets, err := parseSecretMounts(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return mounted, nil
+	}
+	provider, _ := grpcClient.(SecretProvider)
+
+	mounted.staging, err = ioutil.TempDir("", "firebuild-secrets-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating secrets directory")
+	}
+	if err := unix.Mount("tmpfs", mounted.staging, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0700"); err != nil {
+		mounted.cleanup()
+		return nil, errors.Wrap(err, "failed mounting secrets tmpfs")
+	}
+	mounted.stagingMounted = true
+
+	for index, secret := range secrets {
+		var value []byte
+		found := false
+		if provider != nil {
+			value, found, err = provider.Secret(secret.id)
+			if err != nil {
+				mounted.cleanup()
+				return nil, errors.Wrapf(err, "failed fetching secret '%s'", secret.id)
+			}
+		}
+		if !found {
+			if secret.required {
+				mounted.cleanup()
+				return nil, fmt.Errorf("required secret '%s' not found", secret.id)
+			}
+			logger.Debug("secret not found, not mounted", "id", secret.id)
+			continue
+		}
+		if err := mounted.mount(secret, value, filepath.Join(mounted.staging, strconv.Itoa(index))); err != nil {
+			mounted.cleanup()
+			return nil, errors.Wrapf(err, "failed mounting secret '%s'", secret.id)
+		}
+		mounted.values = append(mounted.values, string(value))
+		logger.Debug("secret mounted", "id", secret.id, "target", secret.target)
+	}
+	return mounted, nil
+}
+
+func (m *mountedSecrets) mount(secret *secretMount, value []byte, stagingFile string) error {
+	if err := ioutil.WriteFile(stagingFile, value, secret.mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(stagingFile, secret.mode); err != nil {
+		return err
+	}
+	if err := os.Chown(stagingFile, secret.uid, secret.gid); err != nil {
+		return err
+	}
+
+	// the bind mount needs an existing target, whatever is created for it is removed afterwards:
+	createdDirectories, err := createMountDirectories(filepath.Dir(secret.target))
+	m.createdDirectories = append(m.createdDirectories, createdDirectories...)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(secret.target); os.IsNotExist(err) {
+		placeholder, err := os.OpenFile(secret.target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+		if err != nil {
+			return err
+		}
+		placeholder.Close()
+		m.createdFiles = append(m.createdFiles, secret.target)
+	}
+
+	if err := unix.Mount(stagingFile, secret.target, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+	m.mountedTargets = append(m.mountedTargets, secret.target)
+	return unix.Mount("", secret.target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+}
+
+// cleanup unmounts the secrets and removes what was created for them.
+func (m *mountedSecrets) cleanup() {
+	for index := len(m.mountedTargets) - 1; index >= 0; index-- {
+		if err := unix.Unmount(m.mountedTargets[index], unix.MNT_DETACH); err != nil {
+			m.logger.Warn("failed unmounting secret", "target", m.mountedTargets[index], "reason", err)
+		}
+	}
+	for index := len(m.createdFiles) - 1; index >= 0; index-- {
+		if err := os.Remove(m.createdFiles[index]); err != nil {
+			m.logger.Warn("failed removing secret mount point", "target", m.createdFiles[index], "reason", err)
+		}
+	}
+	for index := len(m.createdDirectories) - 1; index >= 0; index-- {
+		// the command may have left something in the directory:
+		os.Remove(m.createdDirectories[index])
+	}
+	if m.stagingMounted {
+		if err := unix.Unmount(m.staging, unix.MNT_DETACH); err != nil {
+			m.logger.Warn("failed unmounting secrets tmpfs", "path", m.staging, "reason", err)
+		}
+	}
+	if m.staging != "" {
+		if err := os.Remove(m.staging); err != nil {
+			m.logger.Warn("failed removing secrets directory", "path", m.staging, "reason", err)
+		}
+	}
+	m.mountedTargets, m.createdFiles, m.createdDirectories = nil, nil, nil
+	m.staging, m.stagingMounted = "", false
+}
+
+// redactions returns the values redacted from the output, every line of a multi-line secret is redacted on its own.
+func (m *mountedSecrets) redactions() []string {
+	redactions := []string{}
+	for _, value := range m.values {
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if strings.TrimSpace(line) != "" {
+				redactions = append(redactions, line)
+			}
+		}
+	}
+	return redactions
+}
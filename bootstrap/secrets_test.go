@@ -0,0 +1,123 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// mustSupportMounts skips the test when the mounts can't be created.
+func mustSupportMounts(t *testing.T, directory string) {
+	if err := unix.Mount("tmpfs", directory, "tmpfs", 0, ""); err != nil {
+		t.Skip("mounts not supported", err)
+	}
+	unix.Unmount(directory, 0)
+}
+
+func TestParseSecretMounts(t *testing.T) {
+	cmd := commands.RunWithDefaults("cat /run/secrets/token")
+	cmd.OriginalCommand = "RUN --mount=type=secret,id=token --mount=type=cache,target=/cache --mount=type=secret,target=relative/key,required,mode=0440,uid=1000,gid=1000 cat /run/secrets/token"
+	cmd.Workdir = commands.Workdir{Value: "/app"}
+	secrets, err := parseSecretMounts(cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, []*secretMount{
+		{id: "token", target: "/run/secrets/token", mode: defaultSecretMode},
+		{id: "key", target: "/app/relative/key", required: true, mode: fs.FileMode(0440), uid: 1000, gid: 1000},
+	}, secrets)
+
+	for _, invalid := range []string{
+		"RUN --mount=type=secret echo",
+		"RUN --mount=type=secret,id=token,mode=rw echo",
+		"RUN --mount=type=secret,id=token,id=other echo",
+	} {
+		cmd.OriginalCommand = invalid
+		_, err := parseSecretMounts(cmd)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestShellCommandRunnerMountsSecrets(t *testing.T) {
+	runner := newTestShellCommandRunner(t)
+
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mustSupportMounts(t, tempDir)
+
+	target := filepath.Join(tempDir, "run/secrets/token")
+	secretCommand := func(flags, command string) commands.Run {
+		cmd := commands.RunWithDefaults(command)
+		cmd.OriginalCommand = fmt.Sprintf("RUN %s %s", flags, command)
+		return cmd
+	}
+	newClient := func() *runClient {
+		return &runClient{ClientProvider: &recordingClient{}, secrets: map[string]string{"token": "s3cr3t-value"}}
+	}
+
+	// the secret is readable while the command runs and redacted from the output:
+	client := newClient()
+	assert.Nil(t, runner.Execute(context.Background(), secretCommand("--mount=type=secret,id=token,target="+target,
+		fmt.Sprintf(`test "$(cat %s)" = s3cr3t-value && echo matched; cat %s; echo; stat -c %%a %s`, target, target, target)), client))
+	assert.Equal(t, []string{"matched", "[REDACTED]", "400"}, client.ClientProvider.(*recordingClient).stdout)
+
+	// nothing is left behind:
+	_, err = os.Stat(filepath.Join(tempDir, "run"))
+	assert.True(t, os.IsNotExist(err), err)
+
+	// the secret is read-only:
+	client = newClient()
+	assert.NotNil(t, runner.Execute(context.Background(), secretCommand("--mount=type=secret,id=token,target="+target, "echo overwritten > "+target), client))
+	_, err = os.Stat(filepath.Join(tempDir, "run"))
+	assert.True(t, os.IsNotExist(err), err)
+
+	// a missing secret fails the command only when required:
+	assert.Nil(t, runner.Execute(context.Background(), secretCommand("--mount=type=secret,id=missing", "true"), newClient()))
+	assert.NotNil(t, runner.Execute(context.Background(), secretCommand("--mount=type=secret,id=missing,required=true", "true"), newClient()))
+}
+
+// secretReadingRunner reads the secret of the command ID from the client.
+type secretReadingRunner struct {
+	values []string
+}
+
+func (r *secretReadingRunner) Execute(ctx context.Context, cmd commands.Run, grpcClient rootfs.ClientProvider) error {
+	value, found, err := grpcClient.(SecretProvider).Secret(cmd.Command)
+	if err != nil {
+		return err
+	}
+	r.values = append(r.values, fmt.Sprintf("%s:%t", string(value), found))
+	return nil
+}
+
+// serverSecretsClient serves the secrets from the server.
+type serverSecretsClient struct {
+	*recordingClient
+}
+
+func (c *serverSecretsClient) Secret(id string) ([]byte, bool, error) {
+	if id == "server" {
+		return []byte("from-server"), true, nil
+	}
+	return nil, false, nil
+}
+
+func TestBootstrapServesSecrets(t *testing.T) {
+	runner := &secretReadingRunner{}
+	assert.Nil(t, NewDefaultBoostrapper(hclog.Default(), &mmds.MMDSBootstrap{Secrets: map[string]string{"mmds": "from-mmds"}}).
+		WithCommandRunner(runner).(*defaultBootstrapper).
+		execute(context.Background(), &serverSecretsClient{recordingClient: &recordingClient{commands: testCommands("mmds", "server", "missing")}}))
+	assert.Equal(t, []string{"from-mmds:true", "from-server:true", ":false"}, runner.values)
+}
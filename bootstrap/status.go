@@ -0,0 +1,57 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/pkg/errors"
+)
+
+// StatusLinePrefix starts the StdOut lines carrying the build status instead of the command output.
+// The prefix is followed by the status kind, a space and the JSON status.
+// A command output line starting with the prefix is sent with another leading #.
+const StatusLinePrefix = "#vminit:"
+
+// Status kinds.
+const (
+	// StatusKindProgress is the Progress sent with every heartbeat.
+	StatusKindProgress = "progress"
+	// StatusKindResume is the Resume sent before the first command when the bootstrap resumes from a checkpoint.
+	StatusKindResume = "resume"
+	// StatusKindManifest is the StepManifest sent after every step when the manifest paths are configured.
+	StatusKindManifest = "manifest"
+	// StatusKindCache is the CacheResult sent for every step when the build cache is enabled.
+	StatusKindCache = "cache"
+	// StatusKindCacheMounts lists the CacheMountStats of the RUN --mount=type=cache directories when the build finishes.
+	StatusKindCacheMounts = "cache-mounts"
+)
+
+// ParseStatusLine returns the kind and the JSON status of a status line, false if the line is command output.
+func ParseStatusLine(line string) (string, []byte, bool) {
+	if !strings.HasPrefix(line, StatusLinePrefix) {
+		return "", nil, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(line, StatusLinePrefix), " ", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	return parts[0], []byte(parts[1]), true
+}
+
+// sendStatus sends the status to the server as a StdOut status line.
+func sendStatus(client rootfs.ClientProvider, kind string, status interface{}) error {
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrapf(err, "failed serializing %s status", kind)
+	}
+	return client.StdOut([]string{StatusLinePrefix + kind + " " + string(statusBytes)})
+}
+
+// escapeOutputLine keeps a command output line from being taken for a status line.
+func escapeOutputLine(line string) string {
+	if strings.HasPrefix(line, StatusLinePrefix) {
+		return "#" + line
+	}
+	return line
+}
@@ -0,0 +1,79 @@
+package bootstrap
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/combust-labs/firebuild-mmds/passwd"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPasswdFile = "/etc/passwd"
+	defaultGroupFile  = "/etc/group"
+	defaultHome       = "/"
+)
+
+// execUser is a USER resolved against the users and groups database.
+type execUser struct {
+	Uid    int
+	Gid    int
+	Groups []int
+	Home   string
+}
+
+// resolveExecUser resolves the value of the USER instruction in the user[:group] form
+// the way Docker does it: a user not found in the database must be numeric and runs
+// with the root group and / as home, supplementary groups are only added when no group is given.
+func resolveExecUser(db *passwd.Database, userValue string) (*execUser, error) {
+	userPart, groupPart := userValue, ""
+	if idx := strings.Index(userValue, ":"); idx > -1 {
+		userPart, groupPart = userValue[0:idx], userValue[idx+1:]
+	}
+	if userPart == "" {
+		return nil, errors.Errorf("invalid user: '%s'", userValue)
+	}
+
+	resolved := &execUser{Uid: -1, Gid: 0, Groups: []int{}, Home: defaultHome}
+
+	userEntry, lookupErr := db.LookupUser(userPart)
+	if lookupErr != nil {
+		uid, err := strconv.Atoi(userPart)
+		if err != nil {
+			return nil, errors.Wrapf(lookupErr, "user '%s' not found in the passwd database", userPart)
+		}
+		if uid < 0 {
+			return nil, errors.Errorf("invalid uid: '%s'", userPart)
+		}
+		resolved.Uid = uid
+	} else {
+		resolved.Uid = userEntry.Uid
+		resolved.Gid = userEntry.Gid
+		if userEntry.Home != "" {
+			resolved.Home = userEntry.Home
+		}
+	}
+
+	if groupPart == "" {
+		if userEntry != nil {
+			resolved.Groups = db.SupplementaryGroups(userEntry.Name)
+		}
+		return resolved, nil
+	}
+
+	groupEntry, lookupErr := db.LookupGroup(groupPart)
+	if lookupErr != nil {
+		gid, err := strconv.Atoi(groupPart)
+		if err != nil {
+			return nil, errors.Wrapf(lookupErr, "group '%s' not found in the group database", groupPart)
+		}
+		if gid < 0 {
+			return nil, errors.Errorf("invalid gid: '%s'", groupPart)
+		}
+		resolved.Gid = gid
+	} else {
+		resolved.Gid = groupEntry.Gid
+	}
+
+	return resolved, nil
+}
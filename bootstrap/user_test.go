@@ -0,0 +1,127 @@
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/passwd"
+	"github.com/combust-labs/firebuild-shared/build/commands"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/sh
+app:x:1000:1000::/home/app:/bin/sh
+`
+
+const testGroup = `root:x:0:
+app:x:1000:
+docker:x:998:app
+wheel:x:10:app
+`
+
+func mustWriteTestDatabase(t *testing.T, dir string) (string, string) {
+	passwdFile := filepath.Join(dir, "etc/passwd")
+	groupFile := filepath.Join(dir, "etc/group")
+	rootfs.MustPutTestResource(t, passwdFile, []byte(testPasswd))
+	rootfs.MustPutTestResource(t, groupFile, []byte(testGroup))
+	return passwdFile, groupFile
+}
+
+func TestResolveExecUser(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := passwd.NewDatabaseFromFiles(mustWriteTestDatabase(t, tempDir))
+	if err != nil {
+		t.Fatal("expected database, got error", err)
+	}
+
+	user, err := resolveExecUser(db, "app")
+	assert.Nil(t, err)
+	assert.Equal(t, &execUser{Uid: 1000, Gid: 1000, Groups: []int{998, 10}, Home: "/home/app"}, user)
+
+	user, err = resolveExecUser(db, "1000")
+	assert.Nil(t, err)
+	assert.Equal(t, &execUser{Uid: 1000, Gid: 1000, Groups: []int{998, 10}, Home: "/home/app"}, user)
+
+	// explicit group, no supplementary groups:
+	user, err = resolveExecUser(db, "app:docker")
+	assert.Nil(t, err)
+	assert.Equal(t, &execUser{Uid: 1000, Gid: 998, Groups: []int{}, Home: "/home/app"}, user)
+
+	// numeric user not in the database runs with the root group:
+	user, err = resolveExecUser(db, "2000")
+	assert.Nil(t, err)
+	assert.Equal(t, &execUser{Uid: 2000, Gid: 0, Groups: []int{}, Home: "/"}, user)
+
+	user, err = resolveExecUser(db, "2000:3000")
+	assert.Nil(t, err)
+	assert.Equal(t, &execUser{Uid: 2000, Gid: 3000, Groups: []int{}, Home: "/"}, user)
+
+	user, err = resolveExecUser(db, commands.DefaultUser().Value)
+	assert.Nil(t, err)
+	assert.Equal(t, &execUser{Uid: 0, Gid: 0, Groups: []int{}, Home: "/root"}, user)
+
+	_, err = resolveExecUser(db, "unknown")
+	assert.NotNil(t, err)
+	_, err = resolveExecUser(db, "app:unknown")
+	assert.NotNil(t, err)
+	_, err = resolveExecUser(db, ":app")
+	assert.NotNil(t, err)
+}
+
+func TestShellCommandRunnerUser(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	passwdFile, groupFile := mustWriteTestDatabase(t, tempDir)
+	runner := &shellCommandRunner{
+		defaultUser: commands.DefaultUser(),
+		groupFile:   groupFile,
+		logger:      hclog.Default(),
+		passwdFile:  passwdFile,
+	}
+
+	// an unknown user fails before anything is executed:
+	unknownUserCommand := commands.RunWithDefaults("exit 0")
+	unknownUserCommand.User = commands.User{Value: "unknown"}
+	assert.NotNil(t, runner.Execute(context.Background(), unknownUserCommand, &recordingClient{}))
+
+	if os.Getuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+
+	// the runner exports the vminit environment, keep it minimal:
+
+	outputDir := filepath.Join(tempDir, "output")
+	if err := os.Mkdir(outputDir, 0777); err != nil {
+		t.Fatal("expected output directory, got error", err)
+	}
+	for _, dir := range []string{tempDir, outputDir} {
+		if err := os.Chmod(dir, 0777); err != nil {
+			t.Fatal("expected directory mode, got error", err)
+		}
+	}
+	outputFile := filepath.Join(outputDir, "id")
+
+	runCommand := commands.RunWithDefaults("echo $(id -u):$(id -g):$(id -G):${HOME} > " + outputFile)
+	runCommand.User = commands.User{Value: "app"}
+	client := &recordingClient{}
+	assert.Nil(t, runner.Execute(context.Background(), runCommand, client), client.stderr)
+
+	output, err := ioutil.ReadFile(outputFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "1000:1000:1000 10 998:/home/app", strings.TrimSpace(string(output)))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/combust-labs/firebuild-mmds/bootstrap"
+	"github.com/combust-labs/firebuild-mmds/configs"
+	"github.com/spf13/cobra"
+)
+
+var bootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: "Executes the bootstrap sequence of a local build plan without the rootfs server",
+	Long:  ``,
+	Run:   runBootstrap,
+}
+
+type bootstrapCommandConfig struct {
+	CacheDrive          string
+	OutputDirectory     string
+	PathImageConfigFile string
+	Plan                string
+	SealRoot            string
+}
+
+var (
+	bootstrapConfig = new(bootstrapCommandConfig)
+	bootstrapLogCfg = configs.NewLogginConfig()
+)
+
+func initBootstrapFlags() {
+	bootstrapCmd.Flags().StringVar(&bootstrapConfig.CacheDrive, "cache-drive", "", "Path to the block device or the directory holding the RUN --mount=type=cache directories, the caches last for a single build when empty")
+	bootstrapCmd.Flags().StringVar(&bootstrapConfig.OutputDirectory, "output-directory", "", "Path to the directory where the command output and the build result are written, defaults to the plan directory or the directory of the plan archive")
+	bootstrapCmd.Flags().StringVar(&bootstrapConfig.PathImageConfigFile, "path-image-config-file", defaultPathImageConfigFile, "Path to the file the final image config is written to")
+	bootstrapCmd.Flags().StringVar(&bootstrapConfig.Plan, "plan", "", "Path to the build plan directory or tar archive")
+	bootstrapCmd.Flags().StringVar(&bootstrapConfig.SealRoot, "seal-root", "", "Path to the root of the built rootfs sealed after a successful build, a plan with Seal is refused when empty")
+	bootstrapCmd.Flags().AddFlagSet(bootstrapLogCfg.FlagSet())
+}
+
+func init() {
+	initBootstrapFlags()
+	rootCmd.AddCommand(bootstrapCmd)
+}
+
+func runBootstrap(cobraCommand *cobra.Command, _ []string) {
+	os.Exit(processBootstrapCommand())
+}
+
+func processBootstrapCommand() int {
+
+	if bootstrapConfig.Plan == "" {
+		fmt.Fprintln(os.Stderr, "--plan is required")
+		return 1
+	}
+
+	rootLogger := bootstrapLogCfg.NewLogger("vminit")
+
+	client, err := bootstrap.NewPlanClient(rootLogger.Named("plan-client"), bootstrapConfig.Plan, bootstrapConfig.OutputDirectory)
+	if err != nil {
+		rootLogger.Error("failed loading build plan", "plan", bootstrapConfig.Plan, "reason", err)
+		return 1
+	}
+	defer client.Close()
+
+	// the plan runs on this machine, its file system is sealed only when explicitly requested:
+	if client.Bootstrap().SafeSeal() && bootstrapConfig.SealRoot == "" {
+		rootLogger.Error("the build plan seals the rootfs, --seal-root is required")
+		return 1
+	}
+
+	bootstrapper := bootstrap.
+		NewDefaultBoostrapper(rootLogger.Named("bootstrap"), client.Bootstrap()).
+		WithCommandRunner(bootstrap.NewShellCommandRunnerWithPTY(rootLogger.Named("shell-runner"), bootstrap.NewPTYConfig(client.Bootstrap()))).
+		WithResourceDeployer(bootstrap.NewExecutingResourceDeployer(rootLogger.Named("executing-deployer"))).
+		WithCacheDrive(bootstrapConfig.CacheDrive).
+		WithImageConfigFile(bootstrapConfig.PathImageConfigFile).
+		WithBuildReportFile(filepath.Join(client.OutputDirectory(), bootstrap.PlanReportFile)).
+		WithSealRoot(bootstrapConfig.SealRoot)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := bootstrapper.ExecuteWithClient(ctx, client); err != nil {
+		rootLogger.Error("bootstrap failed", "reason", err)
+		return 2
+	}
+	return 0
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/combust-labs/firebuild-mmds/bootstrap"
 	"github.com/combust-labs/firebuild-mmds/configs"
 	"github.com/combust-labs/firebuild-mmds/injectors"
 	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-mmds/state"
+	"github.com/hashicorp/go-hclog"
 	"github.com/spf13/cobra"
 )
 
@@ -20,14 +27,38 @@ var defaultHosts = map[string]string{
 	"ff02::2":   "ip6-allrouters",
 }
 
+var defaultSysctlDenylist = []string{
+	"fs.binfmt_misc.*",
+	"kernel.core_pattern",
+	"kernel.hotplug",
+	"kernel.modprobe",
+	"kernel.poweroff_cmd",
+	"kernel.usermodehelper.*",
+}
+
+// Bootstrap files in the state directory.
+const (
+	bootstrapCacheFile      = "bootstrap/cache.json"
+	bootstrapCheckpointFile = "bootstrap/checkpoint.json"
+	bootstrapReportFile     = "bootstrap/report.json"
+)
+
 const (
 	defaultGuestMMDSIP                   = "169.254.169.254"
 	defaultMetadataPath                  = "latest/meta-data"
 	defaultPathAuthorizedKeysPatternFile = "/home/%s/.ssh/authorized_keys"
+	defaultPathBootIDFile                = "/proc/sys/kernel/random/boot_id"
 	defaultPathEntrypointRunnerFile      = "/usr/bin/firebuild-entrypoint.sh"
 	defaultPathEnvFile                   = "/etc/profile.d/run-env.sh"
 	defaultPathHostnameFile              = "/etc/hostname"
 	defaultPathHostsFile                 = "/etc/hosts"
+	defaultPathImageConfigFile           = "/etc/firebuild/image-config.json"
+	defaultPathPartUUIDDirectory         = "/dev/disk/by-partuuid"
+	defaultPathProcSys                   = "/proc/sys"
+	defaultPathRoot                      = "/"
+	defaultPathRunDirectory              = "/run/vminit"
+	defaultPathStateDirectory            = "/var/lib/vminit"
+	defaultPathSysctlFile                = "/etc/sysctl.d/99-firebuild.conf"
 )
 
 var rootCmd = &cobra.Command{
@@ -42,10 +73,20 @@ type commandConfig struct {
 	MetadataPath string
 
 	PathAuthorizedKeysPatternFile string
+	PathBootIDFile                string
 	PathEntrypointRunnerFile      string
 	PathEnvFile                   string
 	PathHostnameFile              string
 	PathHostsFile                 string
+	PathImageConfigFile           string
+	PathPartUUIDDirectory         string
+	PathProcSys                   string
+	PathRoot                      string
+	PathRunDirectory              string
+	PathStateDirectory            string
+	PathSysctlFile                string
+
+	SysctlDenylist []string
 
 	PrintFlags bool
 }
@@ -60,10 +101,20 @@ func initFlags() {
 	rootCmd.Flags().StringVar(&config.MetadataPath, "metadata-path", defaultMetadataPath, "Path to the metadata root")
 
 	rootCmd.Flags().StringVar(&config.PathAuthorizedKeysPatternFile, "path-authorized-keys-pattern", defaultPathAuthorizedKeysPatternFile, "Path to the metadata root")
+	rootCmd.Flags().StringVar(&config.PathBootIDFile, "path-boot-id-file", defaultPathBootIDFile, "Path to the file containing the kernel boot ID")
 	rootCmd.Flags().StringVar(&config.PathEntrypointRunnerFile, "path-entrypoint-runner-file", defaultPathEntrypointRunnerFile, "Path to the entrypoint runner executable")
 	rootCmd.Flags().StringVar(&config.PathEnvFile, "path-env-file", defaultPathEnvFile, "Path to the metadata root")
 	rootCmd.Flags().StringVar(&config.PathHostnameFile, "path-hostname-file", defaultPathHostnameFile, "Path to the metadata root")
 	rootCmd.Flags().StringVar(&config.PathHostsFile, "path-hosts-file", defaultPathHostsFile, "Path to the metadata root")
+	rootCmd.Flags().StringVar(&config.PathImageConfigFile, "path-image-config-file", defaultPathImageConfigFile, "Path to the image config written by the bootstrap, the entrypoint falls back to it")
+	rootCmd.Flags().StringVar(&config.PathPartUUIDDirectory, "path-partuuid-directory", defaultPathPartUUIDDirectory, "Path to the directory linking the partition UUIDs to the block devices, used to find the drives with a PartUUID")
+	rootCmd.Flags().StringVar(&config.PathProcSys, "path-proc-sys", defaultPathProcSys, "Path to the /proc/sys tree used to apply sysctls")
+	rootCmd.Flags().StringVar(&config.PathRoot, "path-root", defaultPathRoot, "Path to the root directory under which metadata files are written")
+	rootCmd.Flags().StringVar(&config.PathRunDirectory, "path-run-directory", defaultPathRunDirectory, "Path to the directory where vminit keeps the files which must not stay in a sealed rootfs")
+	rootCmd.Flags().StringVar(&config.PathStateDirectory, "path-state-directory", defaultPathStateDirectory, "Path to the directory where vminit keeps its state")
+	rootCmd.Flags().StringVar(&config.PathSysctlFile, "path-sysctl-file", defaultPathSysctlFile, "Path to the managed sysctl drop-in file")
+
+	rootCmd.Flags().StringSliceVar(&config.SysctlDenylist, "sysctl-denylist", defaultSysctlDenylist, "Sysctl key patterns which are never applied from the metadata")
 
 	rootCmd.Flags().BoolVar(&config.PrintFlags, "print-flags", false, "If set, prints the flag per line only in the format '--flag value' (unquoted); useful for fetching configuration defaults")
 
@@ -84,10 +135,19 @@ func processCommand() int {
 		fmt.Println("--guest-mmds-ip " + config.MMDSIP)
 		fmt.Println("--metadata-path " + config.MetadataPath)
 		fmt.Println("--path-authorized-keys-pattern " + config.PathAuthorizedKeysPatternFile)
+		fmt.Println("--path-boot-id-file " + config.PathBootIDFile)
 		fmt.Println("--path-entrypoint-runner-file " + config.PathEntrypointRunnerFile)
 		fmt.Println("--path-env-file " + config.PathEnvFile)
 		fmt.Println("--path-hostname-file " + config.PathHostnameFile)
 		fmt.Println("--path-hosts-file " + config.PathHostsFile)
+		fmt.Println("--path-image-config-file " + config.PathImageConfigFile)
+		fmt.Println("--path-partuuid-directory " + config.PathPartUUIDDirectory)
+		fmt.Println("--path-proc-sys " + config.PathProcSys)
+		fmt.Println("--path-root " + config.PathRoot)
+		fmt.Println("--path-run-directory " + config.PathRunDirectory)
+		fmt.Println("--path-state-directory " + config.PathStateDirectory)
+		fmt.Println("--path-sysctl-file " + config.PathSysctlFile)
+		fmt.Println("--sysctl-denylist " + strings.Join(config.SysctlDenylist, ","))
 		return 0
 	}
 
@@ -101,40 +161,155 @@ func processCommand() int {
 
 	if mmdsData.Bootstrap != nil {
 		// server is in the bootstrap mode:
+		cacheDrive := ""
+		if mmdsData.Bootstrap.CacheDrive != "" {
+			cacheDrive, err = mmdsData.DriveDevice(mmdsData.Bootstrap.CacheDrive, config.PathPartUUIDDirectory)
+			if err != nil {
+				rootLogger.Error("cache drive not found", "drive-id", mmdsData.Bootstrap.CacheDrive, "reason", err)
+				return 2
+			}
+		}
 		bootstrapper := bootstrap.
 			NewDefaultBoostrapper(rootLogger.Named("bootstrap"), mmdsData.Bootstrap).
-			WithCommandRunner(bootstrap.NewShellCommandRunner(rootLogger.Named("shell-runner"))).
-			WithResourceDeployer(bootstrap.NewExecutingResourceDeployer(rootLogger.Named("executing-deployer")))
-		// TODO: needs properly executing resource deployer
-		if err := bootstrapper.Execute(); err != nil {
+			WithCommandRunner(bootstrap.NewShellCommandRunnerWithPTY(rootLogger.Named("shell-runner"), bootstrap.NewPTYConfig(mmdsData.Bootstrap))).
+			WithResourceDeployer(bootstrap.NewExecutingResourceDeployer(rootLogger.Named("executing-deployer"))).
+			WithCacheFile(filepath.Join(config.PathStateDirectory, bootstrapCacheFile)).
+			WithCacheDrive(cacheDrive).
+			WithCheckpointFile(filepath.Join(config.PathStateDirectory, bootstrapCheckpointFile)).
+			WithImageConfigFile(config.PathImageConfigFile).
+			WithBuildReportFile(filepath.Join(config.PathStateDirectory, bootstrapReportFile)).
+			WithSealedBuildReportFile(filepath.Join(config.PathRunDirectory, bootstrapReportFile)).
+			WithSealRoot(config.PathRoot)
+		// a terminated vminit aborts the build and stops the running command:
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := bootstrapper.ExecuteContext(ctx); err != nil {
 			rootLogger.Error("bootstrap failed", "reason", err)
 			return 2
 		}
 		return 0
 	}
 
-	if err := injectors.InjectSSHKeys(rootLogger, mmdsData, config.PathAuthorizedKeysPatternFile); err != nil {
+	bootID, err := state.ReadBootID(config.PathBootIDFile)
+	if err != nil {
+		rootLogger.Warn("failed reading boot ID", "boot-id-file", config.PathBootIDFile, "reason", err)
+	}
+
+	// the state is best effort, without it the injectors still run but nothing is recorded:
+	store := state.NewStore(config.PathStateDirectory)
+	instanceDirectory := ""
+	var instance *state.InstanceState
+	if metadataHash, err := state.MetadataHash(mmdsData); err != nil {
+		rootLogger.Warn("failed hashing metadata, instance state not recorded", "reason", err)
+	} else if beganInstance, change, err := store.Begin(mmdsData.VMMID, bootID, metadataHash); err != nil {
+		rootLogger.Warn("failed recording instance state", "vmm-id", mmdsData.VMMID, "reason", err)
+	} else {
+		instance = beganInstance
+		instanceDirectory = store.InstanceDirectory(mmdsData.VMMID)
+		rootLogger.Info("instance state",
+			"vmm-id", mmdsData.VMMID,
+			"previous-vmm-id", change.PreviousVMMID,
+			"new-instance", change.IsNewInstance,
+			"first-boot", change.IsFirstBoot,
+			"new-boot", change.IsNewBoot,
+			"metadata-changed", change.MetadataChanged)
+	}
+
+	exitCode := runInjectors(rootLogger, mmdsData, instance, instanceDirectory, bootID)
+
+	if instance != nil {
+		instance.Finish(exitCode)
+		if err := store.Save(instance); err != nil {
+			rootLogger.Warn("failed saving instance state", "vmm-id", instance.VMMID, "reason", err)
+		}
+	}
+
+	return exitCode
+}
+
+func runInjectors(rootLogger hclog.Logger, mmdsData *mmds.MMDSData, instance *state.InstanceState, instanceDirectory, bootID string) int {
+
+	if err := instance.Record("ssh-keys", func() error {
+		return injectors.InjectSSHKeys(rootLogger, mmdsData, config.PathAuthorizedKeysPatternFile)
+	}); err != nil {
 		rootLogger.Error("error injecting ssh keys from MMDS data", "reason", err.Error())
 		return 3
 	}
 
-	if err := injectors.InjectEnvironment(rootLogger, mmdsData, config.PathEnvFile); err != nil {
+	if err := instance.Record("environment", func() error {
+		return injectors.InjectEnvironment(rootLogger, mmdsData, config.PathEnvFile)
+	}); err != nil {
 		rootLogger.Error("error injecting environment from MMDS data", "reason", err.Error())
 		return 3
 	}
 
-	if err := injectors.InjectHostname(rootLogger, mmdsData, config.PathHostnameFile); err != nil {
+	if err := instance.Record("hostname", func() error {
+		return injectors.InjectHostname(rootLogger, mmdsData, config.PathHostnameFile)
+	}); err != nil {
 		rootLogger.Error("error injecting local hostname from MMDS data", "reason", err.Error())
 		return 3
 	}
 
-	if err := injectors.InjectHosts(rootLogger, mmdsData, defaultHosts, config.PathHostsFile); err != nil {
+	if err := instance.Record("hosts", func() error {
+		return injectors.InjectHosts(rootLogger, mmdsData, defaultHosts, config.PathHostsFile)
+	}); err != nil {
 		rootLogger.Error("error injecting hosts from MMDS data", "reason", err.Error())
 		return 3
 	}
 
-	if err := injectors.InjectEntrypoint(rootLogger, mmdsData, config.PathEntrypointRunnerFile, config.PathEnvFile); err != nil {
-		rootLogger.Error("error injecting hosts from MMDS data", "reason", err.Error())
+	if err := instance.Record("sysctls", func() error {
+		return injectors.InjectSysctls(rootLogger, mmdsData, config.PathSysctlFile, config.PathProcSys, config.SysctlDenylist)
+	}); err != nil {
+		rootLogger.Error("error injecting sysctls from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("files", func() error {
+		return injectors.InjectFiles(rootLogger, mmdsData, config.PathRoot)
+	}); err != nil {
+		rootLogger.Error("error injecting files from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("trusted-cas", func() error {
+		return injectors.InjectTrustedCAs(rootLogger, mmdsData, config.PathRoot)
+	}); err != nil {
+		rootLogger.Error("error injecting trusted CAs from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("timezone", func() error {
+		return injectors.InjectTimezone(rootLogger, mmdsData, config.PathRoot)
+	}); err != nil {
+		rootLogger.Error("error injecting timezone from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("locale", func() error {
+		return injectors.InjectLocale(rootLogger, mmdsData, config.PathRoot)
+	}); err != nil {
+		rootLogger.Error("error injecting locale from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("ntp-servers", func() error {
+		return injectors.InjectNTPServers(rootLogger, mmdsData, config.PathRoot)
+	}); err != nil {
+		rootLogger.Error("error injecting NTP servers from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("entrypoint", func() error {
+		return injectors.InjectEntrypoint(rootLogger, mmdsData, config.PathEntrypointRunnerFile, config.PathEnvFile, config.PathImageConfigFile)
+	}); err != nil {
+		rootLogger.Error("error injecting entrypoint from MMDS data", "reason", err.Error())
+		return 3
+	}
+
+	if err := instance.Record("scripts", func() error {
+		return injectors.RunScripts(rootLogger, mmdsData, instanceDirectory, bootID)
+	}); err != nil {
+		rootLogger.Error("error running scripts from MMDS data", "reason", err.Error())
 		return 3
 	}
 
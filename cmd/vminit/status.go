@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/state"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Reports the recorded vminit state of the instance",
+	Long:  ``,
+	Run:   runStatus,
+}
+
+type statusCommandConfig struct {
+	JSON               bool
+	PathStateDirectory string
+	VMMID              string
+}
+
+var statusConfig = new(statusCommandConfig)
+
+func initStatusFlags() {
+	statusCmd.Flags().BoolVar(&statusConfig.JSON, "json", false, "If set, prints the instance state as JSON")
+	statusCmd.Flags().StringVar(&statusConfig.PathStateDirectory, "path-state-directory", defaultPathStateDirectory, "Path to the directory where vminit keeps its state")
+	statusCmd.Flags().StringVar(&statusConfig.VMMID, "vmm-id", "", "VMMID of the instance to report, defaults to the instance vminit ran for the last time")
+}
+
+func init() {
+	initStatusFlags()
+	rootCmd.AddCommand(statusCmd)
+}
+
+func runStatus(cobraCommand *cobra.Command, _ []string) {
+	os.Exit(processStatusCommand())
+}
+
+func processStatusCommand() int {
+
+	store := state.NewStore(statusConfig.PathStateDirectory)
+
+	vmmID := statusConfig.VMMID
+	if vmmID == "" {
+		currentVMMID, err := store.CurrentInstance()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed reading current instance:", err)
+			return 1
+		}
+		if currentVMMID == "" {
+			fmt.Fprintln(os.Stderr, "no instance state recorded in", statusConfig.PathStateDirectory)
+			return 1
+		}
+		vmmID = currentVMMID
+	}
+
+	instance, err := store.Load(vmmID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed loading instance state:", err)
+		return 1
+	}
+
+	if statusConfig.JSON {
+		jsonBytes, err := json.MarshalIndent(instance, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed serializing instance state:", err)
+			return 1
+		}
+		fmt.Println(string(jsonBytes))
+		return 0
+	}
+
+	fmt.Println("Instance:      " + instance.VMMID)
+	fmt.Println("Metadata hash: " + instance.MetadataHash)
+	fmt.Println("First seen:    " + instance.FirstSeenAt.Format(time.RFC3339))
+	fmt.Println("Runs:         ", len(instance.Runs))
+
+	run := instance.CurrentRun()
+	if run == nil {
+		return 0
+	}
+
+	fmt.Println()
+	fmt.Println("Last run:")
+	fmt.Println("  Boot ID:     " + run.BootID)
+	fmt.Println("  Started:     " + run.StartedAt.Format(time.RFC3339))
+	if run.FinishedAt != nil {
+		fmt.Println("  Finished:    " + run.FinishedAt.Format(time.RFC3339))
+	}
+	if run.ExitCode != nil {
+		fmt.Println("  Exit code:  ", *run.ExitCode)
+	}
+	for _, result := range run.Injectors {
+		line := fmt.Sprintf("  %-14s %-8s %s", result.Name, result.Status, result.FinishedAt.Sub(result.StartedAt))
+		if result.Error != "" {
+			line = line + ": " + result.Error
+		}
+		fmt.Println(line)
+	}
+
+	return 0
+}
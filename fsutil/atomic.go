@@ -0,0 +1,100 @@
+// Package fsutil contains the file system helpers shared by the injectors, the bootstrap and the instance state.
+package fsutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteFileAtomically writes data to a temporary file next to the target
+// and renames it over the target so readers never observe a partial file.
+func WriteFileAtomically(path string, data []byte, mode fs.FileMode) error {
+	return WriteFileAtomicallyWithOwner(path, data, mode, -1, -1)
+}
+
+// WriteFileAtomicallyWithOwner behaves like WriteFileAtomically but chowns the file before renaming it.
+// A uid or a gid of -1 is not changed.
+func WriteFileAtomicallyWithOwner(path string, data []byte, mode fs.FileMode, uid, gid int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { // the default permission for this directory
+		return errors.Wrap(err, "failed creating parent directory")
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return errors.Wrap(err, "failed creating temporary file")
+	}
+	tempFileName := tempFile.Name()
+	cleanup := func() {
+		tempFile.Close()
+		os.Remove(tempFileName)
+	}
+	written, err := tempFile.Write(data)
+	if err != nil {
+		cleanup()
+		return errors.Wrap(err, "failed writing temporary file")
+	}
+	if written != len(data) {
+		cleanup()
+		return errors.New("temporary file write failed: written != length")
+	}
+	// chown before chmod, chown clears the setuid and setgid bits:
+	if uid > -1 || gid > -1 {
+		if err := tempFile.Chown(uid, gid); err != nil {
+			cleanup()
+			return errors.Wrap(err, "failed chown temporary file")
+		}
+	}
+	// the temporary file is created with 0600, umask does not apply to chmod:
+	if err := tempFile.Chmod(mode); err != nil {
+		cleanup()
+		return errors.Wrap(err, "failed chmod temporary file")
+	}
+	if err := tempFile.Sync(); err != nil {
+		cleanup()
+		return errors.Wrap(err, "failed syncing temporary file")
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFileName)
+		return errors.Wrap(err, "failed closing temporary file")
+	}
+	if err := os.Rename(tempFileName, path); err != nil {
+		os.Remove(tempFileName)
+		return errors.Wrap(err, "failed renaming temporary file")
+	}
+	return nil
+}
+
+// WriteJSONAtomically writes the indented JSON of the value atomically,
+// a missing parent directory is created with the directory mode.
+func WriteJSONAtomically(path string, value interface{}, mode, directoryMode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), directoryMode); err != nil {
+		return errors.Wrap(err, "failed creating parent directory")
+	}
+	jsonBytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed serializing")
+	}
+	return WriteFileAtomically(path, jsonBytes, mode)
+}
+
+// SymlinkAtomically creates a symlink next to the target and renames it over the target.
+func SymlinkAtomically(target, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { // the default permission for this directory
+		return errors.Wrap(err, "failed creating parent directory")
+	}
+	tempPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), os.Getpid()))
+	os.Remove(tempPath)
+	if err := os.Symlink(target, tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package fsutil
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteJSONAtomically(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "state/value.json")
+	assert.Nil(t, WriteJSONAtomically(path, map[string]int{"value": 1}, 0600, 0700))
+	assert.Nil(t, WriteJSONAtomically(path, map[string]int{"value": 2}, 0600, 0700))
+
+	jsonBytes, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n  \"value\": 2\n}", string(jsonBytes))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Equal(t, fs.FileMode(0700), info.Mode().Perm())
+
+	// no temporary file is left behind:
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	assert.NotNil(t, WriteJSONAtomically(path, func() {}, 0600, 0700))
+}
+
+func TestSymlinkAtomically(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "link")
+	assert.Nil(t, SymlinkAtomically("first", path))
+	assert.Nil(t, SymlinkAtomically("second", path))
+	target, err := os.Readlink(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", target)
+}
@@ -0,0 +1,27 @@
+package fsutil
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+)
+
+// ParseOctalMode parses an octal unix mode, for example 0755 or 4755.
+// fs.FileMode does not use the unix bits for setuid, setgid and sticky, they are converted.
+func ParseOctalMode(value string) (fs.FileMode, error) {
+	parsed, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || parsed > 07777 {
+		return 0, fmt.Errorf("invalid mode: '%s', expected an octal mode", value)
+	}
+	mode := fs.FileMode(parsed).Perm()
+	if parsed&04000 != 0 {
+		mode = mode | fs.ModeSetuid
+	}
+	if parsed&02000 != 0 {
+		mode = mode | fs.ModeSetgid
+	}
+	if parsed&01000 != 0 {
+		mode = mode | fs.ModeSticky
+	}
+	return mode, nil
+}
@@ -0,0 +1,26 @@
+package fsutil
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOctalMode(t *testing.T) {
+	for value, expected := range map[string]fs.FileMode{
+		"644":  fs.FileMode(0644),
+		"0755": fs.FileMode(0755),
+		"4755": fs.FileMode(0755) | fs.ModeSetuid,
+		"2750": fs.FileMode(0750) | fs.ModeSetgid,
+		"1777": fs.FileMode(0777) | fs.ModeSticky,
+	} {
+		mode, err := ParseOctalMode(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, mode, value)
+	}
+	for _, invalid := range []string{"", "rw", "0888", "17777"} {
+		_, err := ParseOctalMode(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
@@ -11,4 +11,6 @@ require (
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.6.1
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/sys v0.0.0-20191008105621-543471e840be
 )
@@ -2,6 +2,7 @@ package injectors
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -11,12 +12,34 @@ import (
 )
 
 // InjectEnvironment injects an environment into an /etc/profile.d/... file.
-func InjectEntrypoint(logger hclog.Logger, mmdsData *mmds.MMDSData, entrypointRunnerPath, envFile string) error {
+// Without the entrypoint in the metadata, the entrypoint of the image config written by the bootstrap is used.
+func InjectEntrypoint(logger hclog.Logger, mmdsData *mmds.MMDSData, entrypointRunnerPath, envFile, imageConfigFile string) error {
 
-	entrypointInfo, jsonErr := mmds.NewMMDSRootfsEntrypointInfoFromJSON(mmdsData.EntrypointJSON)
-	if jsonErr != nil {
-		logger.Warn("entrypoint information could not be deserializing; exit early", "reason", jsonErr)
-		return jsonErr
+	var entrypointInfo *mmds.MMDSRootfsEntrypointInfo
+	if mmdsData.EntrypointJSON == "" {
+		imageConfigBytes, err := ioutil.ReadFile(imageConfigFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				logger.Debug("no entrypoint in metadata and no image config, nothing to do", "image-config", imageConfigFile)
+				return nil // nothing to do
+			}
+			logger.Error("failed reading image config", "image-config", imageConfigFile, "reason", err)
+			return errors.Wrap(err, "failed reading image config")
+		}
+		imageConfig, jsonErr := mmds.NewMMDSImageConfigFromJSON(string(imageConfigBytes))
+		if jsonErr != nil {
+			logger.Warn("image config could not be deserialized; exit early", "image-config", imageConfigFile, "reason", jsonErr)
+			return jsonErr
+		}
+		logger.Debug("using entrypoint from image config", "image-config", imageConfigFile)
+		entrypointInfo = imageConfig.EntrypointInfo()
+	} else {
+		metadataEntrypointInfo, jsonErr := mmds.NewMMDSRootfsEntrypointInfoFromJSON(mmdsData.EntrypointJSON)
+		if jsonErr != nil {
+			logger.Warn("entrypoint information could not be deserializing; exit early", "reason", jsonErr)
+			return jsonErr
+		}
+		entrypointInfo = metadataEntrypointInfo
 	}
 
 	if len(entrypointInfo.Entrypoint) == 0 {
@@ -0,0 +1,118 @@
+package injectors
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-mmds/passwd"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// InjectFiles writes the files listed in the metadata under the root path.
+// Each file is written atomically, owners and groups are resolved from the passwd and group files of the root path.
+func InjectFiles(logger hclog.Logger, mmdsData *mmds.MMDSData, rootPath string) error {
+
+	if len(mmdsData.Files) == 0 {
+		logger.Debug("no files, nothing to do")
+		return nil // nothing to do
+	}
+
+	db, err := passwd.NewDatabaseFromFiles(filepath.Join(rootPath, "etc/passwd"), filepath.Join(rootPath, "etc/group"))
+	if err != nil {
+		logger.Error("failed loading users and groups database", "reason", err)
+		return err
+	}
+
+	for _, file := range mmdsData.Files {
+
+		if file == nil {
+			continue
+		}
+
+		if !filepath.IsAbs(file.Path) {
+			logger.Error("file path must be absolute", "path", file.Path)
+			return fmt.Errorf("file path not absolute: '%s'", file.Path)
+		}
+
+		// cleaning an absolute path removes any leading ../ so the result never escapes the root path:
+		onDiskPath := filepath.Join(rootPath, filepath.Clean(file.Path))
+
+		contents, err := file.DecodedContent()
+		if err != nil {
+			logger.Error("failed decoding file content", "path", file.Path, "encoding", file.Encoding, "reason", err)
+			return errors.Wrapf(err, "failed decoding file '%s'", file.Path)
+		}
+
+		mode, err := file.FileMode()
+		if err != nil {
+			logger.Error("invalid file mode", "path", file.Path, "reason", err)
+			return err
+		}
+
+		owner := file.Owner
+		if owner == "" {
+			owner = "0"
+		}
+		uid, gid, err := db.ResolveOwner(owner, file.Group)
+		if err != nil {
+			logger.Error("failed resolving file ownership", "path", file.Path, "owner", file.Owner, "group", file.Group, "reason", err)
+			return err
+		}
+
+		if file.Append {
+			existing, err := ioutil.ReadFile(onDiskPath)
+			if err != nil && !os.IsNotExist(err) {
+				logger.Error("failed reading file to append to", "path", file.Path, "on-disk-path", onDiskPath, "reason", err)
+				return err
+			}
+			// vminit runs on every boot, the content is appended once:
+			if len(contents) > 0 && bytes.Contains(existing, contents) {
+				logger.Debug("file already contains the appended content", "path", file.Path, "on-disk-path", onDiskPath)
+				continue
+			}
+			// the existing file keeps its mode and owner unless they are given:
+			if err == nil {
+				info, err := os.Stat(onDiskPath)
+				if err != nil {
+					logger.Error("failed reading file to append to", "path", file.Path, "on-disk-path", onDiskPath, "reason", err)
+					return err
+				}
+				if file.Mode == "" {
+					mode = info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+				}
+				if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+					if file.Owner == "" {
+						uid = int(stat.Uid)
+					}
+					if file.Owner == "" && file.Group == "" {
+						gid = int(stat.Gid)
+					}
+				}
+			}
+			contents = append(existing, contents...)
+		}
+
+		logger.Debug("writing file",
+			"path", file.Path,
+			"on-disk-path", onDiskPath,
+			"mode", mode,
+			"uid", uid,
+			"gid", gid,
+			"append", file.Append)
+
+		if err := fsutil.WriteFileAtomicallyWithOwner(onDiskPath, contents, mode, uid, gid); err != nil {
+			logger.Error("failed writing file", "path", file.Path, "on-disk-path", onDiskPath, "reason", err)
+			return errors.Wrapf(err, "file '%s' write failed", file.Path)
+		}
+	}
+
+	return nil
+}
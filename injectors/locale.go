@@ -0,0 +1,51 @@
+package injectors
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// InjectLocale writes the system locale into /etc/locale.conf and, on Debian derived systems, /etc/default/locale.
+func InjectLocale(logger hclog.Logger, mmdsData *mmds.MMDSData, rootPath string) error {
+
+	if len(mmdsData.Locale) == 0 {
+		logger.Debug("no locale, nothing to do")
+		return nil // nothing to do
+	}
+
+	locale := strings.TrimSpace(mmdsData.Locale)
+	for _, r := range locale {
+		if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("_.@-", r)) {
+			logger.Error("invalid locale", "locale", locale)
+			return fmt.Errorf("invalid locale: '%s'", locale)
+		}
+	}
+
+	contents := fmt.Sprintf("%sLANG=%s\n", managedFileHeader, locale)
+
+	localeFiles := []string{filepath.Join(rootPath, "etc/locale.conf")}
+	defaultsExists, err := pathExists(filepath.Join(rootPath, "etc/default"))
+	if err != nil {
+		logger.Error("failed checking if etc/default directory exists", "reason", err)
+		return err
+	}
+	if defaultsExists {
+		localeFiles = append(localeFiles, filepath.Join(rootPath, "etc/default/locale"))
+	}
+
+	for _, localeFile := range localeFiles {
+		logger.Debug("writing locale file", "locale-file", localeFile)
+		if err := fsutil.WriteFileAtomically(localeFile, []byte(contents), 0644); err != nil {
+			logger.Error("failed writing locale file", "locale-file", localeFile, "reason", err)
+			return errors.Wrap(err, "locale file write failed")
+		}
+	}
+
+	return nil
+}
@@ -6,6 +6,9 @@ import (
 	"os"
 )
 
+// managedFileHeader is written at the top of configuration files owned by vminit.
+const managedFileHeader = "# Managed by vminit, changes will be overwritten on boot.\n"
+
 func checkIfExistsAndIsRegular(path string) (fs.FileInfo, error) {
 	stat, statErr := os.Stat(path)
 	if statErr != nil {
@@ -0,0 +1,159 @@
+package injectors
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// RunScripts executes the user scripts from the metadata in the order of their names.
+// Scripts, their completion markers and output logs are kept in the instance state directory.
+// Per-instance scripts run once per instance, per-boot scripts run once per boot ID, scripts with the always frequency run every time.
+// When the boot ID is empty, per-boot scripts run every time.
+// A failing script does not prevent the remaining scripts from running.
+func RunScripts(logger hclog.Logger, mmdsData *mmds.MMDSData, instanceDirectory, bootID string) error {
+
+	if len(mmdsData.Scripts) == 0 {
+		logger.Debug("no scripts, nothing to do")
+		return nil // nothing to do
+	}
+
+	if instanceDirectory == "" {
+		logger.Error("scripts require an instance state directory")
+		return errors.New("scripts require an instance state directory")
+	}
+
+	names := []string{}
+	for name := range mmdsData.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scriptsDirectory := filepath.Join(instanceDirectory, "scripts")
+	markersDirectory := filepath.Join(scriptsDirectory, "sem")
+	if err := os.MkdirAll(markersDirectory, 0700); err != nil {
+		logger.Error("failed creating scripts state directory", "path", markersDirectory, "reason", err)
+		return errors.Wrap(err, "failed creating scripts state directory")
+	}
+
+	failed := []string{}
+
+	for _, name := range names {
+
+		script := mmdsData.Scripts[name]
+		if script == nil {
+			continue
+		}
+
+		if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+			logger.Error("invalid script name", "name", name)
+			failed = append(failed, name)
+			continue
+		}
+
+		frequency, err := script.SafeFrequency()
+		if err != nil {
+			logger.Error("invalid script frequency", "name", name, "reason", err)
+			failed = append(failed, name)
+			continue
+		}
+
+		markerFile := filepath.Join(markersDirectory, name)
+		shouldRun, err := scriptShouldRun(markerFile, frequency, bootID)
+		if err != nil {
+			logger.Error("failed checking script completion marker", "name", name, "reason", err)
+			failed = append(failed, name)
+			continue
+		}
+		if !shouldRun {
+			logger.Debug("script already completed, skipping", "name", name, "frequency", frequency)
+			continue
+		}
+
+		scriptFile := filepath.Join(scriptsDirectory, name)
+		logFile := filepath.Join(scriptsDirectory, name+".log")
+
+		logger.Debug("running script", "name", name, "frequency", frequency, "script-file", scriptFile, "log-file", logFile)
+
+		if err := runScript(script, scriptFile, logFile); err != nil {
+			logger.Error("script failed", "name", name, "log-file", logFile, "reason", err)
+			failed = append(failed, name)
+			continue
+		}
+
+		if err := fsutil.WriteFileAtomically(markerFile, []byte(bootID+"\n"), 0600); err != nil {
+			logger.Error("failed writing script completion marker", "name", name, "reason", err)
+			failed = append(failed, name)
+			continue
+		}
+
+		logger.Info("script finished successfully", "name", name)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("scripts failed: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func scriptShouldRun(markerFile, frequency, bootID string) (bool, error) {
+	if frequency == mmds.ScriptFrequencyAlways {
+		return true, nil
+	}
+	markerBytes, err := ioutil.ReadFile(markerFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if frequency == mmds.ScriptFrequencyPerBoot {
+		// without a boot ID there is no way to tell boots apart:
+		return bootID == "" || strings.TrimSpace(string(markerBytes)) != bootID, nil
+	}
+	return false, nil
+}
+
+func runScript(script *mmds.MMDSScript, scriptFile, logFile string) error {
+	if err := fsutil.WriteFileAtomically(scriptFile, []byte(script.Content), 0700); err != nil {
+		return errors.Wrap(err, "failed writing script file")
+	}
+
+	output, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed opening script log file")
+	}
+	defer output.Close()
+
+	fmt.Fprintf(output, "--- %s: starting %s\n", time.Now().UTC().Format(time.RFC3339), filepath.Base(scriptFile))
+
+	// scripts without an interpreter line run with the default shell:
+	args := []string{scriptFile}
+	if !strings.HasPrefix(script.Content, "#!") {
+		args = []string{"/bin/sh", scriptFile}
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = "/"
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	runErr := cmd.Run()
+	if runErr != nil {
+		fmt.Fprintf(output, "--- %s: failed: %v\n", time.Now().UTC().Format(time.RFC3339), runErr)
+		return runErr
+	}
+	fmt.Fprintf(output, "--- %s: finished\n", time.Now().UTC().Format(time.RFC3339))
+	return nil
+}
@@ -1,17 +1,29 @@
 package injectors
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/combust-labs/firebuild-shared/build/rootfs"
 	"github.com/hashicorp/go-hclog"
 )
 
@@ -284,7 +296,7 @@ func TestInjectEntrypoint(t *testing.T) {
 	file := filepath.Join(tempDir, "usr/bin/firebuild-entrypoint.sh")
 	envFile := filepath.Join(tempDir, "etc/profile.d/env.file")
 
-	if err := InjectEntrypoint(hclog.Default(), newMMDSData, file, envFile); err != nil {
+	if err := InjectEntrypoint(hclog.Default(), newMMDSData, file, envFile, filepath.Join(tempDir, "etc/firebuild/image-config.json")); err != nil {
 		t.Fatal("expected the entrypoint runner to be injected but received an error:", err)
 	}
 
@@ -301,6 +313,556 @@ func TestInjectEntrypoint(t *testing.T) {
 	}
 }
 
+func TestInjectEntrypointFromImageConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	file := filepath.Join(tempDir, "usr/bin/firebuild-entrypoint.sh")
+	envFile := filepath.Join(tempDir, "etc/profile.d/env.file")
+	imageConfigFile := filepath.Join(tempDir, "etc/firebuild/image-config.json")
+
+	// without the entrypoint in the metadata and without the image config there is nothing to do:
+	if err := InjectEntrypoint(hclog.Default(), &mmds.MMDSData{}, file, envFile, imageConfigFile); err != nil {
+		t.Fatal("expected no entrypoint to be injected without an error, received an error:", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("expected no entrypoint runner, got:", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(imageConfigFile), 0755); err != nil {
+		t.Fatal("expected image config directory:", err)
+	}
+	if err := ioutil.WriteFile(imageConfigFile, []byte(`{"Cmd": ["--help"], "EntryPoint": ["/usr/bin/start.sh"], "Env": {"ETCD_VERSION": "3.4.0"}, "Workdir": "/", "StopSignal": "SIGQUIT"}`), 0644); err != nil {
+		t.Fatal("expected image config to be written:", err)
+	}
+
+	if err := InjectEntrypoint(hclog.Default(), &mmds.MMDSData{}, file, envFile, imageConfigFile); err != nil {
+		t.Fatal("expected the entrypoint runner to be injected but received an error:", err)
+	}
+
+	fileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("expected the entrypoint runner to be read but received an error:", err)
+	}
+
+	expectedString := fmt.Sprintf("#!/bin/sh\n\n/bin/sh -c 'export ETCD_VERSION=\"3.4.0\"; if [ -f \"%s\" ]; then . \"%s\"; fi; export PATH=$PATH:/; cd / && /usr/bin/start.sh \"--help\"'\n",
+		envFile, envFile)
+
+	if string(fileBytes) != expectedString {
+		t.Fatal("usr/bin/firebuild-entrypoint.sh did not contain required content, got:", string(fileBytes))
+	}
+}
+
+func TestInjectSysctls(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	procSysPath := filepath.Join(tempDir, "proc/sys")
+	if err := os.MkdirAll(filepath.Join(procSysPath, "net/ipv4"), 0755); err != nil {
+		t.Fatal("expected proc/sys/net/ipv4 directory to be created:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(procSysPath, "net/ipv4/ip_forward"), []byte("0\n"), 0644); err != nil {
+		t.Fatal("expected proc/sys/net/ipv4/ip_forward file to be created:", err)
+	}
+	if err := os.MkdirAll(filepath.Join(procSysPath, "net/ipv4/conf/eth0.100"), 0755); err != nil {
+		t.Fatal("expected proc/sys/net/ipv4/conf/eth0.100 directory to be created:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(procSysPath, "net/ipv4/conf/eth0.100/forwarding"), []byte("0\n"), 0644); err != nil {
+		t.Fatal("expected proc/sys/net/ipv4/conf/eth0.100/forwarding file to be created:", err)
+	}
+
+	mmdsData := &mmds.MMDSData{
+		Sysctls: map[string]string{
+			"net/ipv4/ip_forward":               "1",
+			"net/ipv4/conf/eth0.100/forwarding": "1",
+			"not.a.real.key":                    "1",
+		},
+	}
+
+	file := filepath.Join(tempDir, "etc/sysctl.d/99-firebuild.conf")
+	if err := InjectSysctls(hclog.Default(), mmdsData, file, procSysPath, []string{"kernel.core_pattern"}); err != nil {
+		t.Fatal("expected the sysctls to be injected but received an error:", err)
+	}
+
+	fileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal("expected the sysctl file to be read but received an error:", err)
+	}
+	if !strings.Contains(string(fileBytes), "net.ipv4.ip_forward = 1\n") {
+		t.Fatal("sysctl file did not contain the applicable key")
+	}
+	if !strings.Contains(string(fileBytes), "net.ipv4.conf.eth0/100.forwarding = 1\n") {
+		t.Fatal("sysctl file did not contain the key with a dotted interface name, got:", string(fileBytes))
+	}
+	if strings.Contains(string(fileBytes), "not.a.real.key") {
+		t.Fatal("sysctl file contained a key unknown to the kernel")
+	}
+
+	procBytes, err := ioutil.ReadFile(filepath.Join(procSysPath, "net/ipv4/ip_forward"))
+	if err != nil {
+		t.Fatal("expected the proc/sys file to be read but received an error:", err)
+	}
+	if string(procBytes) != "1" {
+		t.Fatal("sysctl was not applied via proc/sys")
+	}
+	procBytes, err = ioutil.ReadFile(filepath.Join(procSysPath, "net/ipv4/conf/eth0.100/forwarding"))
+	if err != nil {
+		t.Fatal("expected the proc/sys file to be read but received an error:", err)
+	}
+	if string(procBytes) != "1" {
+		t.Fatal("sysctl with a dotted interface name was not applied via proc/sys")
+	}
+
+	for _, injected := range []map[string]string{
+		{"net.ipv4.ip_forward": "1\nkernel.core_pattern = |/tmp/x"},
+		{"net.ipv4.ip_forward": "1\rkernel.core_pattern = |/tmp/x"},
+		{"net.ipv4.ip_forward = 1\nkernel.core_pattern": "|/tmp/x"},
+		{"kernel.core_pattern=": "|/tmp/x"},
+	} {
+		if err := InjectSysctls(hclog.Default(), &mmds.MMDSData{Sysctls: injected}, file, procSysPath, []string{"kernel.core_pattern"}); err == nil {
+			t.Fatal("expected sysctl with a line break or an equals sign in the key to be refused:", injected)
+		}
+	}
+
+	// the names which are not a single proc/sys path component could escape the denylist or proc/sys:
+	if err := os.MkdirAll(filepath.Join(procSysPath, "kernel"), 0755); err != nil {
+		t.Fatal("expected proc/sys/kernel directory to be created:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(procSysPath, "kernel/core_pattern"), []byte("core\n"), 0644); err != nil {
+		t.Fatal("expected proc/sys/kernel/core_pattern file to be created:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "victim"), []byte("victim\n"), 0644); err != nil {
+		t.Fatal("expected victim file to be created:", err)
+	}
+	for _, key := range []string{"kernel..core_pattern", "kernel/./core_pattern", "kernel.//.//.//.victim", "kernel/../../../victim"} {
+		if err := InjectSysctls(hclog.Default(), &mmds.MMDSData{Sysctls: map[string]string{key: "|/evil"}}, file, procSysPath, []string{"kernel.core_pattern"}); err == nil {
+			t.Fatal("expected sysctl with an empty, . or .. name to be refused:", key)
+		}
+	}
+	for path, expected := range map[string]string{"proc/sys/kernel/core_pattern": "core\n", "victim": "victim\n"} {
+		procBytes, err := ioutil.ReadFile(filepath.Join(tempDir, path))
+		if err != nil {
+			t.Fatal("expected the file to be read but received an error:", err)
+		}
+		if string(procBytes) != expected {
+			t.Fatal("expected the file not to be written:", path)
+		}
+	}
+
+	// a value can contain equals signs:
+	if err := InjectSysctls(hclog.Default(), &mmds.MMDSData{Sysctls: map[string]string{"kernel.core_pattern": "|/usr/bin/handler --mode=core"}}, file, procSysPath, nil); err != nil {
+		t.Fatal("expected sysctl with an equals sign in the value to be injected but received an error:", err)
+	}
+	procBytes, err = ioutil.ReadFile(filepath.Join(procSysPath, "kernel/core_pattern"))
+	if err != nil {
+		t.Fatal("expected the proc/sys file to be read but received an error:", err)
+	}
+	if string(procBytes) != "|/usr/bin/handler --mode=core" {
+		t.Fatal("sysctl with an equals sign in the value was not applied via proc/sys, got:", string(procBytes))
+	}
+
+	deniedMMDSData := &mmds.MMDSData{
+		Sysctls: map[string]string{
+			"kernel.usermodehelper.bset": "0",
+		},
+	}
+	if err := InjectSysctls(hclog.Default(), deniedMMDSData, file, procSysPath, []string{"kernel.usermodehelper.*"}); err == nil {
+		t.Fatal("expected denylisted sysctl to be refused")
+	}
+	deniedMMDSData = &mmds.MMDSData{
+		Sysctls: map[string]string{
+			"net/ipv4/conf/eth0.100/forwarding": "1",
+		},
+	}
+	if err := InjectSysctls(hclog.Default(), deniedMMDSData, file, procSysPath, []string{"net.ipv4.conf.*.forwarding"}); err == nil {
+		t.Fatal("expected denylisted sysctl with a dotted interface name to be refused")
+	}
+}
+
+func TestInjectFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// gzip+base64 of "compressed content\n":
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write([]byte("compressed content\n"))
+	gzipWriter.Close()
+
+	owner := fmt.Sprintf("%d", os.Getuid())
+	group := fmt.Sprintf("%d", os.Getgid())
+
+	mmdsData := &mmds.MMDSData{
+		Files: []*mmds.MMDSFile{
+			{
+				Path:    "/etc/app/plain.conf",
+				Content: "plain content\n",
+				Owner:   owner,
+				Group:   group,
+				Mode:    "0600",
+			},
+			{
+				Path:     "/etc/app/plain.conf",
+				Content:  base64.StdEncoding.EncodeToString([]byte("appended content\n")),
+				Encoding: mmds.FileEncodingBase64,
+				Owner:    owner,
+				Group:    group,
+				Mode:     "0600",
+				Append:   true,
+			},
+			{
+				Path:     "/../opt/app/compressed.conf",
+				Content:  base64.StdEncoding.EncodeToString(compressed.Bytes()),
+				Encoding: mmds.FileEncodingGzipBase64,
+				Owner:    owner,
+			},
+		},
+	}
+
+	if err := InjectFiles(hclog.Default(), mmdsData, tempDir); err != nil {
+		t.Fatal("expected the files to be injected but received an error:", err)
+	}
+
+	plainBytes, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/app/plain.conf"))
+	if err != nil {
+		t.Fatal("expected the plain file to be read but received an error:", err)
+	}
+	if string(plainBytes) != "plain content\nappended content\n" {
+		t.Fatal("plain file did not contain the expected content")
+	}
+	stat, err := os.Stat(filepath.Join(tempDir, "etc/app/plain.conf"))
+	if err != nil {
+		t.Fatal("failed stat plain file:", err)
+	}
+	if stat.Mode().Perm() != fs.FileMode(0600) {
+		t.Fatal("plain file mode not what expected")
+	}
+
+	// appending keeps the mode of the existing file and appends once on repeated runs:
+	existingFile := filepath.Join(tempDir, "etc/app/existing.conf")
+	if err := ioutil.WriteFile(existingFile, []byte("existing content\n"), 0640); err != nil {
+		t.Fatal("expected the existing file to be created:", err)
+	}
+	appendMMDSData := &mmds.MMDSData{
+		Files: []*mmds.MMDSFile{
+			{
+				Path:    "/etc/app/existing.conf",
+				Content: "appended content\n",
+				Append:  true,
+			},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := InjectFiles(hclog.Default(), appendMMDSData, tempDir); err != nil {
+			t.Fatal("expected the file to be appended to but received an error:", err)
+		}
+	}
+	existingBytes, err := ioutil.ReadFile(existingFile)
+	if err != nil {
+		t.Fatal("expected the existing file to be read but received an error:", err)
+	}
+	if string(existingBytes) != "existing content\nappended content\n" {
+		t.Fatal("existing file did not contain the content appended once, got:", string(existingBytes))
+	}
+	stat, err = os.Stat(existingFile)
+	if err != nil {
+		t.Fatal("failed stat existing file:", err)
+	}
+	if stat.Mode().Perm() != fs.FileMode(0640) {
+		t.Fatal("existing file mode not kept, got:", stat.Mode().Perm())
+	}
+
+	// the relative component must not escape the root:
+	compressedBytes, err := ioutil.ReadFile(filepath.Join(tempDir, "opt/app/compressed.conf"))
+	if err != nil {
+		t.Fatal("expected the compressed file to be read but received an error:", err)
+	}
+	if string(compressedBytes) != "compressed content\n" {
+		t.Fatal("compressed file did not contain the expected content")
+	}
+
+	invalidMMDSData := &mmds.MMDSData{
+		Files: []*mmds.MMDSFile{
+			{
+				Path:    "/etc/app/invalid.conf",
+				Content: "content",
+				Owner:   "non-existing-user",
+			},
+		},
+	}
+	if err := InjectFiles(hclog.Default(), invalidMMDSData, tempDir); err == nil {
+		t.Fatal("expected an unknown owner to fail")
+	}
+}
+
+func TestInjectTrustedCAs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	systemCA := mustGenerateTestCAPEM(t, "system-ca")
+	firstCA := mustGenerateTestCAPEM(t, "first-ca")
+	secondCA := mustGenerateTestCAPEM(t, "second-ca")
+
+	if err := os.MkdirAll(filepath.Join(tempDir, "usr/local/share/ca-certificates"), 0755); err != nil {
+		t.Fatal("expected usr/local/share/ca-certificates directory to be created:", err)
+	}
+	bundleFile := filepath.Join(tempDir, "etc/ssl/certs/ca-certificates.crt")
+	rootfs.MustPutTestResource(t, bundleFile, []byte(systemCA))
+
+	mmdsData := &mmds.MMDSData{
+		TrustedCAs: map[string]string{
+			"internal/ca": firstCA,
+		},
+	}
+	if err := InjectTrustedCAs(hclog.Default(), mmdsData, tempDir); err != nil {
+		t.Fatal("expected the trusted CAs to be injected but received an error:", err)
+	}
+
+	anchorBytes, err := ioutil.ReadFile(filepath.Join(tempDir, "usr/local/share/ca-certificates/firebuild-internal_ca.crt"))
+	if err != nil {
+		t.Fatal("expected the trusted CA anchor to be read but received an error:", err)
+	}
+	if string(anchorBytes) != firstCA {
+		t.Fatal("trusted CA anchor did not contain the CA")
+	}
+	bundleBytes, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		t.Fatal("expected the CA bundle to be read but received an error:", err)
+	}
+	if string(bundleBytes) != systemCA+firstCA {
+		t.Fatal("CA bundle did not contain the system and the trusted CA")
+	}
+
+	// replacing the CA removes the previously installed one:
+	mmdsData.TrustedCAs = map[string]string{
+		"other": secondCA,
+	}
+	if err := InjectTrustedCAs(hclog.Default(), mmdsData, tempDir); err != nil {
+		t.Fatal("expected the trusted CAs to be injected but received an error:", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "usr/local/share/ca-certificates/firebuild-internal_ca.crt")); !os.IsNotExist(err) {
+		t.Fatal("expected the previously installed trusted CA anchor to be removed")
+	}
+	bundleBytes, err = ioutil.ReadFile(bundleFile)
+	if err != nil {
+		t.Fatal("expected the CA bundle to be read but received an error:", err)
+	}
+	if string(bundleBytes) != systemCA+secondCA {
+		t.Fatal("CA bundle did not contain the system and the replaced trusted CA")
+	}
+
+	mmdsData.TrustedCAs = map[string]string{
+		"invalid": "not a PEM",
+	}
+	if err := InjectTrustedCAs(hclog.Default(), mmdsData, tempDir); err == nil {
+		t.Fatal("expected an invalid trusted CA to fail")
+	}
+}
+
+func mustGenerateTestCAPEM(t *testing.T, commonName string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("expected test CA key:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("expected test CA certificate:", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestInjectTimezoneLocaleAndNTPServers(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rootfs.MustPutTestResource(t, filepath.Join(tempDir, "usr/share/zoneinfo/Europe/Berlin"), []byte("TZif"))
+	rootfs.MustPutTestResource(t, filepath.Join(tempDir, "etc/chrony/chrony.conf"), []byte("pool 2.debian.pool.ntp.org iburst\n"))
+	rootfs.MustPutTestResource(t, filepath.Join(tempDir, "usr/sbin/ntpd"), []byte("ntpd"))
+	if err := os.MkdirAll(filepath.Join(tempDir, "etc/default"), 0755); err != nil {
+		t.Fatal("expected etc/default directory to be created:", err)
+	}
+
+	mmdsData := &mmds.MMDSData{
+		Locale:     "en_US.UTF-8",
+		NTPServers: []string{"0.pool.ntp.org", "1.pool.ntp.org"},
+		Timezone:   "Europe/Berlin",
+	}
+
+	if err := InjectTimezone(hclog.Default(), mmdsData, tempDir); err != nil {
+		t.Fatal("expected the timezone to be injected but received an error:", err)
+	}
+	linkTarget, err := os.Readlink(filepath.Join(tempDir, "etc/localtime"))
+	if err != nil {
+		t.Fatal("expected etc/localtime to be a link:", err)
+	}
+	if linkTarget != "/usr/share/zoneinfo/Europe/Berlin" {
+		t.Fatal("etc/localtime link target not what expected:", linkTarget)
+	}
+	timezoneBytes, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/timezone"))
+	if err != nil {
+		t.Fatal("expected the timezone file to be read but received an error:", err)
+	}
+	if string(timezoneBytes) != "Europe/Berlin\n" {
+		t.Fatal("timezone file did not contain the timezone")
+	}
+
+	if err := InjectLocale(hclog.Default(), mmdsData, tempDir); err != nil {
+		t.Fatal("expected the locale to be injected but received an error:", err)
+	}
+	for _, localeFile := range []string{"etc/locale.conf", "etc/default/locale"} {
+		localeBytes, err := ioutil.ReadFile(filepath.Join(tempDir, localeFile))
+		if err != nil {
+			t.Fatal("expected the locale file to be read but received an error:", err)
+		}
+		if !strings.Contains(string(localeBytes), "LANG=en_US.UTF-8\n") {
+			t.Fatal("locale file did not contain the locale:", localeFile)
+		}
+	}
+
+	// the chrony configuration is included once, the distribution settings are kept:
+	for i := 0; i < 2; i++ {
+		if err := InjectNTPServers(hclog.Default(), mmdsData, tempDir); err != nil {
+			t.Fatal("expected the NTP servers to be injected but received an error:", err)
+		}
+	}
+	chronyBytes, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/chrony/conf.d/firebuild.conf"))
+	if err != nil {
+		t.Fatal("expected the chrony drop-in configuration to be read but received an error:", err)
+	}
+	if !strings.Contains(string(chronyBytes), "server 0.pool.ntp.org iburst\nserver 1.pool.ntp.org iburst\n") {
+		t.Fatal("chrony drop-in configuration did not contain the NTP servers")
+	}
+	chronyBytes, err = ioutil.ReadFile(filepath.Join(tempDir, "etc/chrony/chrony.conf"))
+	if err != nil {
+		t.Fatal("expected the chrony configuration to be read but received an error:", err)
+	}
+	if string(chronyBytes) != "pool 2.debian.pool.ntp.org iburst\ninclude /etc/chrony/conf.d/firebuild.conf\n" {
+		t.Fatal("chrony configuration did not include the drop-in configuration once, got:", string(chronyBytes))
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "etc/chrony.d/firebuild.conf")); !os.IsNotExist(err) {
+		t.Fatal("expected a single chrony layout to be configured")
+	}
+	// the other installed daemons are configured too:
+	ntpBytes, err := ioutil.ReadFile(filepath.Join(tempDir, "etc/ntp.conf"))
+	if err != nil {
+		t.Fatal("expected the ntpd configuration to be read but received an error:", err)
+	}
+	if !strings.Contains(string(ntpBytes), "server 0.pool.ntp.org iburst\nserver 1.pool.ntp.org iburst\n") {
+		t.Fatal("ntpd configuration did not contain the NTP servers")
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "etc/systemd/timesyncd.conf.d/firebuild.conf")); !os.IsNotExist(err) {
+		t.Fatal("expected systemd-timesyncd configuration not to be written when not installed")
+	}
+
+	mmdsData.Timezone = "../../etc/shadow"
+	if err := InjectTimezone(hclog.Default(), mmdsData, tempDir); err == nil {
+		t.Fatal("expected an invalid timezone to fail")
+	}
+}
+
+func TestRunScripts(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	instanceDirectory := filepath.Join(tempDir, "var/lib/vminit/instances/test-vmm")
+	countersDirectory := filepath.Join(tempDir, "counters")
+	if err := os.MkdirAll(countersDirectory, 0755); err != nil {
+		t.Fatal("expected counters directory to be created:", err)
+	}
+
+	scriptFor := func(name, frequency string) *mmds.MMDSScript {
+		return &mmds.MMDSScript{
+			Content:   fmt.Sprintf("#!/bin/sh\necho run >> %s\necho output of %s\n", filepath.Join(countersDirectory, name), name),
+			Frequency: frequency,
+		}
+	}
+
+	mmdsData := &mmds.MMDSData{
+		Scripts: map[string]*mmds.MMDSScript{
+			"always":       scriptFor("always", mmds.ScriptFrequencyAlways),
+			"per-boot":     scriptFor("per-boot", mmds.ScriptFrequencyPerBoot),
+			"per-instance": scriptFor("per-instance", ""),
+		},
+	}
+
+	countRuns := func(name string) int {
+		counterBytes, err := ioutil.ReadFile(filepath.Join(countersDirectory, name))
+		if err != nil {
+			t.Fatal("expected the counter file to be read but received an error:", err)
+		}
+		return strings.Count(string(counterBytes), "run\n")
+	}
+
+	// first boot:
+	if err := RunScripts(hclog.Default(), mmdsData, instanceDirectory, "boot-1"); err != nil {
+		t.Fatal("expected the scripts to run but received an error:", err)
+	}
+	// vminit running again within the same boot:
+	if err := RunScripts(hclog.Default(), mmdsData, instanceDirectory, "boot-1"); err != nil {
+		t.Fatal("expected the scripts to run but received an error:", err)
+	}
+	// reboot:
+	if err := RunScripts(hclog.Default(), mmdsData, instanceDirectory, "boot-2"); err != nil {
+		t.Fatal("expected the scripts to run but received an error:", err)
+	}
+
+	if countRuns("always") != 3 {
+		t.Fatal("expected the always script to run three times")
+	}
+	if countRuns("per-boot") != 2 {
+		t.Fatal("expected the per-boot script to run twice")
+	}
+	if countRuns("per-instance") != 1 {
+		t.Fatal("expected the per-instance script to run once")
+	}
+
+	logBytes, err := ioutil.ReadFile(filepath.Join(instanceDirectory, "scripts/per-instance.log"))
+	if err != nil {
+		t.Fatal("expected the script log file to be read but received an error:", err)
+	}
+	if !strings.Contains(string(logBytes), "output of per-instance\n") {
+		t.Fatal("script log file did not contain the script output")
+	}
+
+	// a failed script is not marked as completed:
+	mmdsData.Scripts = map[string]*mmds.MMDSScript{
+		"failing": {Content: "exit 1"},
+	}
+	if err := RunScripts(hclog.Default(), mmdsData, instanceDirectory, "boot-2"); err == nil {
+		t.Fatal("expected a failing script to return an error")
+	}
+	if _, err := os.Stat(filepath.Join(instanceDirectory, "scripts/sem/failing")); !os.IsNotExist(err) {
+		t.Fatal("expected no completion marker for a failing script")
+	}
+}
+
 const testJsonData = `{
 	"drives":{
 	   "1":{
@@ -0,0 +1,172 @@
+package injectors
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+// InjectSysctls writes kernel parameters into a managed /etc/sysctl.d/... drop-in file
+// and applies them immediately via /proc/sys.
+// Keys matching any of the denylist patterns are refused, keys not known to the running kernel are skipped.
+func InjectSysctls(logger hclog.Logger, mmdsData *mmds.MMDSData, sysctlFile, procSysPath string, denylist []string) error {
+
+	if len(mmdsData.Sysctls) == 0 {
+		logger.Debug("no sysctls, nothing to do")
+		return nil // nothing to do
+	}
+
+	// a line break would add lines to the sysctl file, those would escape the denylist,
+	// the value starts after the first equals sign so only the key can't contain one:
+	sysctls := map[string]string{}
+	for k, v := range mmdsData.Sysctls {
+		if strings.ContainsAny(k, "\r\n=") || strings.ContainsAny(v, "\r\n") {
+			logger.Error("refusing sysctl with a line break or an equals sign in the key", "key", k)
+			return fmt.Errorf("invalid sysctl '%s': keys and values must not contain line breaks, keys must not contain equals signs", strings.TrimSpace(k))
+		}
+		key, err := sysctlKey(k)
+		if err != nil {
+			logger.Error("refusing invalid sysctl key", "key", k, "reason", err)
+			return err
+		}
+		sysctls[key] = strings.TrimSpace(v)
+	}
+
+	keys := []string{}
+	for k := range sysctls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// refuse the whole set before touching anything if any key is denied:
+	// the patterns match the slash separated form, a wildcard matches a name with dots:
+	denied := []string{}
+	for _, k := range keys {
+		for _, pattern := range denylist {
+			if matched, _ := path.Match(swapSysctlSeparators(normalizeSysctlKey(pattern)), swapSysctlSeparators(k)); matched {
+				denied = append(denied, k)
+				break
+			}
+		}
+	}
+	if len(denied) > 0 {
+		logger.Error("refusing denylisted sysctls", "keys", denied)
+		return fmt.Errorf("sysctls denied: %s", strings.Join(denied, ", "))
+	}
+
+	procPaths := map[string]string{}
+	for _, k := range keys {
+		procPath, err := sysctlProcPath(procSysPath, k)
+		if err != nil {
+			logger.Error("refusing sysctl outside of proc/sys", "key", k, "reason", err)
+			return err
+		}
+		procPaths[k] = procPath
+	}
+
+	applicable := []string{}
+	unknown := []string{}
+	for _, k := range keys {
+		exists, err := pathExists(procPaths[k])
+		if err != nil {
+			logger.Error("failed checking if sysctl exists", "key", k, "reason", err)
+			return err
+		}
+		if !exists {
+			unknown = append(unknown, k)
+			continue
+		}
+		applicable = append(applicable, k)
+	}
+	if len(unknown) > 0 {
+		logger.Warn("sysctls not supported by the running kernel, skipping", "keys", unknown)
+	}
+
+	contents := managedFileHeader
+	for _, k := range applicable {
+		contents = fmt.Sprintf("%s%s = %s\n", contents, k, sysctls[k])
+	}
+
+	logger.Debug("writing sysctl file", "sysctl-file", sysctlFile, "number-of-keys", len(applicable))
+
+	if err := fsutil.WriteFileAtomically(sysctlFile, []byte(contents), 0644); err != nil {
+		logger.Error("failed writing sysctl file", "reason", err)
+		return errors.Wrap(err, "sysctl file write failed")
+	}
+
+	for _, k := range applicable {
+		logger.Debug("applying sysctl", "key", k, "value", sysctls[k])
+		if err := writeSysctl(procPaths[k], sysctls[k]); err != nil {
+			logger.Error("failed applying sysctl", "key", k, "reason", err)
+			return errors.Wrapf(err, "failed applying sysctl '%s'", k)
+		}
+	}
+
+	return nil
+}
+
+// normalizeSysctlKey converts the key to the dotted form.
+// Like in sysctl.d, when the first separator is a slash, the dots are part of the names, for example
+// net/ipv4/conf/eth0.100/forwarding, and the slashes and the dots are swapped: net.ipv4.conf.eth0/100.forwarding.
+func normalizeSysctlKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(key), "./")
+	if index := strings.IndexAny(key, "./"); index >= 0 && key[index] == '/' {
+		return swapSysctlSeparators(key)
+	}
+	return key
+}
+
+// sysctlKey returns the canonical dotted form of the key.
+// Every name of the key must map to a single proc/sys path component, empty, . and .. names are refused.
+func sysctlKey(key string) (string, error) {
+	normalized := normalizeSysctlKey(key)
+	for _, name := range strings.Split(normalized, ".") {
+		switch swapSysctlSeparators(name) {
+		case "", ".", "..":
+			return "", fmt.Errorf("invalid sysctl '%s': empty, . and .. names are not allowed", strings.TrimSpace(key))
+		}
+	}
+	return normalized, nil
+}
+
+// sysctlProcPath returns the proc/sys path of the canonical key, the path must stay under the proc/sys path.
+func sysctlProcPath(procSysPath, key string) (string, error) {
+	procPath := filepath.Join(procSysPath, swapSysctlSeparators(key))
+	relative, err := filepath.Rel(procSysPath, procPath)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("invalid sysctl '%s': the path is not under %s", key, procSysPath)
+	}
+	return procPath, nil
+}
+
+func swapSysctlSeparators(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, key)
+}
+
+func writeSysctl(procPath, value string) error {
+	writableFile, err := os.OpenFile(procPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := writableFile.WriteString(value); err != nil {
+		writableFile.Close()
+		return err
+	}
+	return writableFile.Close()
+}
@@ -0,0 +1,219 @@
+package injectors
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+const zoneinfoDirectory = "/usr/share/zoneinfo"
+
+// ntpDaemon describes how to detect a time synchronization daemon and where its configuration goes.
+// Paths are relative to the root path.
+// With the drop-in file, an existing config file is kept and only includes the drop-in file.
+type ntpDaemon struct {
+	name         string
+	detectPaths  []string
+	configFile   string
+	dropInFile   string
+	render       func([]string) string
+	renderDropIn func([]string) string
+}
+
+// ntpDaemons lists the supported time synchronization daemons.
+var ntpDaemons = []*ntpDaemon{
+	{
+		// Debian and Ubuntu keep the chrony configuration in a directory:
+		name:         "chrony",
+		detectPaths:  []string{"etc/chrony"},
+		configFile:   "etc/chrony/chrony.conf",
+		dropInFile:   "etc/chrony/conf.d/firebuild.conf",
+		render:       renderChronyConfig,
+		renderDropIn: renderChronyDropIn,
+	},
+	{
+		name:         "chrony",
+		detectPaths:  []string{"etc/chrony.conf", "usr/sbin/chronyd"},
+		configFile:   "etc/chrony.conf",
+		dropInFile:   "etc/chrony.d/firebuild.conf",
+		render:       renderChronyConfig,
+		renderDropIn: renderChronyDropIn,
+	},
+	{
+		name:        "ntpd",
+		detectPaths: []string{"etc/ntp.conf", "usr/sbin/ntpd"},
+		configFile:  "etc/ntp.conf",
+		render:      renderNtpdConfig,
+	},
+	{
+		name:        "systemd-timesyncd",
+		detectPaths: []string{"lib/systemd/systemd-timesyncd", "usr/lib/systemd/systemd-timesyncd"},
+		configFile:  "etc/systemd/timesyncd.conf.d/firebuild.conf",
+		render:      renderTimesyncdConfig,
+	},
+}
+
+// InjectTimezone points /etc/localtime at the zoneinfo file of the timezone and writes /etc/timezone.
+func InjectTimezone(logger hclog.Logger, mmdsData *mmds.MMDSData, rootPath string) error {
+
+	if len(mmdsData.Timezone) == 0 {
+		logger.Debug("no timezone, nothing to do")
+		return nil // nothing to do
+	}
+
+	timezone := strings.TrimSpace(mmdsData.Timezone)
+	if filepath.IsAbs(timezone) || filepath.Clean(timezone) != timezone || strings.HasPrefix(timezone, "..") {
+		logger.Error("invalid timezone", "timezone", timezone)
+		return fmt.Errorf("invalid timezone: '%s'", timezone)
+	}
+
+	zoneinfoFile := filepath.Join(zoneinfoDirectory, timezone)
+	if _, err := checkIfExistsAndIsRegular(filepath.Join(rootPath, zoneinfoFile)); err != nil {
+		logger.Error("timezone not available in the root file system", "timezone", timezone, "reason", err)
+		return errors.Wrapf(err, "timezone '%s' not available", timezone)
+	}
+
+	// the link target is resolved by the guest, it must not contain the root path:
+	localtimeFile := filepath.Join(rootPath, "etc/localtime")
+	logger.Debug("linking localtime", "localtime", localtimeFile, "target", zoneinfoFile)
+	if err := fsutil.SymlinkAtomically(zoneinfoFile, localtimeFile); err != nil {
+		logger.Error("failed linking localtime", "reason", err)
+		return errors.Wrap(err, "localtime link failed")
+	}
+
+	timezoneFile := filepath.Join(rootPath, "etc/timezone")
+	logger.Debug("writing timezone file", "timezone-file", timezoneFile)
+	if err := fsutil.WriteFileAtomically(timezoneFile, []byte(timezone+"\n"), 0644); err != nil {
+		logger.Error("failed writing timezone file", "reason", err)
+		return errors.Wrap(err, "timezone file write failed")
+	}
+
+	return nil
+}
+
+// InjectNTPServers writes the configuration of every time synchronization daemon found in the root file system.
+func InjectNTPServers(logger hclog.Logger, mmdsData *mmds.MMDSData, rootPath string) error {
+
+	servers := []string{}
+	for _, server := range mmdsData.NTPServers {
+		if server = strings.TrimSpace(server); server != "" {
+			if strings.ContainsAny(server, " \t\n\r#") {
+				logger.Error("invalid NTP server", "server", server)
+				return fmt.Errorf("invalid NTP server: '%s'", server)
+			}
+			servers = append(servers, server)
+		}
+	}
+
+	if len(servers) == 0 {
+		logger.Debug("no NTP servers, nothing to do")
+		return nil // nothing to do
+	}
+
+	configured := map[string]bool{}
+	for _, daemon := range ntpDaemons {
+		if configured[daemon.name] {
+			continue // the two chrony layouts are exclusive
+		}
+		detected := false
+		for _, detectPath := range daemon.detectPaths {
+			exists, err := pathExists(filepath.Join(rootPath, detectPath))
+			if err != nil {
+				logger.Error("failed detecting time synchronization daemon", "daemon", daemon.name, "reason", err)
+				return err
+			}
+			if exists {
+				detected = true
+				break
+			}
+		}
+		if !detected {
+			continue
+		}
+
+		if err := writeNTPDaemonConfig(logger, daemon, rootPath, servers); err != nil {
+			logger.Error("failed writing time synchronization daemon configuration", "daemon", daemon.name, "reason", err)
+			return errors.Wrapf(err, "%s configuration write failed", daemon.name)
+		}
+		configured[daemon.name] = true
+	}
+
+	if len(configured) == 0 {
+		logger.Warn("no time synchronization daemon found in the root file system, NTP servers not configured")
+	}
+
+	return nil
+}
+
+// writeNTPDaemonConfig writes the drop-in file and includes it in the existing config file,
+// the config file is written only when it doesn't exist or the daemon has no drop-in file.
+func writeNTPDaemonConfig(logger hclog.Logger, daemon *ntpDaemon, rootPath string, servers []string) error {
+	configFile := filepath.Join(rootPath, daemon.configFile)
+	configBytes, err := ioutil.ReadFile(configFile)
+	if daemon.dropInFile == "" || os.IsNotExist(err) {
+		logger.Debug("writing time synchronization daemon configuration", "daemon", daemon.name, "config-file", configFile)
+		return fsutil.WriteFileAtomically(configFile, []byte(daemon.render(servers)), 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	dropInFile := filepath.Join(rootPath, daemon.dropInFile)
+	logger.Debug("writing time synchronization daemon drop-in configuration", "daemon", daemon.name, "drop-in-file", dropInFile)
+	if err := fsutil.WriteFileAtomically(dropInFile, []byte(daemon.renderDropIn(servers)), 0644); err != nil {
+		return err
+	}
+
+	// the guest resolves the include, it must not contain the root path:
+	includeLine := "include /" + daemon.dropInFile
+	for _, line := range strings.Split(string(configBytes), "\n") {
+		if strings.Join(strings.Fields(line), " ") == includeLine {
+			return nil // included by an earlier boot
+		}
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	if len(configBytes) > 0 && !strings.HasSuffix(string(configBytes), "\n") {
+		configBytes = append(configBytes, '\n')
+	}
+	configBytes = append(configBytes, []byte(includeLine+"\n")...)
+	logger.Debug("including drop-in configuration", "daemon", daemon.name, "config-file", configFile)
+	return fsutil.WriteFileAtomically(configFile, configBytes, info.Mode().Perm())
+}
+
+func renderChronyDropIn(servers []string) string {
+	output := managedFileHeader
+	for _, server := range servers {
+		output = fmt.Sprintf("%sserver %s iburst\n", output, server)
+	}
+	return output
+}
+
+func renderChronyConfig(servers []string) string {
+	output := managedFileHeader
+	for _, server := range servers {
+		output = fmt.Sprintf("%sserver %s iburst\n", output, server)
+	}
+	return output + "driftfile /var/lib/chrony/drift\nmakestep 1.0 3\nrtcsync\n"
+}
+
+func renderNtpdConfig(servers []string) string {
+	output := managedFileHeader + "driftfile /var/lib/ntp/ntp.drift\n"
+	for _, server := range servers {
+		output = fmt.Sprintf("%sserver %s iburst\n", output, server)
+	}
+	return output
+}
+
+func renderTimesyncdConfig(servers []string) string {
+	return fmt.Sprintf("%s[Time]\nNTP=%s\n", managedFileHeader, strings.Join(servers, " "))
+}
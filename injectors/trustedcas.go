@@ -0,0 +1,221 @@
+package injectors
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+)
+
+const trustedCAFilePrefix = "firebuild-"
+
+// trustStoreLayout describes where a distribution keeps the trust anchors and the generated bundle.
+// Paths are relative to the root path.
+type trustStoreLayout struct {
+	detectPath       string
+	anchorsDirectory string
+	bundleFile       string
+}
+
+// trustStoreLayouts lists known layouts in the order of detection, the last one is the default.
+var trustStoreLayouts = []*trustStoreLayout{
+	{
+		// RHEL, CentOS, Fedora, Amazon Linux:
+		detectPath:       "etc/pki/ca-trust",
+		anchorsDirectory: "etc/pki/ca-trust/source/anchors",
+		bundleFile:       "etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	},
+	{
+		// Debian, Ubuntu, Alpine:
+		detectPath:       "usr/local/share/ca-certificates",
+		anchorsDirectory: "usr/local/share/ca-certificates",
+		bundleFile:       "etc/ssl/certs/ca-certificates.crt",
+	},
+}
+
+// InjectTrustedCAs installs the trusted CA certificates into the system trust store
+// and regenerates the CA bundle file.
+// Certificates installed by a previous run and no longer present in the metadata are removed.
+func InjectTrustedCAs(logger hclog.Logger, mmdsData *mmds.MMDSData, rootPath string) error {
+
+	layout, err := detectTrustStoreLayout(rootPath)
+	if err != nil {
+		logger.Error("failed detecting trust store layout", "reason", err)
+		return err
+	}
+
+	anchorsDirectory := filepath.Join(rootPath, layout.anchorsDirectory)
+	bundleFile := filepath.Join(rootPath, layout.bundleFile)
+
+	previousFiles, err := filepath.Glob(filepath.Join(anchorsDirectory, trustedCAFilePrefix+"*.crt"))
+	if err != nil {
+		return err
+	}
+
+	if len(mmdsData.TrustedCAs) == 0 && len(previousFiles) == 0 {
+		logger.Debug("no trusted CAs, nothing to do")
+		return nil // nothing to do
+	}
+
+	// validate everything before changing the trust store:
+	names := []string{}
+	for name := range mmdsData.TrustedCAs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	installFiles := map[string][]*x509.Certificate{}
+	installOrder := []string{}
+	for _, name := range names {
+		certs, err := parseCertificatesPEM([]byte(mmdsData.TrustedCAs[name]))
+		if err != nil {
+			logger.Error("invalid trusted CA", "name", name, "reason", err)
+			return errors.Wrapf(err, "invalid trusted CA '%s'", name)
+		}
+		for _, cert := range certs {
+			if !cert.IsCA {
+				logger.Warn("trusted certificate is not a CA certificate", "name", name, "subject", cert.Subject.String())
+			}
+			if time.Now().After(cert.NotAfter) {
+				logger.Warn("trusted certificate expired", "name", name, "subject", cert.Subject.String(), "not-after", cert.NotAfter)
+			}
+		}
+		fileName := filepath.Join(anchorsDirectory, trustedCAFilePrefix+sanitizeTrustedCAName(name)+".crt")
+		if _, ok := installFiles[fileName]; ok {
+			return fmt.Errorf("trusted CA name '%s' conflicts with another name", name)
+		}
+		installFiles[fileName] = certs
+		installOrder = append(installOrder, fileName)
+	}
+
+	// certificates from the previous run must be removed from the bundle:
+	removeFromBundle := map[[32]byte]struct{}{}
+	for _, previousFile := range previousFiles {
+		previousBytes, err := ioutil.ReadFile(previousFile)
+		if err != nil {
+			logger.Error("failed reading previously installed trusted CA", "path", previousFile, "reason", err)
+			return err
+		}
+		previousCerts, err := parseCertificatesPEM(previousBytes)
+		if err != nil {
+			logger.Warn("previously installed trusted CA invalid, removing", "path", previousFile, "reason", err)
+		}
+		for _, cert := range previousCerts {
+			removeFromBundle[sha256.Sum256(cert.Raw)] = struct{}{}
+		}
+		if _, ok := installFiles[previousFile]; !ok {
+			logger.Debug("removing previously installed trusted CA", "path", previousFile)
+			if err := os.Remove(previousFile); err != nil {
+				return errors.Wrap(err, "failed removing previously installed trusted CA")
+			}
+		}
+	}
+
+	bundleCertsToAppend := []*x509.Certificate{}
+	for _, fileName := range installOrder {
+		logger.Debug("installing trusted CA", "path", fileName, "number-of-certificates", len(installFiles[fileName]))
+		if err := fsutil.WriteFileAtomically(fileName, encodeCertificatesPEM(installFiles[fileName]), 0644); err != nil {
+			logger.Error("failed writing trusted CA", "path", fileName, "reason", err)
+			return errors.Wrap(err, "trusted CA write failed")
+		}
+		for _, cert := range installFiles[fileName] {
+			removeFromBundle[sha256.Sum256(cert.Raw)] = struct{}{}
+			bundleCertsToAppend = append(bundleCertsToAppend, cert)
+		}
+	}
+
+	// regenerate the bundle: keep what the distribution put there, replace what we manage:
+	bundleBytes, err := ioutil.ReadFile(bundleFile)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("failed reading CA bundle", "path", bundleFile, "reason", err)
+		return err
+	}
+	newBundle := []byte{}
+	for {
+		block, remaining := pem.Decode(bundleBytes)
+		if block == nil {
+			break
+		}
+		bundleBytes = remaining
+		if block.Type == "CERTIFICATE" {
+			if _, ok := removeFromBundle[sha256.Sum256(block.Bytes)]; ok {
+				continue
+			}
+		}
+		newBundle = append(newBundle, pem.EncodeToMemory(block)...)
+	}
+	newBundle = append(newBundle, encodeCertificatesPEM(bundleCertsToAppend)...)
+
+	logger.Debug("writing CA bundle", "path", bundleFile, "number-of-managed-certificates", len(bundleCertsToAppend))
+
+	if err := fsutil.WriteFileAtomically(bundleFile, newBundle, 0644); err != nil {
+		logger.Error("failed writing CA bundle", "path", bundleFile, "reason", err)
+		return errors.Wrap(err, "CA bundle write failed")
+	}
+
+	return nil
+}
+
+func detectTrustStoreLayout(rootPath string) (*trustStoreLayout, error) {
+	for _, layout := range trustStoreLayouts {
+		exists, err := pathExists(filepath.Join(rootPath, layout.detectPath))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return layout, nil
+		}
+	}
+	return trustStoreLayouts[len(trustStoreLayouts)-1], nil
+}
+
+func parseCertificatesPEM(input []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		block, remaining := pem.Decode(input)
+		if block == nil {
+			break
+		}
+		input = remaining
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type '%s'", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed parsing certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+func encodeCertificatesPEM(certs []*x509.Certificate) []byte {
+	output := []byte{}
+	for _, cert := range certs {
+		output = append(output, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return output
+}
+
+func sanitizeTrustedCAName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -1,18 +1,46 @@
 package mmds
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/combust-labs/firebuild-mmds/fsutil"
 	"github.com/mitchellh/mapstructure"
 )
 
 var (
-	defaultPingInterval = time.Second * 5
+	defaultCacheDriveFSType     = "ext4"
+	defaultFileMode             = fs.FileMode(0644)
+	defaultPingFailureThreshold = 3
+	defaultPingInterval         = time.Second * 5
+	defaultPTYColumns           = uint16(80)
+	defaultPTYRows              = uint16(24)
 )
 
+// defaultSealPaths are removed by the sealing unless the paths are given: temporary files, package caches and shell history.
+var defaultSealPaths = []string{
+	"/tmp/*",
+	"/var/tmp/*",
+	"/var/cache/apk/*",
+	"/var/cache/apt/archives/*.deb",
+	"/var/cache/dnf/*",
+	"/var/cache/yum/*",
+	"/var/lib/apt/lists/*",
+	"/root/.ash_history",
+	"/root/.bash_history",
+	"/home/*/.ash_history",
+	"/home/*/.bash_history",
+}
+
 type MMDSLatest struct {
 	Latest *MMDSLatestMetadata `json:"latest" mapstructure:"latest"`
 }
@@ -30,16 +58,23 @@ type MMDSLatestMetadata struct {
 }
 
 type MMDSData struct {
-	Bootstrap      *MMDSBootstrap        `json:"Bootstrap,omitempty" mapstructure:"Bootstrap,omitempty"`
-	VMMID          string                `json:"VMMID" mapstructure:"VMMID"`
-	Drives         map[string]*MMDSDrive `json:"Drives" mapstructure:"Drives"`
-	EntrypointJSON string                `json:"EntrypointJSON" mapstructure:"EntrypointJSON"`
-	Env            map[string]string     `json:"Env" mapstructure:"Env"`
-	LocalHostname  string                `json:"LocalHostname" mapstructure:"LocalHostname"`
-	Machine        *MMDSMachine          `json:"Machine" mapstructure:"Machine"`
-	Network        *MMDSNetwork          `json:"Network" mapstructure:"Network"`
-	ImageTag       string                `json:"ImageTag" mapstructure:"ImageTag"`
-	Users          map[string]*MMDSUser  `json:"Users" mapstructure:"Users"`
+	Bootstrap      *MMDSBootstrap         `json:"Bootstrap,omitempty" mapstructure:"Bootstrap,omitempty"`
+	VMMID          string                 `json:"VMMID" mapstructure:"VMMID"`
+	Drives         map[string]*MMDSDrive  `json:"Drives" mapstructure:"Drives"`
+	EntrypointJSON string                 `json:"EntrypointJSON" mapstructure:"EntrypointJSON"`
+	Env            map[string]string      `json:"Env" mapstructure:"Env"`
+	Files          []*MMDSFile            `json:"Files" mapstructure:"Files"`
+	LocalHostname  string                 `json:"LocalHostname" mapstructure:"LocalHostname"`
+	Locale         string                 `json:"Locale" mapstructure:"Locale"`
+	Machine        *MMDSMachine           `json:"Machine" mapstructure:"Machine"`
+	Network        *MMDSNetwork           `json:"Network" mapstructure:"Network"`
+	NTPServers     []string               `json:"NTPServers" mapstructure:"NTPServers"`
+	ImageTag       string                 `json:"ImageTag" mapstructure:"ImageTag"`
+	Scripts        map[string]*MMDSScript `json:"Scripts" mapstructure:"Scripts"`
+	Sysctls        map[string]string      `json:"Sysctls" mapstructure:"Sysctls"`
+	Timezone       string                 `json:"Timezone" mapstructure:"Timezone"`
+	TrustedCAs     map[string]string      `json:"TrustedCAs" mapstructure:"TrustedCAs"`
+	Users          map[string]*MMDSUser   `json:"Users" mapstructure:"Users"`
 }
 
 type MMDSBootstrap struct {
@@ -49,22 +84,273 @@ type MMDSBootstrap struct {
 	Key          string `json:"Key" mapstructure:"Key"`
 	ServerName   string `json:"ServerName" mapstructure:"ServerName"`
 	PingInterval string `json:"PingInterval" mapstructure:"PingInterval"`
+	// PingFailureThreshold is the number of consecutive failed pings aborting the build.
+	PingFailureThreshold string `json:"PingFailureThreshold" mapstructure:"PingFailureThreshold"`
+	// PingJitter is the upper bound of a random duration added to every ping interval.
+	PingJitter string `json:"PingJitter" mapstructure:"PingJitter"`
+	// PTY runs the RUN commands attached to a pseudo-terminal when true.
+	PTY string `json:"PTY" mapstructure:"PTY"`
+	// PTYColumns is the width of the pseudo-terminal.
+	PTYColumns string `json:"PTYColumns" mapstructure:"PTYColumns"`
+	// PTYKeepANSI keeps the ANSI escape sequences in the pseudo-terminal output when true.
+	PTYKeepANSI string `json:"PTYKeepANSI" mapstructure:"PTYKeepANSI"`
+	// PTYRows is the height of the pseudo-terminal.
+	PTYRows string `json:"PTYRows" mapstructure:"PTYRows"`
+	// CommandTimeout limits the execution time of a single RUN command, no limit when empty.
+	CommandTimeout string `json:"CommandTimeout" mapstructure:"CommandTimeout"`
+	// BuildTimeout limits the execution time of the whole bootstrap, no limit when empty.
+	BuildTimeout string `json:"BuildTimeout" mapstructure:"BuildTimeout"`
+	// ManifestPaths is a comma separated list of directories scanned for the changes of every step, no manifest when empty.
+	ManifestPaths string `json:"ManifestPaths" mapstructure:"ManifestPaths"`
+	// Cache skips the steps recorded in the rootfs by a previous build up to the first changed step when true.
+	Cache string `json:"Cache" mapstructure:"Cache"`
+	// Secrets are the build secrets by ID, mounted with RUN --mount=type=secret for the duration of the command.
+	Secrets map[string]string `json:"Secrets" mapstructure:"Secrets"`
+	// CacheDrive is the ID of the drive holding the RUN --mount=type=cache directories, the caches last for a single build when empty.
+	CacheDrive string `json:"CacheDrive" mapstructure:"CacheDrive"`
+	// CacheDriveFSType is the file system of the cache drive, ext4 when empty.
+	CacheDriveFSType string `json:"CacheDriveFSType" mapstructure:"CacheDriveFSType"`
+	// Seal removes the build-time state from the rootfs after a successful build when true.
+	Seal string `json:"Seal" mapstructure:"Seal"`
+	// SealPaths is a comma separated list of absolute glob patterns removed by the sealing, the default paths when empty.
+	SealPaths string `json:"SealPaths" mapstructure:"SealPaths"`
+	// SealZeroFreeSpace fills the free space of the rootfs with zeros when sealing, the image compresses better.
+	SealZeroFreeSpace string `json:"SealZeroFreeSpace" mapstructure:"SealZeroFreeSpace"`
 }
 
+// SafePingInterval returns the ping interval, the default one when not positive.
 func (b *MMDSBootstrap) SafePingInterval() time.Duration {
 	duration, err := time.ParseDuration(b.PingInterval)
-	if err != nil {
+	if err != nil || duration <= 0 {
 		return defaultPingInterval
 	}
 	return duration
 }
 
+// SafePingFailureThreshold returns the number of consecutive failed pings aborting the build.
+func (b *MMDSBootstrap) SafePingFailureThreshold() int {
+	threshold, err := strconv.Atoi(b.PingFailureThreshold)
+	if err != nil || threshold < 1 {
+		return defaultPingFailureThreshold
+	}
+	return threshold
+}
+
+// SafePingJitter returns the ping jitter, zero means no jitter.
+func (b *MMDSBootstrap) SafePingJitter() time.Duration {
+	return safeDuration(b.PingJitter)
+}
+
+// SafePTY returns true if the RUN commands run attached to a pseudo-terminal.
+func (b *MMDSBootstrap) SafePTY() bool {
+	value, err := strconv.ParseBool(b.PTY)
+	return err == nil && value
+}
+
+// SafePTYKeepANSI returns true if the ANSI escape sequences are kept in the pseudo-terminal output.
+func (b *MMDSBootstrap) SafePTYKeepANSI() bool {
+	value, err := strconv.ParseBool(b.PTYKeepANSI)
+	return err == nil && value
+}
+
+// SafePTYSize returns the rows and the columns of the pseudo-terminal.
+func (b *MMDSBootstrap) SafePTYSize() (uint16, uint16) {
+	return safeUint16(b.PTYRows, defaultPTYRows), safeUint16(b.PTYColumns, defaultPTYColumns)
+}
+
+// SafeCommandTimeout returns the RUN command timeout, zero means no timeout.
+func (b *MMDSBootstrap) SafeCommandTimeout() time.Duration {
+	return safeDuration(b.CommandTimeout)
+}
+
+// SafeBuildTimeout returns the bootstrap timeout, zero means no timeout.
+func (b *MMDSBootstrap) SafeBuildTimeout() time.Duration {
+	return safeDuration(b.BuildTimeout)
+}
+
+// SafeCache returns true if the steps completed by a previous build on the same rootfs are skipped.
+func (b *MMDSBootstrap) SafeCache() bool {
+	value, err := strconv.ParseBool(b.Cache)
+	return err == nil && value
+}
+
+// SafeManifestPaths returns the clean absolute directories scanned for the changes of every step,
+// relative paths are ignored.
+func (b *MMDSBootstrap) SafeManifestPaths() []string {
+	paths := []string{}
+	for _, path := range strings.Split(b.ManifestPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" || !filepath.IsAbs(path) {
+			continue
+		}
+		paths = append(paths, filepath.Clean(path))
+	}
+	return paths
+}
+
+// SafeCacheDriveFSType returns the file system of the cache drive.
+func (b *MMDSBootstrap) SafeCacheDriveFSType() string {
+	if b.CacheDriveFSType == "" {
+		return defaultCacheDriveFSType
+	}
+	return b.CacheDriveFSType
+}
+
+// SafeSeal returns true if the rootfs is sealed after a successful build.
+func (b *MMDSBootstrap) SafeSeal() bool {
+	value, err := strconv.ParseBool(b.Seal)
+	return err == nil && value
+}
+
+// SafeSealPaths returns the glob patterns removed by the sealing, the default patterns when none is given.
+func (b *MMDSBootstrap) SafeSealPaths() []string {
+	if strings.TrimSpace(b.SealPaths) == "" {
+		return append([]string{}, defaultSealPaths...)
+	}
+	paths := []string{}
+	for _, path := range strings.Split(b.SealPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// SafeSealZeroFreeSpace returns true if the free space of the rootfs is filled with zeros when sealing.
+func (b *MMDSBootstrap) SafeSealZeroFreeSpace() bool {
+	value, err := strconv.ParseBool(b.SealZeroFreeSpace)
+	return err == nil && value
+}
+
+func safeUint16(input string, defaultValue uint16) uint16 {
+	value, err := strconv.ParseUint(input, 10, 16)
+	if err != nil || value == 0 {
+		return defaultValue
+	}
+	return uint16(value)
+}
+
+func safeDuration(input string) time.Duration {
+	duration, err := time.ParseDuration(input)
+	if err != nil || duration < 0 {
+		return 0
+	}
+	return duration
+}
+
 type MMDSDrive struct {
 	DriveID      string `json:"DriveID" mapstructure:"DriveID"`
 	IsReadOnly   string `json:"IsReadOnly" mapstructure:"IsReadOnly"`
 	IsRootDevice string `json:"IsRootDevice" mapstructure:"IsRootDevice"`
 	Partuuid     string `json:"PartUUID" mapstructure:"PartUUID"`
 	PathOnHost   string `json:"PathOnHost" mapstructure:"PathOnHost"`
+	// GuestDevice is the block device of the drive in the guest, for example /dev/vdb.
+	GuestDevice string `json:"GuestDevice" mapstructure:"GuestDevice"`
+}
+
+// DriveDevice returns the guest block device of the drive.
+// The guest names the devices in the order Firecracker attaches the drives so the device is never derived from the drive ID:
+// it is the GuestDevice of the drive or, for a drive with a PartUUID, the device linked in the partUUIDDirectory.
+func (d *MMDSData) DriveDevice(driveID, partUUIDDirectory string) (string, error) {
+	drive, ok := d.Drives[driveID]
+	if !ok {
+		return "", fmt.Errorf("drive '%s' not found", driveID)
+	}
+	if drive.GuestDevice != "" {
+		if !filepath.IsAbs(drive.GuestDevice) {
+			return "", fmt.Errorf("drive '%s' guest device '%s' is not an absolute path", driveID, drive.GuestDevice)
+		}
+		return filepath.Clean(drive.GuestDevice), nil
+	}
+	if drive.Partuuid != "" {
+		if strings.ContainsAny(drive.Partuuid, "/") {
+			return "", fmt.Errorf("drive '%s' PartUUID '%s' is not valid", driveID, drive.Partuuid)
+		}
+		device, err := filepath.EvalSymlinks(filepath.Join(partUUIDDirectory, strings.ToLower(drive.Partuuid)))
+		if err != nil {
+			return "", fmt.Errorf("drive '%s' with PartUUID '%s' not found: %v", driveID, drive.Partuuid, err)
+		}
+		return device, nil
+	}
+	return "", fmt.Errorf("drive '%s' has no GuestDevice and no PartUUID, its guest device is not known", driveID)
+}
+
+// File encodings supported by MMDSFile.
+const (
+	FileEncodingPlain      = "plain"
+	FileEncodingBase64     = "base64"
+	FileEncodingGzipBase64 = "gzip+base64"
+)
+
+type MMDSFile struct {
+	Path     string `json:"Path" mapstructure:"Path"`
+	Content  string `json:"Content" mapstructure:"Content"`
+	Encoding string `json:"Encoding" mapstructure:"Encoding"`
+	Owner    string `json:"Owner" mapstructure:"Owner"`
+	Group    string `json:"Group" mapstructure:"Group"`
+	Mode     string `json:"Mode" mapstructure:"Mode"`
+	Append   bool   `json:"Append" mapstructure:"Append"`
+}
+
+// DecodedContent returns the file content decoded according to the file encoding.
+func (f *MMDSFile) DecodedContent() ([]byte, error) {
+	switch strings.ToLower(f.Encoding) {
+	case "", FileEncodingPlain:
+		return []byte(f.Content), nil
+	case FileEncodingBase64, "b64":
+		return base64.StdEncoding.DecodeString(f.Content)
+	case FileEncodingGzipBase64, "gz+base64", "gzip+b64", "gz+b64":
+		compressed, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	default:
+		return nil, fmt.Errorf("unsupported file encoding: '%s'", f.Encoding)
+	}
+}
+
+// FileMode returns the octal file mode, 0644 if mode is not set.
+func (f *MMDSFile) FileMode() (fs.FileMode, error) {
+	if f.Mode == "" {
+		return defaultFileMode, nil
+	}
+	mode, err := fsutil.ParseOctalMode(f.Mode)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode: '%s'", f.Mode)
+	}
+	return mode, nil
+}
+
+// Script frequencies supported by MMDSScript.
+const (
+	ScriptFrequencyAlways      = "always"
+	ScriptFrequencyPerBoot     = "per-boot"
+	ScriptFrequencyPerInstance = "per-instance"
+)
+
+type MMDSScript struct {
+	Content   string `json:"Content" mapstructure:"Content"`
+	Frequency string `json:"Frequency" mapstructure:"Frequency"`
+}
+
+// SafeFrequency returns the script frequency, per-instance if frequency is not set.
+func (s *MMDSScript) SafeFrequency() (string, error) {
+	switch s.Frequency {
+	case "":
+		return ScriptFrequencyPerInstance, nil
+	case ScriptFrequencyAlways, ScriptFrequencyPerBoot, ScriptFrequencyPerInstance:
+		return s.Frequency, nil
+	default:
+		return "", fmt.Errorf("unsupported script frequency: '%s'", s.Frequency)
+	}
 }
 
 type MMDSNetwork struct {
@@ -105,6 +391,27 @@ type MMDSRootfsEntrypointInfo struct {
 	Workdir    string            `json:"Workdir" mapstructure:"Workdir"`
 }
 
+// MMDSImageConfig is the final configuration of a built image, persisted in the rootfs by the bootstrap.
+// It is a superset of the entrypoint info.
+type MMDSImageConfig struct {
+	MMDSRootfsEntrypointInfo `mapstructure:",squash"`
+	ExposedPorts             []string          `json:"ExposedPorts" mapstructure:"ExposedPorts"`
+	Labels                   map[string]string `json:"Labels" mapstructure:"Labels"`
+	StopSignal               string            `json:"StopSignal" mapstructure:"StopSignal"`
+	Volumes                  []string          `json:"Volumes" mapstructure:"Volumes"`
+}
+
+// NewMMDSImageConfigFromJSON deserializes a JSON string to a *MMDSImageConfig.
+func NewMMDSImageConfigFromJSON(input string) (*MMDSImageConfig, error) {
+	output := &MMDSImageConfig{}
+	return output, json.Unmarshal([]byte(input), output)
+}
+
+// EntrypointInfo returns the entrypoint info of the image config.
+func (inst *MMDSImageConfig) EntrypointInfo() *MMDSRootfsEntrypointInfo {
+	return &inst.MMDSRootfsEntrypointInfo
+}
+
 // NewMMDSRootfsEntrypointInfoFromJSON deserializes a JSON string to a *MMDSRootfsEntrypointInfo.
 func NewMMDSRootfsEntrypointInfoFromJSON(input string) (*MMDSRootfsEntrypointInfo, error) {
 	output := &MMDSRootfsEntrypointInfo{}
@@ -0,0 +1,55 @@
+package mmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafePingInterval(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":      defaultPingInterval,
+		"fast":  defaultPingInterval,
+		"0s":    defaultPingInterval,
+		"-1s":   defaultPingInterval,
+		"250ms": time.Millisecond * 250,
+	} {
+		assert.Equal(t, expected, (&MMDSBootstrap{PingInterval: value}).SafePingInterval(), value)
+	}
+}
+
+func TestDriveDevice(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	device := filepath.Join(tempDir, "vdc")
+	assert.Nil(t, ioutil.WriteFile(device, []byte{}, 0600))
+	assert.Nil(t, os.Symlink(device, filepath.Join(tempDir, "0ab1cd2e-01")))
+
+	data := &MMDSData{Drives: map[string]*MMDSDrive{
+		"1":     {DriveID: "1", IsRootDevice: "true"},
+		"2":     {DriveID: "2", GuestDevice: "/dev/vdb"},
+		"cache": {DriveID: "cache", Partuuid: "0AB1CD2E-01"},
+		"other": {DriveID: "other", GuestDevice: "vdd"},
+	}}
+
+	resolved, err := data.DriveDevice("2", tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/vdb", resolved)
+	resolved, err = data.DriveDevice("cache", tempDir)
+	assert.Nil(t, err)
+	assert.Equal(t, device, resolved)
+
+	// the device is never guessed from the drive ID:
+	for _, driveID := range []string{"1", "other", "missing"} {
+		_, err = data.DriveDevice(driveID, tempDir)
+		assert.NotNil(t, err, driveID)
+	}
+}
@@ -0,0 +1,203 @@
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// User is an entry of the passwd database.
+type User struct {
+	Name  string
+	Uid   int
+	Gid   int
+	Home  string
+	Shell string
+}
+
+// Group is an entry of the group database.
+type Group struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+// UnknownUserError is returned when a user can't be found in the passwd database.
+type UnknownUserError struct {
+	User string
+}
+
+func (e *UnknownUserError) Error() string {
+	return fmt.Sprintf("unknown user: '%s'", e.User)
+}
+
+// UnknownGroupError is returned when a group can't be found in the group database.
+type UnknownGroupError struct {
+	Group string
+}
+
+func (e *UnknownGroupError) Error() string {
+	return fmt.Sprintf("unknown group: '%s'", e.Group)
+}
+
+// Database is a users and groups database loaded from passwd and group files.
+type Database struct {
+	users  []*User
+	groups []*Group
+}
+
+// NewDatabaseFromFiles loads the users and groups database from the passwd and group files.
+// A file which does not exist results in an empty part of the database.
+func NewDatabaseFromFiles(passwdFile, groupFile string) (*Database, error) {
+	db := &Database{users: []*User{}, groups: []*Group{}}
+	if err := readDatabaseFile(passwdFile, func(fields []string) error {
+		if len(fields) < 7 {
+			return fmt.Errorf("invalid passwd entry: '%s'", strings.Join(fields, ":"))
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid passwd entry uid: '%s'", fields[2])
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("invalid passwd entry gid: '%s'", fields[3])
+		}
+		db.users = append(db.users, &User{
+			Name:  fields[0],
+			Uid:   uid,
+			Gid:   gid,
+			Home:  fields[5],
+			Shell: fields[6],
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := readDatabaseFile(groupFile, func(fields []string) error {
+		if len(fields) < 4 {
+			return fmt.Errorf("invalid group entry: '%s'", strings.Join(fields, ":"))
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid group entry gid: '%s'", fields[2])
+		}
+		members := []string{}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
+			}
+		}
+		db.groups = append(db.groups, &Group{
+			Name:    fields[0],
+			Gid:     gid,
+			Members: members,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// LookupUser finds a user by name or by a numeric uid.
+func (db *Database) LookupUser(nameOrID string) (*User, error) {
+	uid, numericErr := strconv.Atoi(nameOrID)
+	for _, user := range db.users {
+		if user.Name == nameOrID || (numericErr == nil && user.Uid == uid) {
+			return user, nil
+		}
+	}
+	return nil, &UnknownUserError{User: nameOrID}
+}
+
+// LookupGroup finds a group by name or by a numeric gid.
+func (db *Database) LookupGroup(nameOrID string) (*Group, error) {
+	gid, numericErr := strconv.Atoi(nameOrID)
+	for _, group := range db.groups {
+		if group.Name == nameOrID || (numericErr == nil && group.Gid == gid) {
+			return group, nil
+		}
+	}
+	return nil, &UnknownGroupError{Group: nameOrID}
+}
+
+// ResolveOwner resolves a user and a group, each given as a name or a numeric ID, to a uid and a gid.
+// Numeric IDs do not need to exist in the database. When the group is empty,
+// the gid is the primary group of the user or, if the user is not in the database, the same as the uid.
+func (db *Database) ResolveOwner(user, group string) (int, int, error) {
+	uid, gid := -1, -1
+	userEntry, lookupErr := db.LookupUser(user)
+	if numericUid, err := strconv.Atoi(user); err == nil {
+		if numericUid < 0 {
+			return -1, -1, fmt.Errorf("invalid uid: '%s'", user)
+		}
+		uid = numericUid
+		gid = numericUid
+		if lookupErr == nil {
+			gid = userEntry.Gid
+		}
+	} else {
+		if lookupErr != nil {
+			return -1, -1, lookupErr
+		}
+		uid = userEntry.Uid
+		gid = userEntry.Gid
+	}
+	if group == "" {
+		return uid, gid, nil
+	}
+	if numericGid, err := strconv.Atoi(group); err == nil {
+		if numericGid < 0 {
+			return -1, -1, fmt.Errorf("invalid gid: '%s'", group)
+		}
+		return uid, numericGid, nil
+	}
+	groupEntry, err := db.LookupGroup(group)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, groupEntry.Gid, nil
+}
+
+// SupplementaryGroups returns the gids of all groups listing the user as a member.
+func (db *Database) SupplementaryGroups(username string) []int {
+	gids := []int{}
+	for _, group := range db.groups {
+		for _, member := range group.Members {
+			if member == username {
+				gids = append(gids, group.Gid)
+				break
+			}
+		}
+	}
+	return gids
+}
+
+func readDatabaseFile(path string, lineFunc func([]string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return readDatabase(file, lineFunc)
+}
+
+func readDatabase(reader io.Reader, lineFunc func([]string) error) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := lineFunc(strings.Split(line, ":")); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
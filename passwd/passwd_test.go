@@ -0,0 +1,111 @@
+package passwd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/sh
+# comment
+app:x:1000:1001:application:/home/app:/bin/sh
+`
+
+const testGroup = `root:x:0:
+app:x:1001:
+docker:x:998:app,other
+`
+
+func mustLoadTestDatabase(t *testing.T) *Database {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	passwdFile := filepath.Join(tempDir, "passwd")
+	groupFile := filepath.Join(tempDir, "group")
+	if err := ioutil.WriteFile(passwdFile, []byte(testPasswd), 0644); err != nil {
+		t.Fatal("expected passwd file to be written:", err)
+	}
+	if err := ioutil.WriteFile(groupFile, []byte(testGroup), 0644); err != nil {
+		t.Fatal("expected group file to be written:", err)
+	}
+
+	db, err := NewDatabaseFromFiles(passwdFile, groupFile)
+	if err != nil {
+		t.Fatal("expected database to be loaded:", err)
+	}
+	return db
+}
+
+func TestDatabaseLookups(t *testing.T) {
+	db := mustLoadTestDatabase(t)
+
+	user, err := db.LookupUser("app")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, user.Uid)
+	assert.Equal(t, 1001, user.Gid)
+	assert.Equal(t, "/home/app", user.Home)
+
+	user, err = db.LookupUser("0")
+	assert.Nil(t, err)
+	assert.Equal(t, "root", user.Name)
+
+	_, err = db.LookupUser("nobody")
+	assert.IsType(t, &UnknownUserError{}, err)
+
+	group, err := db.LookupGroup("docker")
+	assert.Nil(t, err)
+	assert.Equal(t, 998, group.Gid)
+
+	_, err = db.LookupGroup("1234")
+	assert.IsType(t, &UnknownGroupError{}, err)
+
+	assert.Equal(t, []int{998}, db.SupplementaryGroups("app"))
+
+	// missing files result in an empty database:
+	emptyDB, err := NewDatabaseFromFiles("/non-existent/passwd", "/non-existent/group")
+	assert.Nil(t, err)
+	_, err = emptyDB.LookupUser("root")
+	assert.NotNil(t, err)
+}
+
+func TestResolveOwner(t *testing.T) {
+	db := mustLoadTestDatabase(t)
+
+	uid, gid, err := db.ResolveOwner("app", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1001, gid)
+
+	uid, gid, err = db.ResolveOwner("app", "docker")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 998, gid)
+
+	uid, gid, err = db.ResolveOwner("1000", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1001, gid)
+
+	// numeric IDs not in the database:
+	uid, gid, err = db.ResolveOwner("2000", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, uid)
+	assert.Equal(t, 2000, gid)
+
+	uid, gid, err = db.ResolveOwner("app", "3000")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 3000, gid)
+
+	_, _, err = db.ResolveOwner("nobody", "")
+	assert.IsType(t, &UnknownUserError{}, err)
+
+	_, _, err = db.ResolveOwner("app", "nogroup")
+	assert.IsType(t, &UnknownGroupError{}, err)
+}
@@ -0,0 +1,255 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/combust-labs/firebuild-mmds/fsutil"
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/pkg/errors"
+)
+
+const (
+	currentInstanceLink = "instance"
+	instancesDirectory  = "instances"
+	instanceStateFile   = "state.json"
+	maxRunHistory       = 50
+)
+
+// Injector result statuses.
+const (
+	InjectorStatusFailed  = "failed"
+	InjectorStatusSuccess = "success"
+)
+
+// InjectorResult records the outcome of a single injector.
+type InjectorResult struct {
+	Name       string    `json:"Name"`
+	Status     string    `json:"Status"`
+	Error      string    `json:"Error,omitempty"`
+	StartedAt  time.Time `json:"StartedAt"`
+	FinishedAt time.Time `json:"FinishedAt"`
+}
+
+// Run records a single vminit execution.
+type Run struct {
+	BootID       string            `json:"BootID"`
+	MetadataHash string            `json:"MetadataHash"`
+	StartedAt    time.Time         `json:"StartedAt"`
+	FinishedAt   *time.Time        `json:"FinishedAt,omitempty"`
+	ExitCode     *int              `json:"ExitCode,omitempty"`
+	Injectors    []*InjectorResult `json:"Injectors"`
+}
+
+// InstanceState is the persisted state of an instance identified by the VMMID.
+type InstanceState struct {
+	VMMID        string    `json:"VMMID"`
+	MetadataHash string    `json:"MetadataHash"`
+	FirstSeenAt  time.Time `json:"FirstSeenAt"`
+	Runs         []*Run    `json:"Runs"`
+}
+
+// InstanceChange describes how the current run relates to what vminit recorded previously.
+type InstanceChange struct {
+	// PreviousVMMID is the VMMID of the instance vminit ran for the last time, empty if none.
+	PreviousVMMID string
+	// IsNewInstance is true when the VMMID differs from the previous one, for example after a snapshot restore.
+	IsNewInstance bool
+	// IsFirstBoot is true when there is no recorded boot for this instance.
+	IsFirstBoot bool
+	// IsNewBoot is true when the boot ID differs from the last recorded run of this instance.
+	IsNewBoot bool
+	// MetadataChanged is true when the metadata hash differs from the last recorded run of this instance.
+	MetadataChanged bool
+}
+
+// CurrentRun returns the most recent run, nil if there are no runs.
+func (s *InstanceState) CurrentRun() *Run {
+	if s == nil || len(s.Runs) == 0 {
+		return nil
+	}
+	return s.Runs[len(s.Runs)-1]
+}
+
+// Record executes the injector function and records its result in the current run.
+// Returns the error returned by the injector function.
+// Calling Record on a nil instance state only executes the injector function.
+func (s *InstanceState) Record(name string, injectorFunc func() error) error {
+	result := &InjectorResult{
+		Name:      name,
+		StartedAt: time.Now().UTC(),
+	}
+	err := injectorFunc()
+	result.FinishedAt = time.Now().UTC()
+	result.Status = InjectorStatusSuccess
+	if err != nil {
+		result.Status = InjectorStatusFailed
+		result.Error = err.Error()
+	}
+	if run := s.CurrentRun(); run != nil {
+		run.Injectors = append(run.Injectors, result)
+	}
+	return err
+}
+
+// Finish marks the current run as finished with the exit code.
+func (s *InstanceState) Finish(exitCode int) {
+	if run := s.CurrentRun(); run != nil {
+		finishedAt := time.Now().UTC()
+		run.FinishedAt = &finishedAt
+		run.ExitCode = &exitCode
+	}
+}
+
+// Store manages the vminit state directory.
+type Store struct {
+	directory string
+}
+
+// NewStore returns a store for the state directory.
+func NewStore(directory string) *Store {
+	return &Store{directory: directory}
+}
+
+// InstanceDirectory returns the state directory of the instance.
+func (s *Store) InstanceDirectory(vmmID string) string {
+	return filepath.Join(s.directory, instancesDirectory, vmmID)
+}
+
+// Begin starts a new run for the instance, detects the instance change
+// and marks the instance as the current one.
+func (s *Store) Begin(vmmID, bootID, metadataHash string) (*InstanceState, *InstanceChange, error) {
+	if vmmID == "" || filepath.Base(vmmID) != vmmID || strings.HasPrefix(vmmID, ".") {
+		return nil, nil, errors.Errorf("invalid VMMID: '%s'", vmmID)
+	}
+
+	previousVMMID, err := s.CurrentInstance()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	instance, err := s.Load(vmmID)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			return nil, nil, err
+		}
+		instance = &InstanceState{
+			VMMID:       vmmID,
+			FirstSeenAt: time.Now().UTC(),
+			Runs:        []*Run{},
+		}
+	}
+
+	change := &InstanceChange{
+		PreviousVMMID:   previousVMMID,
+		IsNewInstance:   previousVMMID != vmmID,
+		IsFirstBoot:     len(instance.Runs) == 0,
+		IsNewBoot:       true,
+		MetadataChanged: instance.MetadataHash != metadataHash,
+	}
+	if lastRun := instance.CurrentRun(); lastRun != nil && bootID != "" {
+		change.IsNewBoot = lastRun.BootID != bootID
+	}
+
+	instance.MetadataHash = metadataHash
+	instance.Runs = append(instance.Runs, &Run{
+		BootID:       bootID,
+		MetadataHash: metadataHash,
+		StartedAt:    time.Now().UTC(),
+		Injectors:    []*InjectorResult{},
+	})
+	if len(instance.Runs) > maxRunHistory {
+		instance.Runs = instance.Runs[len(instance.Runs)-maxRunHistory:]
+	}
+
+	if err := s.Save(instance); err != nil {
+		return nil, nil, err
+	}
+	if err := s.setCurrentInstance(vmmID); err != nil {
+		return nil, nil, err
+	}
+
+	return instance, change, nil
+}
+
+// CurrentInstance returns the VMMID of the instance vminit ran for the last time, empty string if none.
+func (s *Store) CurrentInstance() (string, error) {
+	target, err := os.Readlink(filepath.Join(s.directory, currentInstanceLink))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "failed reading current instance link")
+	}
+	return filepath.Base(target), nil
+}
+
+// Instances returns the VMMIDs of all instances with a recorded state.
+func (s *Store) Instances() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.directory, instancesDirectory))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	vmmIDs := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			vmmIDs = append(vmmIDs, entry.Name())
+		}
+	}
+	sort.Strings(vmmIDs)
+	return vmmIDs, nil
+}
+
+// Load loads the state of the instance.
+func (s *Store) Load(vmmID string) (*InstanceState, error) {
+	stateBytes, err := ioutil.ReadFile(filepath.Join(s.InstanceDirectory(vmmID), instanceStateFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading instance state")
+	}
+	instance := &InstanceState{}
+	if err := json.Unmarshal(stateBytes, instance); err != nil {
+		return nil, errors.Wrap(err, "failed deserializing instance state")
+	}
+	return instance, nil
+}
+
+// Save writes the state of the instance.
+func (s *Store) Save(instance *InstanceState) error {
+	statePath := filepath.Join(s.InstanceDirectory(instance.VMMID), instanceStateFile)
+	return errors.Wrap(fsutil.WriteJSONAtomically(statePath, instance, 0600, 0700), "failed writing instance state")
+}
+
+func (s *Store) setCurrentInstance(vmmID string) error {
+	linkPath := filepath.Join(s.directory, currentInstanceLink)
+	return errors.Wrap(fsutil.SymlinkAtomically(filepath.Join(instancesDirectory, vmmID), linkPath), "failed updating current instance link")
+}
+
+// MetadataHash returns a stable hash of the metadata.
+func MetadataHash(mmdsData *mmds.MMDSData) (string, error) {
+	// encoding/json sorts map keys so the output is stable:
+	metadataBytes, err := json.Marshal(mmdsData)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(metadataBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// ReadBootID returns the kernel boot ID from the boot ID file.
+func ReadBootID(bootIDFile string) (string, error) {
+	bootIDBytes, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bootIDBytes)), nil
+}
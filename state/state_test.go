@@ -0,0 +1,80 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/combust-labs/firebuild-mmds/mmds"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceChangeDetection(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("expected temp dir, got error", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := NewStore(tempDir)
+
+	// first boot:
+	instance, change, err := store.Begin("vmm-1", "boot-1", "hash-1")
+	assert.Nil(t, err)
+	assert.Equal(t, &InstanceChange{IsNewInstance: true, IsFirstBoot: true, IsNewBoot: true, MetadataChanged: true}, change)
+	assert.Nil(t, instance.Record("ok", func() error { return nil }))
+	assert.NotNil(t, instance.Record("failing", func() error { return fmt.Errorf("boom") }))
+	instance.Finish(3)
+	assert.Nil(t, store.Save(instance))
+
+	loaded, err := store.Load("vmm-1")
+	assert.Nil(t, err)
+	run := loaded.CurrentRun()
+	assert.Equal(t, 3, *run.ExitCode)
+	assert.Equal(t, 2, len(run.Injectors))
+	assert.Equal(t, InjectorStatusSuccess, run.Injectors[0].Status)
+	assert.Equal(t, InjectorStatusFailed, run.Injectors[1].Status)
+	assert.Equal(t, "boom", run.Injectors[1].Error)
+
+	// vminit running again within the same boot:
+	_, change, err = store.Begin("vmm-1", "boot-1", "hash-1")
+	assert.Nil(t, err)
+	assert.Equal(t, &InstanceChange{PreviousVMMID: "vmm-1"}, change)
+
+	// reboot with changed metadata:
+	_, change, err = store.Begin("vmm-1", "boot-2", "hash-2")
+	assert.Nil(t, err)
+	assert.Equal(t, &InstanceChange{PreviousVMMID: "vmm-1", IsNewBoot: true, MetadataChanged: true}, change)
+
+	// snapshot restored as a new instance:
+	_, change, err = store.Begin("vmm-2", "boot-2", "hash-2")
+	assert.Nil(t, err)
+	assert.Equal(t, &InstanceChange{PreviousVMMID: "vmm-1", IsNewInstance: true, IsFirstBoot: true, IsNewBoot: true, MetadataChanged: true}, change)
+
+	current, err := store.CurrentInstance()
+	assert.Nil(t, err)
+	assert.Equal(t, "vmm-2", current)
+
+	instances, err := store.Instances()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vmm-1", "vmm-2"}, instances)
+
+	loaded, err = store.Load("vmm-1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(loaded.Runs))
+
+	_, _, err = store.Begin("../escape", "boot-2", "hash-2")
+	assert.NotNil(t, err)
+}
+
+func TestMetadataHash(t *testing.T) {
+	first, err := MetadataHash(&mmds.MMDSData{VMMID: "vmm-1", Sysctls: map[string]string{"a": "1", "b": "2"}})
+	assert.Nil(t, err)
+	second, err := MetadataHash(&mmds.MMDSData{VMMID: "vmm-1", Sysctls: map[string]string{"b": "2", "a": "1"}})
+	assert.Nil(t, err)
+	third, err := MetadataHash(&mmds.MMDSData{VMMID: "vmm-2"})
+	assert.Nil(t, err)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, third)
+}